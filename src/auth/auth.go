@@ -24,16 +24,17 @@ type Auth struct {
 	// Written once by NewAuth before any concurrent use, then read-only.
 	secretHashes [][]byte
 
-	// Cache of secrets already verified against a hash. Only successes are
-	// stored, so it is bounded by the number of configured secrets.
-	passwords map[string]bool
+	// Cache of secrets already verified against a hash, with its position.
+	// Only successes are stored, so it is bounded by the number of configured
+	// secrets.
+	passwords map[string]int
 	mu        sync.RWMutex
 }
 
 func NewAuth(envvar string) *Auth {
 	ret := &Auth{
 		secretHashes: make([][]byte, 0),
-		passwords:    make(map[string]bool),
+		passwords:    make(map[string]int),
 	}
 
 	for _, s := range strings.Split(envvar, ",") {
@@ -48,24 +49,32 @@ func NewAuth(envvar string) *Auth {
 }
 
 func (a *Auth) Authenticate(pwd string) bool {
+	_, ok := a.Identify(pwd)
+	return ok
+}
+
+// Identify is Authenticate, that also tells whose the secret is: the position,
+// from 1, of the hash it matches in the list. It's what identifies an uploader
+// in the logs, without giving away anything of the secret.
+func (a *Auth) Identify(pwd string) (int, bool) {
 	a.mu.RLock()
-	cached := a.passwords[pwd]
+	identity, cached := a.passwords[pwd]
 	a.mu.RUnlock()
 	if cached {
-		return true
+		return identity, true
 	}
 
 	// bcrypt is deliberately expensive, so it runs outside the lock: holding it
 	// here would serialize every authentication behind the slowest one, and a
 	// burst of wrong secrets (never cached, so always paying full price) would
 	// stall users whose secret is already cached.
-	for _, hash := range a.secretHashes {
+	for i, hash := range a.secretHashes {
 		if err := bcrypt.CompareHashAndPassword(hash, []byte(pwd)); err == nil {
 			a.mu.Lock()
-			a.passwords[pwd] = true
+			a.passwords[pwd] = i + 1
 			a.mu.Unlock()
-			return true
+			return i + 1, true
 		}
 	}
-	return false
+	return 0, false
 }
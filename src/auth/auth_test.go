@@ -22,7 +22,7 @@ import (
 // bcrypt hashes of "mysecret" and "other", cost 10.
 const (
 	hashMysecret = `$2a$10$I.NhoT1acD9XkXmXn1IMSOp0qhZDd63iSw1RfHZP7nzyg/ItX5eVa`
-	hashOther    = `$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy`
+	hashOther    = `$2a$10$hPGpJATJxKxOd0yzdjUoYu38rn6mUvEUXhRMqs.YMB7qJGJrpIMRG`
 )
 
 func TestAuthenticate(t *testing.T) {
@@ -89,3 +89,15 @@ func TestWrongSecretsDoNotStallCachedUser(t *testing.T) {
 		t.Errorf("cached authentication took %v while %d wrong secrets were verified", elapsed, attackers)
 	}
 }
+
+func TestIdentify(t *testing.T) {
+	a := NewAuth(hashMysecret + "," + hashOther)
+	for range 2 { // the second time, from the cache
+		if id, ok := a.Identify("other"); !ok || id != 2 {
+			t.Errorf("got %d, %v; want 2, true", id, ok)
+		}
+	}
+	if id, ok := a.Identify("wrong"); ok || id != 0 {
+		t.Errorf("wrong secret: got %d, %v", id, ok)
+	}
+}
@@ -0,0 +1,676 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/proofrock/fileway/client"
+	"github.com/proofrock/fileway/utils"
+)
+
+// The client modes of the binary. Without a subcommand it runs the server, as
+// it always did, so the docker images and existing deployments are unaffected.
+//
+// Exit codes follow fileway_ul.py: 1 for any failure, including an expired
+// transfer, and 130 when interrupted.
+
+const cliUsage = `Usage:
+  fileway                       Runs the server (configured via env vars)
+  fileway send [options] PATH   Uploads a file; PATH can be - for stdin
+  fileway send --zip [options] PATH...
+                                Zips files and dirs, then uploads the zip
+  fileway send --txt [options] TEXT...
+                                Sends a text
+  fileway receive [options] URL Downloads from a link given by an uploader, or
+                                from a named pipe
+  fileway admin [options] COMMAND
+                                Manages the transfers of a server
+  fileway version               Prints the version
+
+Run 'fileway send -h', 'fileway receive -h' or 'fileway admin -h' for the
+options.
+`
+
+// runCLI runs the subcommand in args[0]; the boolean is false when it isn't
+// one, and the server must start instead.
+func runCLI(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "send":
+		return waitForInterrupt(cliSend(args[1:])), true
+	case "receive":
+		return cliReceive(args[1:]), true
+	case "admin":
+		return cliAdmin(args[1:]), true
+	case "version":
+		fmt.Println(version)
+		return 0, true
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0, true
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n%s", args[0], cliUsage)
+		return 1, true
+	}
+}
+
+func cliSend(args []string) int {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	isTxt := fs.Bool("txt", false, "Send a text. Incompatible with --zip.")
+	isZip := fs.Bool("zip", false, "Zip the files and dirs, then send the zip. Incompatible with --txt.")
+	isSave := fs.Bool("save", false, "Save the secret to user home.")
+	name := fs.String("name", "", "File name for the recipient; mandatory when reading from stdin.")
+	server := fs.String("server", os.Getenv("FILEWAY_URL"), "Base URL of the server; defaults to $FILEWAY_URL.")
+	quiet := fs.Bool("quiet", false, "Don't print the progress.")
+	downloads := fs.Int("downloads", 1, "How many downloaders get the payload, all at once; each one uses the same link.")
+	spool := fs.Bool("spool", false, "Have the server keep the payload, so that you don't have to wait for the download; the server must allow it.")
+	digest := fs.Bool("digest", false, "Hash the payload first, so that the server and the downloader check that they get exactly that.")
+	e2e := fs.Bool("e2e", false, "End-to-end encrypt the payload: the server can't read it, and the key is in the link.")
+	resumeID := fs.String("resume", "", "Go on with an interrupted upload, given its id (the end of the link, with the key after the # if encrypted); same file as before.")
+	cancelID := fs.String("cancel", "", "Cancel an upload, given its id, instead of sending anything; the link stops working.")
+	pipe := fs.String("pipe", "", "Send on the named pipe NAME too, where the downloader may already be waiting; see 'fileway receive'.")
+	parallel := fs.Int("parallel", 1, "Send as many chunks of a file at once, each on a connection of its own; it can be faster on a far, lossy link.")
+	noConfirm := fs.Bool("no-confirm", false, "Don't wait for the downloader to confirm it got the whole payload, just for the server to have it.")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	payloads := fs.Args()
+
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "Error: no server. Use --server or set FILEWAY_URL.")
+		return 1
+	}
+	if *cancelID != "" {
+		secret, err := getSecret(*isSave)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		c := client.New(*server, secret)
+		c.UserAgent = "FilewayClient/" + version
+		if err := c.Cancel(context.Background(), *cancelID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Fprintln(os.Stderr, "The transfer is cancelled.")
+		return 0
+	}
+	if len(payloads) == 0 {
+		fmt.Fprintln(os.Stderr, "No files specified")
+		return 1
+	}
+	if *isTxt && *isZip {
+		fmt.Fprintln(os.Stderr, "Error: --txt and --zip are incompatible.")
+		return 1
+	}
+	if !*isTxt && !*isZip && len(payloads) > 1 {
+		fmt.Fprintln(os.Stderr, "To upload multiple files, specify '--zip'")
+		return 1
+	}
+	// The payload must be the same as the first time, byte by byte: a text
+	// could be, but a zip or stdin are gone with the process that sent them.
+	if *resumeID != "" && (*isZip || payloads[0] == "-") {
+		fmt.Fprintln(os.Stderr, "Error: --resume needs the file of the interrupted upload.")
+		return 1
+	}
+
+	secret, err := getSecret(*isSave)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var (
+		payload  io.Reader
+		text     string
+		filename string
+		size     int64
+	)
+	switch {
+	case *isTxt:
+		text = strings.Join(payloads, " ")
+		fmt.Fprintln(os.Stderr, "Sending secret text...")
+	case payloads[0] == "-" && !*isZip:
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "Error: --name is mandatory when reading from stdin.")
+			return 1
+		}
+		// Stdin is streamed, as it comes, unless the size is needed up front:
+		// then it's spooled to a temp file first, which, like --zip, needs
+		// room in the temp dir.
+		if !*spool && !*e2e && !*digest {
+			payload, filename, size = os.Stdin, *name, -1
+			fmt.Fprintln(os.Stderr, "Streaming from stdin...")
+			break
+		}
+		tmp, n, err := spoolToTemp(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
+			return 1
+		}
+		defer tmp.Close()
+		defer removeOnExit(tmp.Name())()
+		payload, filename, size = tmp, *name, n
+		fmt.Fprintf(os.Stderr, "Uploading %s from stdin...\n", utils.HumanReadableSize(size))
+	default:
+		path := payloads[0]
+		// A zip is made as it's streamed, when it can be
+		if *isZip && !*spool && !*e2e && !*digest {
+			for _, p := range payloads {
+				if _, err := os.Stat(p); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: path not found: %s\n", p)
+					return 1
+				}
+			}
+			pr, pw := io.Pipe()
+			go func() { pw.CloseWithError(writeZip(pw, payloads)) }()
+			defer pr.Close()
+			payload, filename, size = pr, "fileway.zip", -1
+			if *name != "" {
+				filename = *name
+			}
+			fmt.Fprintln(os.Stderr, "Zipping and streaming files...")
+			break
+		}
+		if *isZip {
+			fmt.Fprintln(os.Stderr, "Zipping files...")
+			zipPath, err := createTempZip(payloads)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating ZIP file: %v\n", err)
+				return 1
+			}
+			defer removeOnExit(zipPath)()
+			fmt.Fprintf(os.Stderr, "Created upload file '%s'\n", zipPath)
+			path = zipPath
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if !fi.Mode().IsRegular() {
+			fmt.Fprintf(os.Stderr, "Error: '%s' is not a file.\n", path)
+			return 1
+		}
+		payload, filename, size = f, filepath.Base(path), fi.Size()
+		if *name != "" {
+			filename = *name
+		}
+		fmt.Fprintf(os.Stderr, "Uploading '%s'...\n", path)
+	}
+
+	c := client.New(*server, secret)
+	c.UserAgent = "FilewayClient/" + version
+	c.Downloads = *downloads
+	c.Spool = *spool
+	c.E2E = *e2e
+	c.Digest = *digest
+	c.Confirm = !*noConfirm
+	c.Pipe = *pipe
+	c.Parallel = *parallel
+	progress := newProgress(*quiet, "Uploading")
+	c.OnProgress = progress.update
+
+	var up *client.Upload
+	switch {
+	case *resumeID != "" && *isTxt:
+		up, err = c.Resume(context.Background(), *resumeID, strings.NewReader(text), int64(len(text)))
+	case *resumeID != "":
+		up, err = c.Resume(context.Background(), *resumeID, payload, size)
+	case *isTxt:
+		up, err = c.SendText(context.Background(), text)
+	case size < 0:
+		up, err = c.SendStream(context.Background(), payload, filename)
+	default:
+		up, err = c.Send(context.Background(), payload, filename, size)
+	}
+	if err == nil {
+		// The links go to stdout, everything else to stderr, so that
+		// `fileway send` can be piped into whatever delivers the link.
+		what, curlOpts := "file", "-OJ "
+		if *isTxt {
+			what, curlOpts = "text", ""
+		}
+		fmt.Fprintf(os.Stderr, "All set up! Download your %s using:\n", what)
+		fmt.Printf("- a browser, from %s\n", up.URL)
+		// curl can't decrypt
+		if up.Key == "" {
+			fmt.Printf("- a shell, with $> curl %s%s\n", curlOpts, up.URL)
+		}
+		fmt.Printf("- fileway, with $> fileway receive %s\n", up.URL)
+		if up.PipeURL != "" && up.Key == "" {
+			fmt.Printf("- the pipe, also before now, with $> curl %s%s\n", curlOpts, up.PipeURL)
+		} else if up.PipeURL != "" {
+			fmt.Printf("- the pipe, also before now, with $> fileway receive %s\n", up.PipeURL)
+		}
+		if *downloads > 1 {
+			fmt.Fprintf(os.Stderr, "The same link is for %d downloaders; it starts when they are all there, or a while after the first one.\n", *downloads)
+		}
+
+		// Interrupted, the transfer is over: the link must not go on working
+		defer atInterrupt(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := c.Cancel(ctx, up.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "Error cancelling the transfer: %v\n", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "The transfer is cancelled.")
+			}
+		})()
+
+		err = up.Wait()
+		progress.done()
+	}
+	if err != nil {
+		if isInterrupted() {
+			// It's the interruption that cancelled it, and says so
+			return 130
+		}
+		var serr *client.StatusError
+		if errors.Is(err, client.ErrNotDelivered) {
+			fmt.Fprintf(os.Stderr, "ERROR: %v.\n", err)
+		} else if errors.As(err, &serr) && serr.Phase != "" {
+			// The server tells how it ended, e.g. "Transfer failed: downloader
+			// disconnected at 37%"
+			fmt.Fprintf(os.Stderr, "ERROR: %s.\n", serr.Message)
+		} else if errors.Is(err, client.ErrConduitCancelled) {
+			fmt.Fprintln(os.Stderr, "ERROR: transfer cancelled.")
+		} else if errors.Is(err, client.ErrConduitExpired) {
+			fmt.Fprintln(os.Stderr, "ERROR: transfer expired.")
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if up != nil && !*isZip && payloads[0] != "-" {
+				id := up.ID
+				if up.Key != "" {
+					id += "#" + up.Key
+				}
+				fmt.Fprintf(os.Stderr, "The server waits for a while; to go on, add '--resume %s'\n", id)
+			}
+		}
+		return 1
+	}
+	if *spool {
+		fmt.Fprintln(os.Stderr, "All data stored on the server, it can be downloaded later. Bye!")
+	} else if result := up.Result(); result != nil {
+		fmt.Fprintf(os.Stderr, "All data delivered, in %s. Bye!\n",
+			(time.Duration(result.DurationMillis) * time.Millisecond).Round(100*time.Millisecond))
+	} else {
+		fmt.Fprintln(os.Stderr, "All data sent. Bye!")
+	}
+	return 0
+}
+
+func cliReceive(args []string) int {
+	fs := flag.NewFlagSet("receive", flag.ContinueOnError)
+	output := fs.String("o", "", "Where to save the file; - for stdout. Defaults to the uploaded file name, in the current dir.")
+	quiet := fs.Bool("quiet", false, "Don't print the progress.")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Error: specify exactly one download link.")
+		return 1
+	}
+
+	c := client.New("", "")
+	c.UserAgent = "FilewayClient/" + version
+	dl, err := c.Open(context.Background(), fs.Arg(0))
+	if err != nil {
+		if errors.Is(err, client.ErrConduitExpired) {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		return 1
+	}
+	defer dl.Body.Close()
+
+	// Texts go to stdout unless told otherwise, like `curl` does with them.
+	dest := *output
+	if dest == "" {
+		if dl.IsText {
+			dest = "-"
+		} else {
+			// The name comes from the other side: never let it choose the dir.
+			dest = filepath.Base(filepath.Clean("/" + dl.Filename))
+			if dest == "/" || dest == "." {
+				dest = "fileway_download.bin"
+			}
+		}
+	}
+
+	var w io.Writer
+	if dest == "-" {
+		w = os.Stdout
+		*quiet = *quiet || dl.IsText
+	} else {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+		fmt.Fprintf(os.Stderr, "Saving to '%s'...\n", dest)
+	}
+
+	progress := newProgress(*quiet, "Downloading")
+	_, err = io.Copy(w, &progressReader{r: dl.Body, total: dl.Size, onProgress: progress.update})
+	progress.done()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: transfer interrupted: %v\n", err)
+		return 1
+	}
+	if dest != "-" {
+		fmt.Fprintln(os.Stderr, "Download complete.")
+	}
+	return 0
+}
+
+// Same sources, and the same ~/.fileway-creds format, as fileway_ul.py: a
+// secret saved by one is picked up by the other.
+func getSecret(saveToHome bool) (string, error) {
+	if s, ok := os.LookupEnv("FILEWAY_SECRET"); ok {
+		return s, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	credsFile := filepath.Join(home, ".fileway-creds")
+
+	if fi, err := os.Stat(credsFile); err == nil {
+		if fi.Mode().Perm() != 0o400 {
+			return "", fmt.Errorf("permissions for %s must be '0400'", credsFile)
+		}
+		content, err := os.ReadFile(credsFile)
+		if err != nil {
+			return "", err
+		}
+		return obfuscate(strings.TrimSpace(string(content))), nil
+	}
+
+	secret, err := promptSecret("Please enter the secret: ")
+	if err != nil {
+		return "", err
+	}
+	if saveToHome {
+		if err := os.WriteFile(credsFile, []byte(obfuscate(secret)), 0o400); err != nil {
+			return "", fmt.Errorf("saving secret: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Secret saved to %s\n\n", credsFile)
+	} else {
+		fmt.Fprintln(os.Stderr, "Use '--save' to save the secret to user home and avoid the prompt")
+	}
+	return secret, nil
+}
+
+// XOR with 17, per character: it's its own inverse. Not a protection, just a
+// way not to have the secret in plain sight.
+func obfuscate(text string) string {
+	var sb strings.Builder
+	for _, r := range text {
+		sb.WriteRune(r ^ 17)
+	}
+	return sb.String()
+}
+
+// Reads a line from the terminal with echo off. There is no portable way to
+// do it in the standard library, so it asks stty, and when that's not there
+// (e.g. no terminal at all) it just reads the line.
+func promptSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	echoOff := exec.Command("stty", "-echo")
+	echoOff.Stdin = os.Stdin
+	if echoOff.Run() == nil {
+		defer func() {
+			echoOn := exec.Command("stty", "echo")
+			echoOn.Stdin = os.Stdin
+			_ = echoOn.Run()
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading the secret: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// What runs on Ctrl-C, before exiting with 130; see atInterrupt.
+var (
+	interruptMu    sync.Mutex
+	interruptHooks []*func()
+	interruptSig   = make(chan os.Signal, 1)
+	interruptOnce  sync.Once
+	interrupted    = make(chan struct{}) // closed on Ctrl-C
+)
+
+// Registers fn to run on Ctrl-C, after those registered later, and then the
+// process exits with 130; the returned func unregisters it, to be deferred.
+// With nothing registered, Ctrl-C is left alone.
+func atInterrupt(fn func()) func() {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+
+	hook := &fn
+	interruptHooks = append(interruptHooks, hook)
+	interruptOnce.Do(func() {
+		go func() {
+			<-interruptSig
+			close(interrupted)
+			fmt.Fprintln(os.Stderr, "\nInterrupted")
+			interruptMu.Lock()
+			hooks := slices.Clone(interruptHooks)
+			interruptMu.Unlock()
+			for i := len(hooks) - 1; i >= 0; i-- {
+				(*hooks[i])()
+			}
+			os.Exit(130)
+		}()
+	})
+	signal.Notify(interruptSig, os.Interrupt)
+
+	return func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+
+		interruptHooks = slices.DeleteFunc(interruptHooks, func(h *func()) bool { return h == hook })
+		if len(interruptHooks) == 0 {
+			signal.Reset(os.Interrupt)
+		}
+	}
+}
+
+// Returns code, unless Ctrl-C was hit: then the hooks are running, and exit
+// when done, so what they interrupted must not exit before them.
+func waitForInterrupt(code int) int {
+	if isInterrupted() {
+		select {}
+	}
+	return code
+}
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns a func that removes path, to be deferred; it is also registered to
+// run on Ctrl-C.
+func removeOnExit(path string) func() {
+	unregister := atInterrupt(func() { os.Remove(path) })
+	return func() {
+		unregister()
+		os.Remove(path)
+	}
+}
+
+// Copies r to a new temp file, returning it rewound and with the size.
+func spoolToTemp(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "fileway_*.bin")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+// Zips paths into a temp file, with the same layout fileway_ul.py uses: files
+// at the root, dirs as a subtree named after their last element.
+func createTempZip(paths []string) (string, error) {
+	f, err := os.CreateTemp("", "fileway_*.zip")
+	if err != nil {
+		return "", err
+	}
+	zipPath := f.Name()
+	err = writeZip(f, paths)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(zipPath)
+		return "", err
+	}
+	return zipPath, nil
+}
+
+func writeZip(w io.Writer, paths []string) error {
+	zw := zip.NewWriter(w)
+	add := func(path, arcname string) error {
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := zw.Create(filepath.ToSlash(arcname))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, src)
+		return err
+	}
+
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("path not found: %s", path)
+		}
+		if !fi.IsDir() {
+			if err := add(path, filepath.Base(path)); err != nil {
+				return err
+			}
+			continue
+		}
+		root := filepath.Clean(path)
+		err = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(root), p)
+			if err != nil {
+				return err
+			}
+			return add(p, rel)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Progress on stderr, on a single line rewritten in place, at most a few
+// times a second.
+type progress struct {
+	quiet bool
+	label string
+	last  time.Time
+	shown bool
+}
+
+func newProgress(quiet bool, label string) *progress {
+	return &progress{quiet: quiet, label: label}
+}
+
+func (p *progress) update(done, total int64) {
+	if p.quiet || (time.Since(p.last) < 200*time.Millisecond && done != total) {
+		return
+	}
+	p.last = time.Now()
+	p.shown = true
+	if total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %s of %s, %.1f%%   ", p.label,
+			utils.HumanReadableSize(done), utils.HumanReadableSize(total), float64(done)*100/float64(total))
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s: %s   ", p.label, utils.HumanReadableSize(done))
+	}
+}
+
+func (p *progress) done() {
+	if p.shown {
+		fmt.Fprintln(os.Stderr)
+		p.shown = false
+	}
+}
+
+type progressReader struct {
+	r          io.Reader
+	done       int64
+	total      int64
+	onProgress func(done, total int64)
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.done += int64(n)
+	pr.onProgress(pr.done, pr.total)
+	return n, err
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	fw "github.com/proofrock/fileway/fileway_logic"
+	"github.com/proofrock/fileway/utils"
+)
+
+const adminUsage = `Usage:
+  fileway admin [options] list            Lists the transfers
+  fileway admin [options] show CONDUIT    Tells all about a transfer
+  fileway admin [options] expire CONDUIT  Ends a transfer right away
+  fileway admin [options] drain [on|off]  Tells, or sets, whether new
+                                          transfers are refused
+
+CONDUIT is the fingerprint of a transfer, as in the list and in the logs.
+
+Options:
+`
+
+// The admin API of a server, on its own listener: see server.adoc, "Admin API".
+func cliAdmin(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	server := fs.String("server", os.Getenv("FILEWAY_ADMIN_URL"), "Address of the admin API, as http://host:port or unix:PATH; defaults to $FILEWAY_ADMIN_URL.")
+	asJSON := fs.Bool("json", false, "Print what the server answers, as JSON.")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, adminUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "Error: no server. Use --server or set FILEWAY_ADMIN_URL.")
+		return 1
+	}
+
+	var method, path string
+	var body io.Reader
+	switch cmd := fs.Args(); {
+	case len(cmd) == 1 && cmd[0] == "list":
+		method, path = "GET", "/conduits"
+	case len(cmd) == 2 && cmd[0] == "show":
+		method, path = "GET", "/conduits/"+cmd[1]
+	case len(cmd) == 2 && cmd[0] == "expire":
+		method, path = "DELETE", "/conduits/"+cmd[1]
+	case len(cmd) == 1 && cmd[0] == "drain":
+		method, path = "GET", "/drain"
+	case len(cmd) == 2 && cmd[0] == "drain" && (cmd[1] == "on" || cmd[1] == "off"):
+		method, path = "PUT", "/drain"
+		body = strings.NewReader(fmt.Sprintf(`{"drain":%t}`, cmd[1] == "on"))
+	default:
+		fs.Usage()
+		return 1
+	}
+
+	secret, ok := os.LookupEnv("FILEWAY_ADMIN_SECRET")
+	if !ok {
+		var err error
+		if secret, err = promptSecret("Please enter the admin secret: "); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	ret, err := adminRequest(*server, secret, method, path, body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if *asJSON || len(ret) == 0 {
+		os.Stdout.Write(ret)
+		return 0
+	}
+
+	switch {
+	case path == "/conduits":
+		var infos []fw.ConduitInfo
+		if err = json.Unmarshal(ret, &infos); err == nil {
+			printConduits(os.Stdout, infos, time.Now())
+		}
+	case path == "/drain":
+		var drain struct {
+			Drain bool `json:"drain"`
+		}
+		if err = json.Unmarshal(ret, &drain); err == nil {
+			if drain.Drain {
+				fmt.Println("Draining: new transfers are refused.")
+			} else {
+				fmt.Println("Not draining: new transfers are accepted.")
+			}
+		}
+	default:
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, ret, "", "  "); err == nil {
+			fmt.Println(indented.String())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: unexpected answer: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Sends a request to the admin API at server, and returns the body of the
+// answer, or an error if it's not a success.
+func adminRequest(server, secret, method, path string, body io.Reader) ([]byte, error) {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimSuffix(server, "/")
+	if socket, isUnix := strings.CutPrefix(server, "unix:"); isUnix {
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		base = "http://fileway"
+	}
+
+	req, err := http.NewRequest(method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-fileway-secret", secret)
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	ret, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP %d: %s", res.StatusCode, strings.TrimSpace(string(ret)))
+	}
+	return ret, nil
+}
+
+func printConduits(w io.Writer, infos []fw.ConduitInfo, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONDUIT\tSTATE\tNAME\tSIZE\tAGE\tIDLE\tCHUNKS\tDELIVERED\tQUEUE")
+	for _, info := range infos {
+		name := info.Filename
+		if info.IsText {
+			name = "(text)"
+		}
+		var delivered []string
+		for _, d := range info.Delivered {
+			delivered = append(delivered, utils.HumanReadableSize(d))
+		}
+		if info.Spooled {
+			delivered = []string{"-"}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%s\t%d/%d\n",
+			info.Fingerprint, info.State, name, utils.HumanReadableSize(info.Size),
+			now.Sub(info.CreatedAt).Round(time.Second), now.Sub(info.LastAccess).Round(time.Second),
+			info.ChunksReceived, info.Chunks, strings.Join(delivered, ","),
+			info.QueueLen, info.QueueCap)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,810 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package client transfers files and texts through a fileway server, from Go.
+
+It speaks the same protocol as the web page and fileway_ul.py: /setup, then
+/ping/ until a downloader shows up, then one PUT to /ul/{id}/{index} per
+entry of the chunk plan, retrying the ones that fail; and /ddl/ to download.
+
+	c := client.New("https://fileway.example.com", secret)
+	up, err := c.Send(ctx, f, "report.pdf", size)
+	if err != nil {
+		return err
+	}
+	notify(recipient, up.URL) // the transfer starts when they open it
+	if err := up.Wait(); err != nil {
+		return err
+	}
+*/
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	// Base URL of the server, e.g. "https://fileway.example.com".
+	BaseURL string
+	// The secret, in clear; the server holds its hash. Only needed to send.
+	Secret string
+	// Defaults to a client with no overall timeout, since a transfer takes as
+	// long as it takes. See NewHTTPClient.
+	HTTPClient *http.Client
+	// Defaults to "FilewayClient".
+	UserAgent string
+	// How many downloaders each upload is for; they all get the same
+	// payload, at once. 0 is the same as 1.
+	Downloads int
+	// If true, the server keeps each upload on disk, and the uploader doesn't
+	// wait for the downloaders: Wait returns once it's all stored. The
+	// server must allow it; see server.adoc, "Spooling".
+	Spool bool
+	// If true, each upload is end-to-end encrypted: the server relays it
+	// without being able to read it, and the key is in the fragment of the
+	// links. It takes a browser, or Open, to download it.
+	E2E bool
+	// If true, the payload is hashed before the upload, and the server checks
+	// that what it relays matches; the reader given to Send must then be an
+	// io.Seeker, since it's read twice.
+	Digest bool
+	// If true, Wait returns once the downloaders got the whole payload, not
+	// once the server did, and ErrNotDelivered if they didn't; the Upload's
+	// Result tells how it went. It doesn't apply to a spooled upload, whose
+	// downloaders may come much later.
+	Confirm bool
+	// If set, each upload is on the named pipe Pipe too: the downloader can
+	// open its link, Upload.PipeURL, before the upload is set up, and wait for
+	// it. It can be agreed in advance, e.g. "deploy-42"; anyone who knows it
+	// can download, so it must be hard to guess if that matters. See
+	// server.adoc, "Named pipes".
+	Pipe string
+	// How many chunks of a file are sent at once, each in a request of its
+	// own, as far as the server allows; 0 is the same as 1. On a link that is
+	// far and loses packets, several connections go faster than one. The
+	// chunks are then of a size set up front, rather than adapted to the
+	// link; see server.adoc, "Parallel chunks".
+	Parallel int
+	// If set, called after each chunk is uploaded or downloaded, with the bytes
+	// done so far and the total (-1 when unknown). Called from the goroutine
+	// doing the transfer.
+	OnProgress func(done, total int64)
+}
+
+// New returns a Client for the server at baseURL.
+func New(baseURL, secret string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Secret:  secret,
+	}
+}
+
+// NewHTTPClient returns the http.Client used when Client.HTTPClient is nil: no
+// overall timeout, but a bound on connecting and on waiting for the headers.
+// The long poll on /ping/ answers within 20 seconds, but an upload waits for a
+// downloader that dropped to come back, for the server's grace window.
+func NewHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 10 * time.Minute
+	return &http.Client{Transport: transport}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		c.HTTPClient = NewHTTPClient()
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) do(ctx context.Context, method, rawURL string, body io.Reader, withSecret bool, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if withSecret {
+		req.Header.Set("x-fileway-secret", c.Secret)
+	}
+	c.setUserAgent(req)
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) setUserAgent(req *http.Request) {
+	ua := c.UserAgent
+	if ua == "" {
+		ua = "FilewayClient"
+	}
+	req.Header.Set("User-Agent", ua)
+}
+
+func (c *Client) progress(done, total int64) {
+	if c.OnProgress != nil {
+		c.OnProgress(done, total)
+	}
+}
+
+// Upload is a transfer that was set up on the server. The data flows once a
+// downloader opens URL; Wait blocks until it has all been handed over.
+type Upload struct {
+	// The conduit id, i.e. the last element of the download links.
+	ID string
+	// The link for the recipient; a browser gets a download page, a CLI
+	// downloader the payload.
+	URL string
+	// The link that always downloads the payload directly.
+	DirectURL string
+	// The link of the named pipe, with Client.Pipe; it downloads directly, as
+	// DirectURL. Empty otherwise.
+	PipeURL string
+	// The key of an end-to-end encrypted upload, as in the fragment of the
+	// links; empty if it's not encrypted.
+	Key string
+
+	done   chan struct{}
+	err    error
+	result *Result
+}
+
+// Done is closed when the upload is over, for good or not.
+func (u *Upload) Done() <-chan struct{} {
+	return u.done
+}
+
+// Result returns how the transfer went, as the server told it, once it's
+// done; nil unless Client.Confirm is set.
+func (u *Upload) Result() *Result {
+	<-u.done
+	return u.result
+}
+
+// Wait blocks until the upload is over, and returns nil if every byte was
+// handed to the server. Expiry is reported as ErrConduitExpired, a
+// cancellation, by either end, as ErrConduitCancelled, and a failure, e.g.
+// the downloader disconnecting, as ErrConduitFailed; the StatusError they
+// wrap tells why.
+func (u *Upload) Wait() error {
+	<-u.done
+	return u.err
+}
+
+// Send sets up the transfer of size bytes from r, to be saved as name, and
+// returns as soon as the download link exists; the upload goes on in the
+// background until the returned Upload is done. Cancelling ctx aborts it.
+func (c *Client) Send(ctx context.Context, r io.Reader, name string, size int64) (*Upload, error) {
+	qry := url.Values{}
+	qry.Set("txt", "0")
+	qry.Set("filename", name)
+	return c.send(ctx, r, size, qry)
+}
+
+// SendStream is Send for a payload whose size is not known, e.g. the output
+// of a command: it's sent until r ends, and the downloader gets it chunked,
+// with no Content-Length. It can't be spooled, end-to-end encrypted, have a
+// digest, or be resumed. See server.adoc, "Streams".
+func (c *Client) SendStream(ctx context.Context, r io.Reader, name string) (*Upload, error) {
+	if c.Spool || c.E2E || c.Digest {
+		return nil, ErrStreamOptions
+	}
+	qry := url.Values{}
+	qry.Set("txt", "0")
+	qry.Set("filename", name)
+	return c.send(ctx, r, -1, qry)
+}
+
+// SendText is Send for a text. The server names the file on its own, and
+// serves it as text/plain.
+func (c *Client) SendText(ctx context.Context, text string) (*Upload, error) {
+	qry := url.Values{}
+	qry.Set("txt", "1")
+	return c.send(ctx, strings.NewReader(text), int64(len(text)), qry)
+}
+
+func (c *Client) send(ctx context.Context, r io.Reader, size int64, qry url.Values) (*Upload, error) {
+	if size < 0 {
+		qry.Set("stream", "1")
+	} else {
+		qry.Set("size", strconv.FormatInt(size, 10))
+	}
+	if c.Downloads > 1 {
+		qry.Set("downloads", strconv.Itoa(c.Downloads))
+	}
+	if c.Spool {
+		qry.Set("spool", "1")
+	}
+	if c.Pipe != "" {
+		qry.Set("pipe", c.Pipe)
+	}
+	var key string
+	if c.E2E {
+		var err error
+		if key, err = newE2EKey(); err != nil {
+			return nil, err
+		}
+		qry.Set("e2e", "1")
+	}
+	if c.Digest {
+		sum, err := digestOf(r, key, size)
+		if err != nil {
+			return nil, err
+		}
+		qry.Set("sha256", hex.EncodeToString(sum))
+	}
+	// Telling the version of the plan it knows, it gets an adaptive one; to
+	// send several chunks at once, it asks for one that is set up front
+	version := chunkPlanVersion
+	if c.Parallel > 1 && size >= 0 {
+		version = chunkPlanFixed
+	}
+	header := http.Header{"X-Fileway-Plan": {strconv.Itoa(version)}}
+	res, err := c.do(ctx, "GET", c.BaseURL+"/setup?"+qry.Encode(), nil, true, header)
+	if err != nil {
+		return nil, err
+	}
+	body, err := readOK(res, "setup")
+	if err != nil {
+		return nil, err
+	}
+
+	return c.start(ctx, string(body), key, r, size, false), nil
+}
+
+// Resume goes on with the upload id, that a previous Send (maybe from another
+// process) left halfway, e.g. because the network changed. r must be the same
+// payload from the start: what the server already has is skipped, seeking if r
+// is an io.Seeker. The server waits for the uploader to come back only for a
+// while; see server.adoc, "Resuming an upload". An end-to-end encrypted
+// upload is resumed with its id and key, as in "id#key".
+func (c *Client) Resume(ctx context.Context, id string, r io.Reader, size int64) (*Upload, error) {
+	if size < 0 {
+		return nil, ErrStreamOptions
+	}
+	id, key, _ := strings.Cut(id, "#")
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid transfer id %q", id)
+	}
+	return c.start(ctx, id, key, r, size, true), nil
+}
+
+func (c *Client) start(ctx context.Context, id, key string, r io.Reader, size int64, resume bool) *Upload {
+	ret := &Upload{
+		ID:        id,
+		URL:       c.BaseURL + "/dl/" + id,
+		DirectURL: c.BaseURL + "/ddl/" + id,
+		Key:       key,
+		done:      make(chan struct{}),
+	}
+	if c.Pipe != "" {
+		ret.PipeURL = c.BaseURL + "/pipe/" + url.PathEscape(c.Pipe)
+	}
+	if key != "" {
+		ret.URL += "#" + key
+		ret.DirectURL += "#" + key
+		if ret.PipeURL != "" {
+			ret.PipeURL += "#" + key
+		}
+	}
+	go func() {
+		defer close(ret.done)
+		ret.result, ret.err = c.upload(ctx, id, key, r, size, resume)
+	}()
+	return ret
+}
+
+func (c *Client) upload(ctx context.Context, id, key string, r io.Reader, size int64, resume bool) (*Result, error) {
+	// Encrypted, what is sent is the sealed payload, and the plan and the
+	// offsets are about it.
+	if key != "" {
+		sealer, err := newSealer(r, key, size)
+		if err != nil {
+			return nil, err
+		}
+		r, size = sealer, sealedSize(size)
+	}
+
+	// The long poll returns no plan every 20 seconds while nobody is
+	// downloading, and the plan itself once somebody does.
+	var plan *chunkPlan
+	var spool string
+	for plan == nil {
+		var err error
+		if plan, spool, err = c.ping(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, plan.biggest())
+
+	first, sent, next := 0, int64(0), plan.sizeAt(0, size)
+	if resume {
+		var err error
+		if first, sent, next, err = c.progressOf(ctx, id); err != nil {
+			return nil, err
+		}
+		// A server from before doesn't tell it
+		if next < 0 {
+			next = plan.sizeAt(first, size)
+		}
+		if err := skip(r, sent); err != nil {
+			return nil, fmt.Errorf("reading the payload: %w", err)
+		}
+		c.progress(sent, size)
+	}
+
+	if window := min(c.Parallel, plan.Parallel); window > 1 && size >= 0 {
+		if err := c.uploadParallel(ctx, id, r, plan, size, first, sent, window); err != nil {
+			return nil, err
+		}
+		next = 0
+	}
+
+	// A stream goes on until r ends
+	for index := first; next > 0; index++ {
+		if next > len(buf) {
+			return nil, fmt.Errorf("chunk %d of %d bytes, past the plan", index, next)
+		}
+		chunk := buf[:next]
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && (size >= 0 || (err != io.EOF && err != io.ErrUnexpectedEOF)) {
+			// A stream can't be resumed: the downloader must not wait for it
+			if size < 0 {
+				c.Cancel(ctx, id)
+			}
+			return nil, fmt.Errorf("reading the payload: %w", err)
+		}
+		after := -1
+		if n > 0 {
+			if after, err = c.putChunk(ctx, id, index, chunk[:n]); err != nil {
+				return nil, err
+			}
+			sent += int64(n)
+			c.progress(sent, size)
+		}
+		if n < len(chunk) {
+			if n > 0 {
+				index++
+			}
+			if err := c.endStream(ctx, id, index); err != nil {
+				return nil, err
+			}
+			c.progress(sent, sent)
+			break
+		}
+		next = plan.sizeAt(index+1, size)
+		if plan.Adaptive {
+			if after < 0 {
+				return nil, fmt.Errorf("the server didn't tell the size of chunk %d", index+1)
+			}
+			next = after
+		}
+	}
+
+	// A spooled upload is over when the server says it's all on disk; the
+	// uploader is free to go.
+	if spool != "" {
+		_, spool, err := c.ping(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if spool != "stored" {
+			return nil, errors.New("the server didn't store the whole upload")
+		}
+		return nil, nil
+	}
+	if !c.Confirm {
+		return nil, nil
+	}
+
+	result, err := c.Result(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if result.Phase != "completed" {
+		return result, fmt.Errorf("%w: %s, %d of %d bytes", ErrNotDelivered, result.Detail, result.Bytes, result.Size)
+	}
+	return result, nil
+}
+
+// Result is how a transfer went, as the server tells it; see server.adoc,
+// "Delivery confirmation".
+type Result struct {
+	Phase  string `json:"phase"`  // e.g. "completed"; see server.adoc, "Phases and reasons"
+	Reason string `json:"reason"` // e.g. "downloader_disconnected"
+	Detail string `json:"detail"` // e.g. "downloader disconnected at 37%"
+	Final  bool   `json:"final"`
+	// When it ended, if Final; otherwise, when it last changed phase
+	At time.Time `json:"at"`
+	// The bytes to deliver, and those the downloader got (of several, the
+	// one that got the least); sealed ones, if end-to-end encrypted
+	Size           int64 `json:"size"`
+	Bytes          int64 `json:"bytes"`
+	DurationMillis int64 `json:"duration_ms"`
+}
+
+// Result waits for the transfer id to be over, and tells how it went. The
+// server knows it for a while after it's over, then it's ErrConduitExpired.
+// As in Resume, the id can come with the key, as "id#key".
+func (c *Client) Result(ctx context.Context, id string) (*Result, error) {
+	id, _, _ = strings.Cut(id, "#")
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid transfer id %q", id)
+	}
+	// A long poll, that returns when it's over or after 20 seconds
+	for {
+		res, err := c.do(ctx, "GET", c.BaseURL+"/result/"+id, nil, true, nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := readOK(res, "result")
+		if err != nil {
+			return nil, err
+		}
+		var ret Result
+		if err := json.Unmarshal(body, &ret); err != nil {
+			return nil, fmt.Errorf("malformed result: %w", err)
+		}
+		if ret.Final {
+			return &ret, nil
+		}
+	}
+}
+
+// Cancel ends the upload id right away, e.g. because it's the wrong file: the
+// link stops working, and a download under way is cut short. An Upload of it
+// still running then fails with ErrConduitCancelled. Of a transfer that is
+// over, it returns what ended it, e.g. ErrConduitCancelled again. As in Resume,
+// the id can come with the key, as "id#key".
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	id, _, _ = strings.Cut(id, "#")
+	if id == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid transfer id %q", id)
+	}
+	res, err := c.do(ctx, "DELETE", c.BaseURL+"/ul/"+id, nil, true, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(res.Body)
+		return statusError(res, "cancel", body)
+	}
+	return nil
+}
+
+// Asks for the chunk plan; it's nil while nobody is downloading. The second
+// value is the state of a spooled upload: "receiving" or "stored", or empty if
+// it's not spooled.
+func (c *Client) ping(ctx context.Context, id string) (*chunkPlan, string, error) {
+	header := http.Header{"X-Fileway-Plan": {strconv.Itoa(chunkPlanVersion)}}
+	res, err := c.do(ctx, "GET", c.BaseURL+"/ping/"+id, nil, true, header)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := readOK(res, "ping")
+	if err != nil {
+		return nil, "", err
+	}
+	plan, err := parsePlan(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed chunk plan: %w", err)
+	}
+	return plan, res.Header.Get("X-Fileway-Spool"), nil
+}
+
+// Uploads the chunks of a file from first on, sent bytes in, window at a
+// time: r is read in order, and each chunk is sent in a goroutine of its own,
+// as soon as fewer than window are being sent. The server puts them back in
+// order. The first error stops it, once those under way are done.
+func (c *Client) uploadParallel(ctx context.Context, id string, r io.Reader, plan *chunkPlan, size int64, first int, sent int64, window int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type putDone struct {
+		chunk []byte
+		err   error
+	}
+	done := make(chan putDone, window)
+	free := make([][]byte, window)
+	for i := range free {
+		free[i] = make([]byte, plan.biggest())
+	}
+	running := 0
+	var failed error
+	// Waits for a chunk to be sent, and takes back its buffer
+	collect := func() {
+		put := <-done
+		running--
+		free = append(free, put.chunk[:cap(put.chunk)])
+		switch {
+		case put.err == nil:
+			sent += int64(len(put.chunk))
+			c.progress(sent, size)
+		case failed == nil:
+			failed = put.err
+			cancel()
+		}
+	}
+
+	for index := first; ; index++ {
+		if running == window {
+			collect()
+		}
+		n := plan.sizeAt(index, size)
+		if failed != nil || n == 0 {
+			break
+		}
+		chunk := free[len(free)-1][:n]
+		free = free[:len(free)-1]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			failed = fmt.Errorf("reading the payload: %w", err)
+			cancel()
+			break
+		}
+		running++
+		go func() {
+			_, err := c.putChunk(ctx, id, index, chunk)
+			done <- putDone{chunk, err}
+		}()
+	}
+	for running > 0 {
+		collect()
+	}
+	return failed
+}
+
+// Asks the server where the upload got to: the next chunk, its offset and its
+// size, -1 if the server doesn't tell it.
+func (c *Client) progressOf(ctx context.Context, id string) (int, int64, int, error) {
+	res, err := c.do(ctx, "GET", c.BaseURL+"/resume/"+id, nil, true, nil)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	body, err := readOK(res, "resume")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	progress := struct {
+		Chunk  int   `json:"chunk"`
+		Offset int64 `json:"offset"`
+		Size   int   `json:"size"`
+	}{Size: -1}
+	if err := json.Unmarshal(body, &progress); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed upload progress: %w", err)
+	}
+	return progress.Chunk, progress.Offset, progress.Size, nil
+}
+
+// Returns the SHA-256 of the payload of size bytes in r, as it's sent, i.e.
+// sealed with key, if there is one; then moves back to where r was.
+func digestOf(r io.Reader, key string, size int64) ([]byte, error) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return nil, errors.New("a digest can't be computed on a payload that can't be read twice")
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader = io.LimitReader(r, size)
+	if key != "" {
+		if src, err = newSealer(r, key, size); err != nil {
+			return nil, err
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return nil, fmt.Errorf("reading the payload: %w", err)
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Formats a SHA-256 as an RFC 9530 digest, e.g. for Content-Digest.
+func formatDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Gets the SHA-256 out of an RFC 9530 Repr-Digest header, or nil if there
+// is none. Other algorithms are ignored.
+func parseDigest(header string) []byte {
+	for _, member := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || alg != "sha-256" || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err == nil && len(sum) == sha256.Size {
+			return sum
+		}
+	}
+	return nil
+}
+
+// Moves r forward by n bytes, seeking when it can.
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(*sealer); ok {
+		return s.skip(n)
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// How many times a chunk is sent before giving up, retryDelay apart more
+// each time.
+const maxChunkAttempts = 5
+
+// Uploads the chunk at index of the plan. The server accepts the same index
+// again, so a chunk whose upload failed, or whose answer was lost, is sent
+// again rather than aborting the whole upload. So is one that got corrupted.
+// It returns the size of the next chunk, as the server tells it for an
+// adaptive plan; -1 if it doesn't.
+func (c *Client) putChunk(ctx context.Context, id string, index int, chunk []byte) (int, error) {
+	// The server checks it, so a chunk corrupted on the way is sent again
+	sum := sha256.Sum256(chunk)
+	return c.put(ctx, id, index, chunk, http.Header{"Content-Digest": {formatDigest(sum[:])}})
+}
+
+// Marks the end of a stream, past the chunk before index. It's retried as a
+// chunk is: marking it again is fine.
+func (c *Client) endStream(ctx context.Context, id string, index int) error {
+	_, err := c.put(ctx, id, index, nil, http.Header{"X-Fileway-Eof": {"1"}})
+	return err
+}
+
+func (c *Client) put(ctx context.Context, id string, index int, chunk []byte, header http.Header) (int, error) {
+	chunkURL := fmt.Sprintf("%s/ul/%s/%d", c.BaseURL, id, index)
+	for attempt := 1; ; attempt++ {
+		next := -1
+		res, err := c.do(ctx, "PUT", chunkURL, bytes.NewReader(chunk), true, header)
+		if err == nil {
+			if n, err := strconv.Atoi(res.Header.Get("X-Fileway-Next-Chunk")); err == nil {
+				next = n
+			}
+			_, err = readOK(res, "upload")
+		}
+		if err == nil || ctx.Err() != nil || attempt == maxChunkAttempts || !isTransient(err) {
+			return next, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+	}
+}
+
+// Reports whether an upload error is worth a retry: a network error, a stall,
+// the previous attempt still being handled, a chunk corrupted on the way, or
+// a server error. An expired transfer or a wrong secret is final.
+func isTransient(err error) bool {
+	var serr *StatusError
+	if !errors.As(err, &serr) {
+		return true
+	}
+	if errors.Is(err, ErrConduitExpired) || errors.Is(err, ErrConduitCancelled) || errors.Is(err, ErrConduitFailed) ||
+		errors.Is(err, ErrDigestMismatch) || errors.Is(err, ErrSecretMismatch) {
+		return false
+	}
+	return serr.Code == http.StatusRequestTimeout || serr.Code == http.StatusConflict ||
+		serr.Code == http.StatusUnprocessableEntity || serr.Code >= 500
+}
+
+// Reads the whole body and turns a non-200 answer into an error.
+func readOK(res *http.Response, what string) ([]byte, error) {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, statusError(res, what, body)
+	}
+	return body, nil
+}
+
+// Maps the status codes of the uploading endpoints to the errors. The server
+// says 410 for a transfer that is over while it still knows the conduit, and
+// 404 once it has forgotten it; see server.adoc, "Status codes for an expired
+// transfer". The 410 tells how it ended, see overError.
+func statusError(res *http.Response, what string, body []byte) error {
+	err := newStatusError(res, what, body)
+	switch {
+	case err.Code == http.StatusUnauthorized:
+		return fmt.Errorf("%w: %w", ErrSecretMismatch, err)
+	case err.Code == http.StatusRequestTimeout:
+		return fmt.Errorf("%w: %w", ErrUploadTimeout, err)
+	case what == "setup" && err.Code == http.StatusConflict:
+		return fmt.Errorf("%w: %w", ErrPipeBusy, err)
+	case what != "setup" && (err.Code == http.StatusGone || err.Code == http.StatusNotFound):
+		return overError(err)
+	}
+	return err
+}
+
+func newStatusError(res *http.Response, what string, body []byte) *StatusError {
+	return &StatusError{
+		Code:    res.StatusCode,
+		Op:      what,
+		Message: strings.TrimSpace(string(body)),
+		Phase:   res.Header.Get("X-Fileway-Phase"),
+		Reason:  res.Header.Get("X-Fileway-Reason"),
+	}
+}
+
+// Maps a transfer that is over to the error for how it ended. Without a
+// phase, i.e. a 404, all that's known is that it's gone: it's reported as
+// expired.
+func overError(err *StatusError) error {
+	switch {
+	case err.Phase == "cancelled":
+		return fmt.Errorf("%w: %w", ErrConduitCancelled, err)
+	case err.Reason == "digest_mismatch":
+		return fmt.Errorf("%w: %w", ErrDigestMismatch, err)
+	case err.Phase == "failed":
+		return fmt.Errorf("%w: %w", ErrConduitFailed, err)
+	}
+	return fmt.Errorf("%w: %w", ErrConduitExpired, err)
+}
+
+// StatusError is an unexpected HTTP answer. The sentinel errors below wrap
+// one, so errors.As can still get at the status.
+type StatusError struct {
+	Code    int
+	Op      string // setup, ping, upload, resume, cancel, result or download
+	Message string // the body of the response
+	// For a transfer that is over, how it ended, e.g. "failed", and why, e.g.
+	// "downloader_disconnected"; see server.adoc, "Phases and reasons"
+	Phase  string
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error in %s: HTTP %d: %s", e.Op, e.Code, e.Message)
+}
+
+// These mirror the ones in fileway_logic, as seen from the other end of the
+// wire; check them with errors.Is.
+var (
+	ErrConduitExpired            = errors.New("transfer expired")
+	ErrConduitCancelled          = errors.New("transfer cancelled")
+	ErrConduitFailed             = errors.New("transfer failed")
+	ErrNotDelivered              = errors.New("the downloader didn't get the whole payload")
+	ErrUploadTimeout             = errors.New("upload timed out, the transfer seems stuck")
+	ErrConduitAlreadyDownloading = errors.New("transfer already downloading or downloaded")
+	ErrSecretMismatch            = errors.New("secret mismatch")
+	ErrNotALink                  = errors.New("not a fileway download link")
+	ErrDigestMismatch            = errors.New("the payload doesn't match its digest")
+	ErrPipeBusy                  = errors.New("there's already a transfer on the pipe")
+	ErrStreamOptions             = errors.New("a stream can't be spooled, end-to-end encrypted, have a digest, or be resumed")
+)
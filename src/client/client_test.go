@@ -0,0 +1,361 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirectURL(t *testing.T) {
+	cases := map[string]string{
+		"https://fw.example.com/dl/abc":    "https://fw.example.com/ddl/abc",
+		"https://fw.example.com/ddl/abc":   "https://fw.example.com/ddl/abc",
+		"http://fw.example.com/sub/dl/abc": "http://fw.example.com/sub/ddl/abc",
+		"https://fw.example.com/setup":     "",
+		"ftp://fw.example.com/dl/abc":      "",
+	}
+	for in, want := range cases {
+		got, err := DirectURL(in)
+		if want == "" {
+			if !errors.Is(err, ErrNotALink) {
+				t.Errorf("%s: got %q, %v; want ErrNotALink", in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("%s -> %q, %v; want %q", in, got, err, want)
+		}
+	}
+}
+
+// Each status the server uses to end a transfer maps to its own error, and the
+// status itself stays reachable.
+func TestUploadStatusErrors(t *testing.T) {
+	cases := []struct {
+		code          int
+		phase, reason string
+		want          error
+	}{
+		{http.StatusGone, "", "", ErrConduitExpired},
+		{http.StatusGone, "expired", "no_downloader", ErrConduitExpired},
+		{http.StatusGone, "cancelled", "cancelled_by_downloader", ErrConduitCancelled},
+		{http.StatusGone, "failed", "downloader_disconnected", ErrConduitFailed},
+		{http.StatusGone, "failed", "digest_mismatch", ErrDigestMismatch},
+		{http.StatusNotFound, "", "", ErrConduitExpired},
+		{http.StatusRequestTimeout, "", "", ErrUploadTimeout},
+		{http.StatusUnauthorized, "", "", ErrSecretMismatch},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/setup" {
+				w.Write([]byte("abc"))
+				return
+			}
+			if c.phase != "" {
+				w.Header().Set("X-Fileway-Phase", c.phase)
+				w.Header().Set("X-Fileway-Reason", c.reason)
+			}
+			http.Error(w, "nope", c.code)
+		}))
+
+		up, err := New(srv.URL, "s").SendText(context.Background(), "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = up.Wait()
+		var se *StatusError
+		if !errors.Is(err, c.want) || !errors.As(err, &se) || se.Code != c.code || se.Reason != c.reason {
+			t.Errorf("HTTP %d: got %v, want %v", c.code, err, c.want)
+		}
+		srv.Close()
+	}
+}
+
+// A chunk whose upload fails is sent again, at the same index, instead of
+// failing the whole transfer.
+func TestSendRetriesChunks(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	var puts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/setup":
+			w.Write([]byte("abc"))
+		case r.URL.Path == "/ping/abc":
+			w.Write([]byte("[1]"))
+		default:
+			puts = append(puts, r.URL.Path)
+			if len(puts) == 1 {
+				http.Error(w, "stalled", http.StatusRequestTimeout)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	up, err := New(srv.URL, "s").SendText(context.Background(), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(puts) != 2 || puts[0] != "/ul/abc/0" || puts[1] != "/ul/abc/0" {
+		t.Errorf("got PUTs %v, want chunk 0 twice", puts)
+	}
+}
+
+// The plan is described by the server, or listed by one from before: the
+// chunks are the same.
+func TestParsePlan(t *testing.T) {
+	for _, body := range []string{"null", "[]", " []\n"} {
+		if plan, err := parsePlan([]byte(body)); plan != nil || err != nil {
+			t.Errorf("%q: got %+v, %v", body, plan, err)
+		}
+	}
+
+	described, err := parsePlan([]byte(`{"version":2,"initial":4096,"factor":2,"max":16384,"size":40000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := parsePlan([]byte(`[4096,8192,16384,11328]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if a, b := described.sizeAt(i, 40000), listed.sizeAt(i, 40000); a != b {
+			t.Errorf("chunk %d: described %d, listed %d", i, a, b)
+		}
+	}
+	if described.biggest() != 16384 || listed.biggest() != 16384 {
+		t.Errorf("biggest: %d, %d", described.biggest(), listed.biggest())
+	}
+
+	stream, _ := parsePlan([]byte(`{"version":2,"initial":4096,"factor":2,"max":16384,"size":-1}`))
+	streamListed, _ := parsePlan([]byte(`[4096,8192,16384]`))
+	for i := 0; i < 6; i++ {
+		if a, b := stream.sizeAt(i, -1), streamListed.sizeAt(i, -1); a != b || a == 0 {
+			t.Errorf("stream chunk %d: described %d, listed %d", i, a, b)
+		}
+	}
+}
+
+// Cancelling the context stops an upload parked on the long poll.
+func TestSendIsCancellable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/setup" {
+			w.Write([]byte("abc"))
+			return
+		}
+		<-r.Context().Done() // a ping with nobody downloading
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	up, err := New(srv.URL, "s").SendText(ctx, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case <-up.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload did not stop once cancelled")
+	}
+	if err := up.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+// A body that ends before the announced size is an error, not a short file.
+func TestReceiveDetectsTruncation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("abcd")) // and the uploader goes away
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, "").Receive(context.Background(), srv.URL+"/ddl/abc", io.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// A download whose connection drops carries on from where it was, asking for
+// the rest with a Range that names the same payload.
+func TestReceiveResumes(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"x"`)
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("abcd")) // and the connection drops
+			return
+		}
+		if r.Header.Get("Range") != "bytes=4-" || r.Header.Get("If-Range") != `"x"` {
+			http.Error(w, "unexpected resume", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 4-9/10")
+		w.Header().Set("Content-Length", "6")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("efghij"))
+	}))
+	defer srv.Close()
+
+	var got bytes.Buffer
+	if _, err := New(srv.URL, "").Receive(context.Background(), srv.URL+"/ddl/abc", &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "abcdefghij" {
+		t.Errorf("got %q", got.String())
+	}
+}
+
+// A resumed upload asks the server where it got to, and sends only the rest.
+func TestResumeSendsTheRest(t *testing.T) {
+	var puts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping/abc":
+			w.Write([]byte("[1,1,1]"))
+		case "/resume/abc":
+			w.Write([]byte(`{"chunk":2,"offset":2}`))
+		default:
+			body, _ := io.ReadAll(r.Body)
+			puts = append(puts, r.URL.Path+" "+string(body))
+		}
+	}))
+	defer srv.Close()
+
+	// Not a Seeker, so what was sent already has to be read through.
+	payload := io.MultiReader(strings.NewReader("abc"))
+	up, err := New(srv.URL, "s").Resume(context.Background(), "abc", payload, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if len(puts) != 1 || puts[0] != "/ul/abc/2 c" {
+		t.Errorf("got PUTs %v, want only chunk 2", puts)
+	}
+}
+
+// A resumed encrypted upload seals from the record the server got to, and
+// what it sends is the same as if it had never stopped.
+func TestSealerSkip(t *testing.T) {
+	key, err := newE2EKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("0123456789"), 20000)
+	whole, err := newSealer(bytes.NewReader(payload), key, int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(whole)
+	if err != nil || int64(len(sealed)) != sealedSize(int64(len(payload))) {
+		t.Fatalf("sealed %d bytes, %v", len(sealed), err)
+	}
+
+	for _, from := range []int64{1, e2eSealedRecordSize, e2eSealedRecordSize + 7, int64(len(sealed)) - 1} {
+		s, _ := newSealer(io.MultiReader(bytes.NewReader(payload)), key, int64(len(payload)))
+		if err := skip(s, from); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(s)
+		if err != nil || !bytes.Equal(rest, sealed[from:]) {
+			t.Errorf("from %d: got %d bytes, %v", from, len(rest), err)
+		}
+	}
+}
+
+// An encrypted download needs the key, and fails rather than deliver a
+// payload that was altered, or cut short.
+func TestOpenE2E(t *testing.T) {
+	key, err := newE2EKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("x"), 100000)
+	s, _ := newSealer(bytes.NewReader(payload), key, int64(len(payload)))
+	sealed, _ := io.ReadAll(s)
+
+	var served []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Fileway-E2E", "1")
+		w.Header().Set("Content-Length", strconv.Itoa(len(served)))
+		w.Write(served)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, "")
+	served = sealed
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc", io.Discard); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("no key: got %v, want ErrMissingKey", err)
+	}
+	var got bytes.Buffer
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc#"+key, &got); err != nil || !bytes.Equal(got.Bytes(), payload) {
+		t.Errorf("got %d bytes, %v", got.Len(), err)
+	}
+
+	served = bytes.Clone(sealed)
+	served[10] ^= 1
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc#"+key, io.Discard); !errors.Is(err, ErrDecryption) {
+		t.Errorf("altered: got %v, want ErrDecryption", err)
+	}
+	// Cut at a record boundary, the last record left isn't flagged as such
+	served = sealed[:e2eSealedRecordSize]
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc#"+key, io.Discard); !errors.Is(err, ErrDecryption) {
+		t.Errorf("truncated: got %v, want ErrDecryption", err)
+	}
+}
+
+func TestReceiveChecksDigest(t *testing.T) {
+	payload := []byte("some payload")
+	var digest string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Repr-Digest", digest)
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		w.Write(payload)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, "")
+	sum := sha256.Sum256(payload)
+	digest = formatDigest(sum[:])
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc", io.Discard); err != nil {
+		t.Errorf("matching digest: %v", err)
+	}
+	sum = sha256.Sum256([]byte("something else"))
+	digest = formatDigest(sum[:])
+	if _, err := c.Receive(context.Background(), srv.URL+"/ddl/abc", io.Discard); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("got %v, want ErrDigestMismatch", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Download is a transfer being downloaded. Reading Body pulls the payload
+// from the uploader, through the server.
+type Download struct {
+	Body     io.ReadCloser
+	Filename string // as given by the uploader; sanitize it before using it as a path
+	Size     int64  // -1 for a stream, whose size is known at the end
+	IsText   bool
+}
+
+// DirectURL turns a link as given by the uploaders (/dl/...) into the direct
+// download one (/ddl/...); see downloading.adoc. A direct link, or the one of
+// a named pipe (/pipe/...), is returned as is. The fragment, that holds the key of an end-to-end encrypted
+// transfer, is kept.
+func DirectURL(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%w: %s", ErrNotALink, link)
+	}
+	switch {
+	case strings.Contains(u.Path, "/ddl/"), strings.Contains(u.Path, "/pipe/"):
+	case strings.Contains(u.Path, "/dl/"):
+		u.Path = strings.Replace(u.Path, "/dl/", "/ddl/", 1)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrNotALink, link)
+	}
+	return u.String(), nil
+}
+
+// Open starts downloading from link. No secret is needed, the link is the
+// capability. The transfer is one-shot: a second Open of the same link fails
+// with ErrConduitAlreadyDownloading. The caller must close Body; the payload
+// is complete only if Body is read to EOF without errors.
+//
+// If the connection drops, Body reconnects on its own and resumes where it
+// was, as long as the server still allows it (see server.adoc, "Resuming a
+// download").
+//
+// If the server gives the SHA-256 of the payload, as declared by the uploader
+// or in a trailer, reading Body fails at the end with ErrDigestMismatch if
+// what was read doesn't match.
+//
+// An end-to-end encrypted payload is decrypted with the key in the fragment
+// of link; reading Body fails with ErrDecryption if it's wrong, or if the
+// payload was altered.
+func (c *Client) Open(ctx context.Context, link string) (*Download, error) {
+	ddlURL, err := DirectURL(link)
+	if err != nil {
+		return nil, err
+	}
+	ddlURL, key, _ := strings.Cut(ddlURL, "#")
+	res, err := c.get(ctx, ddlURL, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Download{
+		Body: &resumingBody{
+			c:       c,
+			ctx:     ctx,
+			url:     ddlURL,
+			etag:    res.Header.Get("ETag"),
+			resume:  res.Header.Get("Accept-Ranges") == "bytes",
+			current: res.Body,
+			size:    res.ContentLength,
+			hash:    sha256.New(),
+			digest:  parseDigest(res.Header.Get("Repr-Digest")),
+			trailer: res.Trailer,
+		},
+		Size:   res.ContentLength,
+		IsText: strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain"),
+	}
+	if res.Header.Get("X-Fileway-E2E") != "" {
+		if key == "" {
+			ret.Body.Close()
+			return nil, ErrMissingKey
+		}
+		if ret.Size < 0 {
+			ret.Body.Close()
+			return nil, fmt.Errorf("%w: the size is unknown", ErrDecryption)
+		}
+		opener, err := newOpener(ret.Body, key, ret.Size)
+		if err != nil {
+			ret.Body.Close()
+			return nil, err
+		}
+		ret.Body, ret.Size = opener, openedSize(ret.Size)
+	}
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		ret.Filename = params["filename"]
+	}
+	return ret, nil
+}
+
+// Requests the payload from offset from on; etag, if given, makes sure it's
+// still the same one.
+func (c *Client) get(ctx context.Context, ddlURL string, from int64, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ddlURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setUserAgent(req)
+	if from > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := http.StatusOK
+	if from > 0 {
+		expected = http.StatusPartialContent
+	}
+	if res.StatusCode == expected {
+		if from == 0 || strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", from)) {
+			return res, nil
+		}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+	serr := newStatusError(res, "download", body)
+	switch {
+	case res.StatusCode == http.StatusNotFound, res.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return nil, fmt.Errorf("%w: %w", ErrConduitExpired, serr)
+	case res.StatusCode == http.StatusGone && serr.Phase != "":
+		return nil, overError(serr)
+	case res.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %w", ErrConduitAlreadyDownloading, serr)
+	}
+	return nil, serr
+}
+
+// Receive downloads from link into w, and returns once every byte is written.
+// The returned Download describes the payload; its Body is already consumed.
+func (c *Client) Receive(ctx context.Context, link string, w io.Writer) (*Download, error) {
+	d, err := c.Open(ctx, link)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Body.Close()
+
+	done := int64(0)
+	buf := make([]byte, 256*1024)
+	for {
+		n, err := d.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return d, werr
+			}
+			done += int64(n)
+			c.progress(done, d.Size)
+		}
+		if err == io.EOF {
+			return d, nil
+		}
+		if err != nil {
+			return d, err
+		}
+	}
+}
+
+// How many times in a row a dropped download is resumed before giving up,
+// retryDelay apart more each time. The server keeps the transfer for its
+// grace window, a minute by default, so this covers most of it.
+const maxResumes = 8
+
+// The base delay between attempts, for downloads and uploads alike.
+var retryDelay = time.Second
+
+// The server announces the size and then streams it. If the connection drops,
+// this reconnects with a Range request and carries on from the same offset; if
+// the other end is gone for good, the body ends with io.ErrUnexpectedEOF
+// rather than just short. What's read is hashed, to check it at the end
+// against the digest, if the server gives one.
+type resumingBody struct {
+	c       *Client
+	ctx     context.Context
+	url     string
+	etag    string
+	resume  bool
+	current io.ReadCloser
+	read    int64
+	size    int64
+	hash    hash.Hash
+	digest  []byte      // from the headers
+	trailer http.Header // of the last response, filled once it's read
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := b.current.Read(p)
+		b.read += int64(n)
+		b.hash.Write(p[:n])
+		if err == io.EOF && b.read < b.size {
+			err = io.ErrUnexpectedEOF
+		}
+		// A stream has no size to check against: the server says in the
+		// trailer that it's complete
+		if err == io.EOF && b.size < 0 && b.trailer.Get("X-Fileway-Status") != "complete" {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == io.EOF && !b.matchesDigest() {
+			return n, ErrDigestMismatch
+		}
+		if err == nil || err == io.EOF || n > 0 {
+			return n, err
+		}
+
+		// Interrupted: reconnect, unless there's nothing to reconnect to.
+		if b.size < 0 {
+			return 0, fmt.Errorf("%w: stream interrupted after %d bytes: %w", io.ErrUnexpectedEOF, b.read, err)
+		}
+		if !b.resume || b.ctx.Err() != nil || attempt > maxResumes {
+			return 0, fmt.Errorf("%w: transfer interrupted, %d bytes missing: %w", io.ErrUnexpectedEOF, b.size-b.read, err)
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+		b.current.Close()
+		res, rerr := b.c.get(b.ctx, b.url, b.read, b.etag)
+		if errors.Is(rerr, ErrConduitExpired) || errors.Is(rerr, ErrConduitCancelled) || errors.Is(rerr, ErrConduitFailed) {
+			return 0, fmt.Errorf("%w: transfer interrupted, %d bytes missing: %w", io.ErrUnexpectedEOF, b.size-b.read, rerr)
+		}
+		if rerr != nil {
+			// Typically the server hasn't noticed yet that the old connection
+			// is gone, and says it's already downloading; try again.
+			b.current = io.NopCloser(errReader{rerr})
+			continue
+		}
+		b.current, b.trailer = res.Body, res.Trailer
+	}
+}
+
+// Reports whether what was read matches the digest from the headers or the
+// trailer, if any.
+func (b *resumingBody) matchesDigest() bool {
+	digest := b.digest
+	if digest == nil {
+		digest = parseDigest(b.trailer.Get("Repr-Digest"))
+	}
+	return digest == nil || bytes.Equal(b.hash.Sum(nil), digest)
+}
+
+func (b *resumingBody) Close() error {
+	return b.current.Close()
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,192 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// End-to-end encryption: the payload is cut in records, each sealed with
+// AES-256-GCM on its own, and the key only travels in the fragment of the
+// links, which browsers and HTTP clients never send. The format is in
+// uploading.adoc, "End-to-end encryption"; these mirror fileway_logic.
+const (
+	e2eRecordSize       = 64 * 1024
+	e2eTagSize          = 16
+	e2eSealedRecordSize = e2eRecordSize + e2eTagSize
+)
+
+func sealedSize(size int64) int64 {
+	records := (size + e2eRecordSize - 1) / e2eRecordSize
+	return size + records*e2eTagSize
+}
+
+func openedSize(sealedSize int64) int64 {
+	records := (sealedSize + e2eSealedRecordSize - 1) / e2eSealedRecordSize
+	return sealedSize - records*e2eTagSize
+}
+
+// The nonce of a record is its index, with a flag for the last one, so that
+// records can't be reordered, and a payload can't be cut short, unnoticed.
+func e2eNonce(record int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], uint64(record))
+	return nonce
+}
+
+// Returns a new random key, as it goes in the links.
+func newE2EKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("%w: malformed key", ErrDecryption)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Reads the size bytes of r, sealed.
+type sealer struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	size   int64
+	record int64 // the next one to seal
+	plain  []byte
+	buf    []byte
+	sealed []byte // what's left to read of the last record sealed
+}
+
+func newSealer(r io.Reader, key string, size int64) (*sealer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{
+		r:     r,
+		aead:  aead,
+		size:  size,
+		plain: make([]byte, e2eRecordSize),
+		buf:   make([]byte, 0, e2eSealedRecordSize),
+	}, nil
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	if len(s.sealed) == 0 {
+		start := s.record * e2eRecordSize
+		if start >= s.size {
+			return 0, io.EOF
+		}
+		plain := s.plain[:min(e2eRecordSize, s.size-start)]
+		if _, err := io.ReadFull(s.r, plain); err != nil {
+			return 0, err
+		}
+		last := start+int64(len(plain)) == s.size
+		s.sealed = s.aead.Seal(s.buf[:0], e2eNonce(s.record, last), plain, nil)
+		s.record++
+	}
+	n := copy(p, s.sealed)
+	s.sealed = s.sealed[n:]
+	return n, nil
+}
+
+// Moves a sealer that wasn't read yet forward by n sealed bytes: the records
+// before are skipped in r, seeking if it can, and only the one n falls in is
+// sealed.
+func (s *sealer) skip(n int64) error {
+	s.record = n / e2eSealedRecordSize
+	if err := skip(s.r, s.record*e2eRecordSize); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, s, n%e2eSealedRecordSize)
+	return err
+}
+
+// Opens the sealed payload of size bytes that is read from body.
+type opener struct {
+	body   io.ReadCloser
+	aead   cipher.AEAD
+	size   int64
+	record int64 // the next one to open
+	buf    []byte
+	plain  []byte // what's left to read of the last record opened
+}
+
+func newOpener(body io.ReadCloser, key string, size int64) (*opener, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &opener{
+		body: body,
+		aead: aead,
+		size: size,
+		buf:  make([]byte, e2eSealedRecordSize),
+	}, nil
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	if len(o.plain) == 0 {
+		start := o.record * e2eSealedRecordSize
+		if start >= o.size {
+			return 0, io.EOF
+		}
+		sealed := o.buf[:min(e2eSealedRecordSize, o.size-start)]
+		if _, err := io.ReadFull(o.body, sealed); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		last := start+int64(len(sealed)) == o.size
+		plain, err := o.aead.Open(sealed[:0], e2eNonce(o.record, last), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("%w: record %d", ErrDecryption, o.record)
+		}
+		o.plain = plain
+		o.record++
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *opener) Close() error {
+	return o.body.Close()
+}
+
+// The server knows nothing of these: they come from the payload itself.
+var (
+	ErrMissingKey = errors.New("the link lacks the key of an end-to-end encrypted transfer")
+	ErrDecryption = errors.New("can't decrypt the payload: wrong key, or altered data")
+)
@@ -0,0 +1,103 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// The version of the chunk plan that is asked for at setup and ping; this
+// mirrors fileway_logic.ChunkPlan, see server.adoc, "Chunk plan".
+const chunkPlanVersion = 3
+
+// The version of a plan that is set up front, that is asked for at setup to
+// send several chunks at once: an adaptive one can't.
+const chunkPlanFixed = 2
+
+// How the payload is cut in chunks: the first one is Initial bytes, each one
+// after is Factor times the one before, up to Max, and the last one is what's
+// left of Size; a stream, of Size -1, goes on with chunks of Max. If
+// Adaptive, the server tells the size of each chunk after the first, as it
+// gets the one before. Parallel is how many chunks can be sent at once. A
+// server from before gives the list of the sizes instead, in sizes.
+type chunkPlan struct {
+	Version  int   `json:"version"`
+	Initial  int   `json:"initial"`
+	Factor   int   `json:"factor"`
+	Min      int   `json:"min"`
+	Max      int   `json:"max"`
+	Size     int64 `json:"size"`
+	Adaptive bool  `json:"adaptive"`
+	Parallel int   `json:"parallel"`
+
+	sizes []int
+}
+
+// Parses the plan as given by ping: nil while nobody is downloading, that's
+// null, or an empty list from a server from before.
+func parsePlan(body []byte) (*chunkPlan, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		var sizes []int
+		if err := json.Unmarshal(body, &sizes); err != nil || len(sizes) == 0 {
+			return nil, err
+		}
+		return &chunkPlan{sizes: sizes}, nil
+	}
+	var ret *chunkPlan
+	if err := json.Unmarshal(body, &ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// The size of the chunk at index, for a payload of size bytes, -1 for a
+// stream; 0 past the last one.
+func (p *chunkPlan) sizeAt(index int, size int64) int {
+	if p.sizes != nil {
+		switch {
+		case index < len(p.sizes):
+			return p.sizes[index]
+		case size < 0:
+			// A stream goes on, as big as the last one
+			return p.sizes[len(p.sizes)-1]
+		}
+		return 0
+	}
+
+	off, n := int64(0), p.Initial
+	for ; index > 0 && n < p.Max; index-- {
+		off += int64(n)
+		if p.Factor < 2 {
+			n = p.Max
+		} else {
+			n = min(n*p.Factor, p.Max)
+		}
+	}
+	off += int64(index) * int64(n)
+	if size < 0 {
+		return n
+	}
+	return int(max(0, min(int64(n), size-off)))
+}
+
+// The biggest chunk there can be.
+func (p *chunkPlan) biggest() int {
+	ret := max(p.Initial, p.Max)
+	for _, n := range p.sizes {
+		ret = max(ret, n)
+	}
+	return ret
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import "time"
+
+// How long a chunk of an adaptive plan should take, at the pace of the
+// transfer, round trip included: long enough that the round trip is a small
+// part of it, short enough to be well within the 30 seconds that Offer waits.
+const chunkTarget = 2 * time.Second
+
+// A pace, in bytes per second, as measured: the bytes over the time they
+// took, where each measure weighs as much as all those before, in both. A
+// chunk that takes long weighs more than many that are quick, so that it
+// follows a link that slows down, or a downloader that falls behind, in a
+// chunk or two.
+type pace struct {
+	bytes, secs float64
+}
+
+// Measures n bytes, that took from since to now.
+func (p *pace) observe(n int, since, now time.Time) {
+	took := now.Sub(since).Seconds()
+	if since.IsZero() || took <= 0 {
+		return
+	}
+	p.bytes = p.bytes/2 + float64(n)
+	p.secs = p.secs/2 + took
+}
+
+// The bytes per second; 0 until it's measured.
+func (p pace) value() float64 {
+	if p.secs == 0 {
+		return 0
+	}
+	return p.bytes / p.secs
+}
+
+// WithAdaptivePlan makes the plan of the conduit adaptive, with chunks between
+// minChunk and maxChunk; see ChunkPlan. A text is sent in a chunk anyway.
+func WithAdaptivePlan(minChunk, maxChunk int) ConduitOption {
+	return func(c *Conduit) { c.makeAdaptive(minChunk, maxChunk) }
+}
+
+// See WithAdaptivePlan.
+func (c *Conduit) makeAdaptive(minChunk, maxChunk int) {
+	if c.IsText {
+		return
+	}
+	c.ChunkPlan = ChunkPlan{
+		Version:  ChunkPlanVersion,
+		Initial:  min(chunkSizeInitial, maxChunk),
+		Factor:   chunkSizeRampFactor,
+		Min:      min(minChunk, maxChunk),
+		Max:      maxChunk,
+		Size:     c.Size,
+		Adaptive: true,
+	}
+	c.nextSize = c.ChunkPlan.Initial
+}
+
+// The pace of the transfer: the one of the uploader, that waits for room in
+// the queues, or of the downloaders, whichever is slower. 0 until it's
+// measured. Call with mu held.
+func (c *Conduit) pace() float64 {
+	up, down := c.upPace.value(), c.downPace.value()
+	if up == 0 || down == 0 {
+		return max(up, down)
+	}
+	return min(up, down)
+}
+
+// Chooses the size of the chunk after one of prev, for an adaptive plan: it
+// ramps up as usual while the pace keeps up, and the downloaders too, i.e.
+// there's no more than a chunk waiting for them; it stays while it takes up
+// to twice chunkTarget, so that a pace that wobbles doesn't change it at
+// every chunk; and it drops to what the pace allows, but not below Min, if it
+// takes longer. Call with mu held.
+func (c *Conduit) adapt(prev int) int {
+	grown := c.ChunkPlan.next(prev)
+	if c.buffered.Load() > int64(prev) {
+		// Bigger chunks would wait longer in the queues, until Offer gives up
+		grown = prev
+	}
+	pace := c.pace()
+	if pace == 0 {
+		return grown
+	}
+	want := int(min(pace*chunkTarget.Seconds(), float64(c.ChunkPlan.Max)))
+	switch {
+	case want >= grown:
+		return grown
+	case want >= prev/2:
+		return prev
+	}
+	// In whole KiB, as the bounds are
+	return max(c.ChunkPlan.Min, want&^1023)
+}
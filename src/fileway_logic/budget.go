@@ -0,0 +1,233 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The bytes that the conduits of a set can buffer in memory, all together;
+// see ConduitSet.Limit. They are counted as Buffered counts them: a chunk
+// queued for several downloaders counts for each. A nil budget has no limit.
+type budget struct {
+	mu    sync.Mutex
+	max   int64 // 0 for no limit
+	used  int64
+	freed chan struct{} // closed, and replaced, when some is given back
+	// How many are waiting for some to be given back; meanwhile, the tails
+	// of the downloaders are cut down, see Conduit.Reserve
+	wanting int
+}
+
+func newBudget() *budget {
+	return &budget{freed: make(chan struct{})}
+}
+
+// Takes n bytes, if they fit; a chunk bigger than the whole budget still goes,
+// alone. If they don't, it returns a channel that is closed when some are
+// given back, to try again.
+func (b *budget) take(n int64) (bool, <-chan struct{}) {
+	if b == nil {
+		return true, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.max > 0 && b.used > 0 && b.used+n > b.max {
+		return false, b.freed
+	}
+	b.used += n
+	return true, nil
+}
+
+// Takes n bytes anyway, e.g. for a copy of a chunk that is already in: the
+// next chunk waits for them.
+func (b *budget) force(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used += n
+}
+
+func (b *budget) give(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// Counts one more waiting for room, or one less with -1.
+func (b *budget) want(delta int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.wanting += delta
+}
+
+// Reports whether somebody is waiting for room.
+func (b *budget) isWanted() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.wanting > 0
+}
+
+// Reports whether no more can be taken, until some is given back.
+func (b *budget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.max > 0 && b.used >= b.max
+}
+
+// Counts n bytes more as held by the conduit, taking them from the budget:
+// with wait, only if they fit, otherwise anyway (see budget.force). If they
+// don't fit, it returns a channel that is closed when it's worth trying again.
+func (c *Conduit) hold(n int64, wait bool) (bool, <-chan struct{}) {
+	if wait {
+		if ok, freed := c.budget.take(n); !ok {
+			return false, freed
+		}
+	} else {
+		c.budget.force(n)
+	}
+	c.held.Add(n)
+	// Held after the conduit was over, and gave back what it held: nobody
+	// would give it back
+	if c.IsOver() {
+		c.unhold(math.MaxInt64)
+	}
+	return true, nil
+}
+
+// Reserve holds n bytes of the budget of the set for the chunk at index, before
+// it's read, so that what the uploaders send is in the budget from the first
+// byte. The next chunk waits for them, up to 30 seconds, as Offer waits for
+// the queue, and then it's ErrUploadTimeout; what's kept to resume a download
+// from goes first, see trimTails. One ahead of it, that would wait for its
+// turn in memory, gets ErrMemoryFull at once; a retry of one that was already
+// received takes them anyway, as it's read only to be dropped. A spooled
+// conduit doesn't need them. They are given back with Unreserve, unless the
+// chunk is taken by OfferChunk.
+func (c *Conduit) Reserve(index, n int) error {
+	if c.spool != nil {
+		return nil
+	}
+	c.mu.Lock()
+	next := c.nextChunk
+	c.mu.Unlock()
+	if index < next {
+		c.hold(int64(n), false)
+		return nil
+	}
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	wanting := false
+	defer func() {
+		if wanting {
+			c.budget.want(-1)
+		}
+	}()
+	for {
+		held, freed := c.hold(int64(n), true)
+		if !held {
+			c.mu.Lock()
+			trimmed := c.trimTails()
+			c.mu.Unlock()
+			if trimmed {
+				held, freed = c.hold(int64(n), true)
+			}
+		}
+		switch {
+		case held:
+			return nil
+		case index > next:
+			return ErrMemoryFull
+		case !wanting:
+			c.budget.want(1)
+			wanting = true
+		}
+		select {
+		case <-freed:
+		case <-c.Done:
+			return ErrConduitOver
+		case <-timer.C:
+			// As in Offer, a downloader that dropped may be back
+			if !c.IsDetached() {
+				return ErrUploadTimeout
+			}
+			timer.Reset(30 * time.Second)
+		}
+	}
+}
+
+// Unreserve gives back n bytes reserved with Reserve.
+func (c *Conduit) Unreserve(n int) {
+	if c.spool == nil {
+		c.unhold(int64(n))
+	}
+}
+
+// Drops the tails of the downloaders but their last chunk, that may be being
+// written and is not held: what is kept to resume a download from goes first
+// when the budget is short. While somebody waits for room, the downloaders
+// keep no more than that as they go, see Downloader.Delivered. It reports
+// whether it dropped any. Call with mu held.
+func (c *Conduit) trimTails() bool {
+	ret := false
+	for _, d := range c.downloaders {
+		for len(d.tail) > 1 {
+			d.shift()
+			ret = true
+		}
+	}
+	return ret
+}
+
+// Gives back n bytes held by the conduit, or as many as it still holds: once
+// it's over it gave them all back, and what's still in the queues doesn't
+// count anymore.
+func (c *Conduit) unhold(n int64) {
+	for {
+		held := c.held.Load()
+		n = min(n, held)
+		if n <= 0 {
+			return
+		}
+		if c.held.CompareAndSwap(held, held-n) {
+			c.budget.give(n)
+			return
+		}
+	}
+}
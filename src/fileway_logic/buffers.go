@@ -0,0 +1,69 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// The chunks go from the uploader to the downloader in buffers that are
+// recycled, rather than allocated for each chunk and left to the GC: at a few
+// hundred MB/s, that's the GC running all the time, and the heap swinging by
+// a multiple of what's buffered. The buffers come in power-of-two sizes, from
+// chunkSizeInitial on, as do the chunks of the plan, but the last one.
+//
+// Beyond bufferClassMax they are not pooled.
+const (
+	bufferClassMin = 12 // 4k, chunkSizeInitial
+	bufferClassMax = 30 // 1G
+)
+
+var bufferPools [bufferClassMax - bufferClassMin + 1]sync.Pool
+
+// The class of a buffer that holds n bytes, i.e. the exponent of the power of
+// two that is at least n; -1 if it's too big to be pooled.
+func bufferClass(n int) int {
+	class := max(bits.Len(uint(n-1)), bufferClassMin)
+	if n <= 0 || class > bufferClassMax {
+		return -1
+	}
+	return class
+}
+
+// NewBuffer returns a buffer of n bytes, for a chunk, from the pool if there's
+// one. Its content is not zeroed. It's to be given back with ReleaseBuffer,
+// once nobody uses it; one that isn't is just left to the GC.
+func NewBuffer(n int) []byte {
+	class := bufferClass(n)
+	if class < 0 {
+		return make([]byte, n)
+	}
+	if b, ok := bufferPools[class-bufferClassMin].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, 1<<class)
+}
+
+// ReleaseBuffer gives back a buffer from NewBuffer, or a slice of it, to be
+// used again: whoever still reads it would see another chunk. Anything else is
+// ignored.
+func ReleaseBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class < 0 || cap(b) != 1<<class {
+		return
+	}
+	b = b[:0]
+	bufferPools[class-bufferClassMin].Put(&b)
+}
@@ -14,7 +14,13 @@
 package fileway
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"log/slog"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -31,12 +37,26 @@ Conduit represents a single transfer conduit, which can be used to upload or dow
 It is a thread-safe structure that can be accessed concurrently by multiple goroutines.
 */
 type Conduit struct {
-	Id       string
+	Id string
+	// What stands for Id in the logs: anyone who has the id can download the
+	// payload, so it must not be there.
+	Fingerprint string
+	// Who set it up, as the position of the secret; see auth.Identify. 0 if
+	// unknown.
+	Identity int
 	IsText   bool
 	Filename string
-	Size     int64
+	// The bytes that go through: for an end-to-end encrypted payload, see
+	// E2E, the ciphertext, and PayloadSize is the original size. -1 for a
+	// stream, whose size is known only at the end; see Total.
+	Size int64
+	// Whether the payload is end-to-end encrypted: the server relays it as
+	// it is, and the downloader opens it with the key in the link.
+	E2E bool
 
-	ChunkPlan []int
+	// How the uploader cuts the payload in chunks; see ChunkSizeAt. It's
+	// set up front, but for the size of the chunks of an adaptive one.
+	ChunkPlan ChunkPlan
 
 	ChunkQueue chan []byte
 
@@ -44,61 +64,282 @@ type Conduit struct {
 	// channel is a broadcast that every waiter sees, immediately and forever, so
 	// selecting on both tells a caller which of the two happened - no follow-up
 	// query needed.
-	Started chan struct{} // closed when a download claims the conduit
-	Done    chan struct{} // closed when the conduit expires
+	Started chan struct{} // closed when the download starts
+	Done    chan struct{} // closed when the conduit is over, see Phase
+	// Closed when the uploader marks the end of a stream; nil if it's not
+	// one. See EndStream.
+	StreamEnd chan struct{}
 
 	secret string
+	// The name of the pipe it's on, if any; see ConduitSet.Pipe. Guarded by
+	// the mu of the set.
+	pipe string
+	// The SHA-256 of the payload as the uploader declared it, if it did. It's
+	// the one of what goes through, i.e. sealed if E2E.
+	digest []byte
 
-	lastAccessed    atomic.Int64
-	downloadStarted atomic.Bool
-	expired         atomic.Bool
-	chunkIndex      atomic.Int32
+	createdAt    int64 // unix millis
+	lastAccessed atomic.Int64
+	startedAt    atomic.Int64 // unix millis, when the download started
+	// The transitions so far, guarded by mu, and the last one, to be read
+	// without it
+	history []Transition
+	outcome atomic.Pointer[Transition]
+	// Bytes in ChunkQueue and in the queues of the downloaders; the same
+	// chunk, queued for several downloaders, counts for each.
+	buffered atomic.Int64
+	// The memory that the conduits of a set can buffer, together, and how
+	// much of it this one holds: the chunks being read (see Reserve), those
+	// buffered, and those kept in the tails of the downloaders once written.
+	// It's all given back when the conduit is over. See budget.go.
+	budget *budget
+	held   atomic.Int64
+
+	// Who gets the payload: one Downloader per expected downloader, each with
+	// its own buffer. With more than one, a goroutine hands every chunk of
+	// ChunkQueue to each of them, so the slowest sets the pace. The download
+	// starts when they are all there, or fanOutWait after the first one came.
+	mu          sync.Mutex
+	downloaders []*Downloader
+	fanOutWait  time.Duration
+	fanOutTimer *time.Timer
+	tailMax     int           // see Downloader
+	left        chan struct{} // closed when no downloader is left
+
+	// The entry of ChunkPlan to be uploaded next, and those whose upload is
+	// under way: with a plan that allows several at once, the ones ahead of
+	// nextChunk wait for their turn, see parallel.go. Guarded by mu.
+	nextChunk int
+	inFlight  map[int]bool
+	turn      chan struct{} // closed, and replaced, when nextChunk moves on
+	accepted  int64         // bytes of the chunks before nextChunk
+	eof       bool          // a stream, whose end was marked at nextChunk
+	// How fast the transfer goes, see adapt.go: the chunks accepted, as the
+	// time between each one and the one before, and the chunks delivered, as
+	// the time between each one and the one before for the same downloader.
+	// With an adaptive plan, they set the size of the chunk at nextChunk.
+	acceptedAt time.Time
+	upPace     pace
+	downPace   pace
+	nextSize   int
+
+	// Whether the uploader is around once the download started: how many of
+	// its requests are being handled, and when the last one ended. An uploader
+	// that went away can reconnect, ask for Progress and go on from there.
+	// Guarded by mu.
+	uploads        int
+	uploaderLeftAt int64 // unix millis
+
+	// If not nil, the payload goes to disk rather than to the downloaders,
+	// and they read it from there, whenever they come.
+	spool *spool
+}
+
+// Downloader is one of the receiving ends of a conduit. What was handed to it
+// is kept, so that one that lost the connection can attach again and resume
+// (HTTP Range): the chunks are kept in tail until tailMax are retained, which
+// bounds how far back a resume can go. What was handed to it is also hashed,
+// in order, so that it can be checked against what the uploader declared.
+// The only downloader of a conduit owns the chunks, and gives them back with
+// ReleaseBuffer once they are out of the tail; those of several are shared,
+// and left to the GC. Guarded by the conduit's mu.
+type Downloader struct {
+	c       *Conduit
+	queue   chan []byte
+	dropped chan struct{} // closed when it's done, or gone for good
+
+	attached   bool
+	detachedAt int64 // unix millis, set when it goes away
+	gone       bool
+	skipped    bool  // didn't come in time, and the download started without it
+	delivered  int64 // bytes taken from the queue
+	hash       hash.Hash
+	tail       [][]byte
+	tailStart  int64  // offset of tail[0]
+	last       []byte // the chunk being written, without a tail
+	// The chunk before, as its size and when it was taken: the time until
+	// the next one is taken is how long it took to write. See
+	// Conduit.downPace.
+	deliveredLen int
+	deliveredAt  time.Time
 }
 
-// Creates a new Conduit instance
+// A ConduitOption sets up a conduit as it's created, before anybody else can
+// see it; see ConduitSet.NewConduit.
+type ConduitOption func(*Conduit)
+
+// WithDigest has the payload checked against sum, its SHA-256 as the uploader
+// declared it; nil for none.
+func WithDigest(sum []byte) ConduitOption {
+	return func(c *Conduit) { c.digest = sum }
+}
+
+// WithIdentity sets who set the conduit up; see Conduit.Identity.
+func WithIdentity(identity int) ConduitOption {
+	return func(c *Conduit) { c.Identity = identity }
+}
+
+// Creates a new Conduit instance, to be downloaded by as many as downloads.
+// size is the one of the payload, before encryption if e2e.
 func newConduit(
-	isText bool,
+	isText, e2e bool,
 	filename string,
 	size int64,
 	secret string,
-	chunkSize, bufferQueueSize, idsLength int,
+	chunkSize, bufferQueueSize, idsLength, downloads int,
+	opts ...ConduitOption,
 ) *Conduit {
+	if e2e {
+		size = SealedSize(size)
+	}
+	id := utils.GenRandomString(idsLength)
 	ret := &Conduit{
-		Id:         utils.GenRandomString(idsLength),
-		IsText:     isText,
-		Filename:   filename,
-		Size:       size,
-		secret:     secret,
-		ChunkQueue: make(chan []byte, bufferQueueSize),
-		Started:    make(chan struct{}),
-		Done:       make(chan struct{}),
+		Id:          id,
+		Fingerprint: Fingerprint(id),
+		IsText:      isText,
+		Filename:    filename,
+		Size:        size,
+		E2E:         e2e,
+		secret:      secret,
+		createdAt:   time.Now().UnixMilli(),
+		ChunkQueue:  make(chan []byte, bufferQueueSize),
+		Started:     make(chan struct{}),
+		Done:        make(chan struct{}),
+		left:        make(chan struct{}),
+		inFlight:    map[int]bool{},
+		turn:        make(chan struct{}),
 	}
 
-	if !ret.IsText {
-		ret.ChunkPlan = buildChunkPlan(size, chunkSize)
-	} else {
-		ret.ChunkPlan = []int{int(size)}
+	// A text goes in a chunk
+	if isText {
+		chunkSize = int(size)
+	}
+	ret.ChunkPlan = newChunkPlan(size, chunkSize)
+	if size < 0 {
+		ret.StreamEnd = make(chan struct{})
+	}
+
+	// A single downloader reads ChunkQueue directly
+	for i := 0; i < max(downloads, 1); i++ {
+		d := &Downloader{c: ret, queue: ret.ChunkQueue, dropped: make(chan struct{}), hash: sha256.New()}
+		if downloads > 1 {
+			d.queue = make(chan []byte, bufferQueueSize)
+		}
+		ret.downloaders = append(ret.downloaders, d)
+	}
+	for _, opt := range opts {
+		opt(ret)
 	}
 
+	ret.transition(PhaseWaiting, ReasonSetUp, "waiting for the downloader")
 	ret.touch()
 	return ret
 }
 
-func buildChunkPlan(size int64, chunkSize int) []int {
-	if size < chunkSizeInitial {
-		return []int{int(size)}
+// Fingerprint returns what stands for a conduit id in the logs: a short hash,
+// that tells the lines about a transfer apart from the others, but can't be
+// turned back into the id.
+func Fingerprint(id string) string {
+	sum := sha256.Sum256([]byte("fileway log fingerprint\x00" + id))
+	return hex.EncodeToString(sum[:6])
+}
+
+// LogAttrs returns what the log lines about the conduit carry, for slog.
+func (c *Conduit) LogAttrs() []any {
+	return []any{
+		slog.String("conduit", c.Fingerprint),
+		slog.Int64("size", c.Size),
+		slog.Int("identity", c.Identity),
 	}
+}
+
+// IsStream reports whether the size is not known in advance: the uploader
+// sends chunks until it marks the end, with EndStream.
+func (c *Conduit) IsStream() bool {
+	return c.Size < 0
+}
 
-	sum := int64(chunkSizeInitial)
-	lastChunk := chunkSizeInitial
-	ret := []int{chunkSizeInitial}
-	for sum < size {
-		nextChunk := min(lastChunk*chunkSizeRampFactor, chunkSize, int(size-sum))
-		ret = append(ret, nextChunk)
-		sum += int64(nextChunk)
-		lastChunk = nextChunk
+// ChunkSizeAt returns the size of the chunk at index in the plan, i.e. the
+// most it can be; a chunk of a stream can be shorter. It's 0 if no chunk is
+// expected there. With an adaptive plan only the size of the next chunk is
+// known, until it's accepted: for the others it's the most any can be, as
+// they are not queued anyway.
+func (c *Conduit) ChunkSizeAt(index int) int {
+	if !c.ChunkPlan.Adaptive {
+		return c.ChunkPlan.SizeAt(index)
 	}
-	return ret
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.chunkSizeAt(index)
+}
+
+// See ChunkSizeAt; c.mu must be held.
+func (c *Conduit) chunkSizeAt(index int) int {
+	switch {
+	case !c.ChunkPlan.Adaptive:
+		return c.ChunkPlan.SizeAt(index)
+	case index < 0:
+		return 0
+	case index != c.nextChunk:
+		return c.ChunkPlan.Max
+	case c.IsStream():
+		return c.nextSize
+	}
+	return int(min(int64(c.nextSize), c.Size-c.accepted))
+}
+
+// ChunkOffsetAt returns the offset in the payload of the chunk at index in the
+// plan, as far as the plan goes: a chunk of a stream can be shorter, and then
+// the stream ends. With an adaptive plan only the one of the next chunk is
+// known, and it's -1 for the others.
+func (c *Conduit) ChunkOffsetAt(index int) int64 {
+	if !c.ChunkPlan.Adaptive {
+		return c.ChunkPlan.OffsetAt(index)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index != c.nextChunk {
+		return -1
+	}
+	return c.accepted
+}
+
+// Total returns the bytes that go through: Size, or for a stream, what was
+// sent once it ended, and -1 before.
+func (c *Conduit) Total() int64 {
+	if !c.IsStream() {
+		return c.Size
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.eof {
+		return -1
+	}
+	return c.accepted
+}
+
+// IsWhole reports whether bytes, from the start, are the whole payload. For a
+// stream it can only be once it ended.
+func (c *Conduit) IsWhole(bytes int64) bool {
+	total := c.Total()
+	return total >= 0 && bytes >= total
+}
+
+// PayloadSize is the size of the payload as the uploader has it, i.e.
+// before encryption if it's end-to-end encrypted.
+func (c *Conduit) PayloadSize() int64 {
+	if c.E2E {
+		return OpenedSize(c.Size)
+	}
+	return c.Size
+}
+
+// Digest returns the SHA-256 of the payload the uploader declared, or nil.
+func (c *Conduit) Digest() []byte {
+	return c.digest
 }
 
 // IsUploadSecretWrong checks if the provided secret is wrong
@@ -123,58 +364,719 @@ func (c *Conduit) WasAccessedAfter(cutoffTime int64) bool {
 	return c.lastAccessed.Load() > cutoffTime
 }
 
-// Download starts the download process. The CAS makes this the only caller that
-// gets through, so closing Started here cannot happen twice.
-func (c *Conduit) Download() error {
-	if !c.downloadStarted.CompareAndSwap(false, true) {
-		return ErrConduitAlreadyDownloading
+// Downloads reports how many downloaders the payload is meant for.
+func (c *Conduit) Downloads() int {
+	if c.spool != nil {
+		return c.spool.downloads
 	}
+	return len(c.downloaders)
+}
 
-	c.touch()
+// Download makes the caller a downloader from the first byte. See Attach.
+func (c *Conduit) Download() (*Downloader, error) {
+	d, _, err := c.Attach(0)
+	return d, err
+}
+
+// Attach makes the caller a downloader, resuming from offset from, and
+// returns the chunks (or their ends) already delivered past that offset, to
+// be written again before reading Chunks. They are copies: the tail they come
+// from may be trimmed, and its buffers used again, while they are written,
+// see trimTails. Before the download starts, a
+// downloader takes a free place; after, only one that went away can come
+// back. The download starts, closing Started, when the last place is taken.
+func (c *Conduit) Attach(from int64) (*Downloader, [][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.startedAt.Load() == 0 {
+		if from != 0 {
+			return nil, nil, ErrRangeNotSatisfiable
+		}
+		claimed := 0
+		var free *Downloader
+		for _, d := range c.downloaders {
+			if d.attached {
+				claimed++
+			} else if free == nil {
+				free = d
+			}
+		}
+		if free == nil {
+			return nil, nil, ErrConduitAlreadyDownloading
+		}
+		free.attached = true
+		c.touch()
+		if claimed+1 == len(c.downloaders) {
+			c.start()
+		} else if c.fanOutTimer == nil {
+			c.fanOutTimer = time.AfterFunc(c.fanOutWait, c.startWithThoseAttached)
+		}
+		return free, nil, nil
+	}
+
+	// All the downloaders get the same bytes, so any that went away will do,
+	// as long as it can resume from there.
+	err := ErrConduitAlreadyDownloading
+	for _, d := range c.downloaders {
+		if !d.isDetached() {
+			continue
+		}
+		if from < d.tailStart || from > d.delivered {
+			err = ErrRangeNotSatisfiable
+			continue
+		}
+
+		var replay [][]byte
+		off := d.tailStart
+		for _, chunk := range d.tail {
+			if end := off + int64(len(chunk)); end > from {
+				replay = append(replay, bytes.Clone(chunk[max(0, from-off):]))
+			}
+			off += int64(len(chunk))
+		}
+
+		d.attached = true
+		c.touch()
+		return d, replay, nil
+	}
+	return nil, nil, err
+}
+
+// Starts the download, with the downloaders attached so far; the places left
+// free are not waited for. Call with mu held.
+func (c *Conduit) start() {
+	if c.startedAt.Load() > 0 || !c.transition(PhaseStreaming, ReasonDownloadStarted, "the download started") {
+		return
+	}
+	if c.fanOutTimer != nil {
+		c.fanOutTimer.Stop()
+	}
+	for _, d := range c.downloaders {
+		if !d.attached {
+			d.skipped = true
+			d.drop()
+		}
+	}
+	// The uploader is parked on ping, and needs a moment to come: it's
+	// counted as away from now.
+	c.uploaderLeftAt = time.Now().UnixMilli()
+	c.startedAt.Store(c.uploaderLeftAt)
+	if len(c.downloaders) > 1 {
+		go c.fanOut()
+	}
 	close(c.Started)
+}
+
+// Called fanOutWait after the first downloader came, unless all came before.
+func (c *Conduit) startWithThoseAttached() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fanOutTimer = nil
+	for _, d := range c.downloaders {
+		if d.attached {
+			c.start()
+			return
+		}
+	}
+	// They all went away while waiting: the next one that comes re-arms it.
+}
+
+// Hands every chunk of ChunkQueue to each downloader, in turn. One that is
+// slow holds up the others, and so does one that went away, until it's back
+// or gone for good.
+func (c *Conduit) fanOut() {
+	for {
+		var chunk []byte
+		select {
+		case chunk = <-c.ChunkQueue:
+			c.buffered.Add(-int64(len(chunk)))
+			c.unhold(int64(len(chunk)))
+		case <-c.Done:
+			return
+		case <-c.left:
+			return
+		}
+		for _, d := range c.downloaders {
+			select {
+			case d.queue <- chunk:
+				c.buffered.Add(int64(len(chunk)))
+				c.hold(int64(len(chunk)), false)
+			case <-d.dropped:
+			case <-c.Done:
+				return
+			}
+		}
+	}
+}
+
+// Chunks is where the downloader reads the payload from.
+func (d *Downloader) Chunks() <-chan []byte {
+	return d.queue
+}
+
+// Delivered records a chunk taken from Chunks, before it's written to the
+// downloader: if the write fails, a resumed download must find it in the tail.
+func (d *Downloader) Delivered(chunk []byte) {
+	d.c.mu.Lock()
+	defer d.c.mu.Unlock()
 
+	d.delivered += int64(len(chunk))
+	now := time.Now()
+	d.c.downPace.observe(d.deliveredLen, d.deliveredAt, now)
+	d.deliveredLen, d.deliveredAt = len(chunk), now
+	d.hash.Write(chunk)
+	d.c.buffered.Add(-int64(len(chunk)))
+	// The one being written is not held, as the next one can't come before
+	// it's done; the ones before it are, as long as they are in the tail.
+	d.c.unhold(int64(len(chunk)))
+	// The previous chunks were written, this is called before the next
+	if d.c.tailMax == 0 {
+		d.tailStart = d.delivered
+		d.release(d.last)
+		d.last = chunk
+		return
+	}
+	if n := len(d.tail); n > 0 {
+		d.c.hold(int64(len(d.tail[n-1])), false)
+	}
+	// While somebody waits for room, only the one being written is kept
+	keep := d.c.tailMax
+	if d.c.budget.isWanted() {
+		keep = 1
+	}
+	d.tail = append(d.tail, chunk)
+	for len(d.tail) > keep {
+		d.shift()
+	}
+}
+
+// Drops the first chunk of the tail, that is not the last one, being written:
+// it can't be resumed from anymore. Call with the conduit's mu held.
+func (d *Downloader) shift() {
+	d.tailStart += int64(len(d.tail[0]))
+	d.c.unhold(int64(len(d.tail[0])))
+	d.release(d.tail[0])
+	d.tail[0] = nil
+	d.tail = d.tail[1:]
+}
+
+// Gives a chunk back to the pool, if it's not shared with other downloaders.
+// Call with mu held.
+func (d *Downloader) release(chunk []byte) {
+	if len(d.c.downloaders) == 1 {
+		ReleaseBuffer(chunk)
+	}
+}
+
+// Sum returns the SHA-256 of what was delivered so far; once it's all been,
+// it's the one of the payload.
+func (d *Downloader) Sum() []byte {
+	d.c.mu.Lock()
+	defer d.c.mu.Unlock()
+
+	return d.hash.Sum(nil)
+}
+
+// DigestMismatch reports whether the whole payload was delivered, and it's
+// not what the uploader declared.
+func (d *Downloader) DigestMismatch() bool {
+	if d.c.digest == nil {
+		return false
+	}
+	d.c.mu.Lock()
+	defer d.c.mu.Unlock()
+
+	return d.delivered == d.c.Size && string(d.hash.Sum(nil)) != string(d.c.digest)
+}
+
+// Detach records that the downloader went away before the end. It stays
+// around, for the grace window, so that it can come back with Attach. Before
+// the download starts it just frees its place.
+func (d *Downloader) Detach() {
+	d.c.mu.Lock()
+	defer d.c.mu.Unlock()
+
+	d.attached = false
+	if d.c.startedAt.Load() > 0 {
+		d.detachedAt = time.Now().UnixMilli()
+	}
+}
+
+// Drop records that the downloader is done, or won't be back, and reports
+// whether it was the last one left. Before the download starts it just frees
+// its place.
+func (d *Downloader) Drop() bool {
+	d.c.mu.Lock()
+	defer d.c.mu.Unlock()
+
+	d.attached = false
+	if d.c.startedAt.Load() == 0 {
+		return false
+	}
+	d.drop()
+	return d.c.isLeft()
+}
+
+// Call with mu held.
+func (d *Downloader) drop() {
+	if !d.gone {
+		d.gone = true
+		// Nobody is writing them: it's done, or it's not attached. The last
+		// one was not held, see Delivered.
+		for i, chunk := range d.tail {
+			if i < len(d.tail)-1 {
+				d.c.unhold(int64(len(chunk)))
+			}
+			d.release(chunk)
+		}
+		d.release(d.last)
+		d.tail, d.last = nil, nil
+		close(d.dropped)
+	}
+}
+
+// isLeft reports whether every downloader is done or gone, closing left if
+// so. Call with mu held.
+func (c *Conduit) isLeft() bool {
+	for _, d := range c.downloaders {
+		if !d.gone {
+			return false
+		}
+	}
+	select {
+	case <-c.left:
+	default:
+		close(c.left)
+	}
+	return true
+}
+
+// isDetached reports whether the downloader came and went away. Call with mu
+// held.
+func (d *Downloader) isDetached() bool {
+	return !d.attached && !d.gone && d.detachedAt > 0
+}
+
+// DropDetachedBefore gives up on the downloaders that went away, and are
+// still away, since before cutoffTime; it reports whether none is left.
+func (c *Conduit) DropDetachedBefore(cutoffTime int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := false
+	for _, d := range c.downloaders {
+		if d.isDetached() && d.detachedAt < cutoffTime {
+			d.drop()
+			dropped = true
+		}
+	}
+	return dropped && c.isLeft()
+}
+
+// IsDetached reports whether a downloader came and went away, and may be back.
+func (c *Conduit) IsDetached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.downloaders {
+		if d.isDetached() {
+			return true
+		}
+	}
+	return false
+}
+
+// BeginUpload and EndUpload enclose each request of the uploader, so that it's
+// known to be around while any of them is being handled.
+func (c *Conduit) BeginUpload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploads++
+}
+
+// EndUpload: see BeginUpload.
+func (c *Conduit) EndUpload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.uploads--
+	c.uploaderLeftAt = time.Now().UnixMilli()
+}
+
+// isUploaderAway reports whether the download started and is waiting for
+// chunks, with no request of the uploader being handled. Call with mu held.
+func (c *Conduit) isUploaderAway() bool {
+	return c.startedAt.Load() > 0 && !c.uploaded() && c.uploads == 0
+}
+
+// uploaded reports whether all the chunks are in. Call with mu held.
+func (c *Conduit) uploaded() bool {
+	if c.IsStream() {
+		return c.eof
+	}
+	return c.accepted >= c.Size
+}
+
+// IsUploaderAway reports whether the download is waiting for an uploader that
+// is not sending anything; it's normal for a moment between two chunks.
+func (c *Conduit) IsUploaderAway() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.isUploaderAway()
+}
+
+// UploaderAwayBefore reports whether the uploader went away, and is still
+// away, since before cutoffTime.
+func (c *Conduit) UploaderAwayBefore(cutoffTime int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.isUploaderAway() && c.uploaderLeftAt < cutoffTime
+}
+
+// Progress returns the index in ChunkPlan of the chunk to be uploaded next,
+// and the offset in the payload it starts at: it's where an uploader that
+// reconnects goes on from.
+func (c *Conduit) Progress() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nextChunk, c.accepted
+}
+
+// StartedAt returns when the download started, or the zero time if it
+// didn't yet. A spooled conduit has none: each download starts on its own.
+func (c *Conduit) StartedAt() time.Time {
+	if ms := c.startedAt.Load(); ms > 0 {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
+
+// Buffered returns how many bytes are queued in memory, between the uploader
+// and the downloaders.
+func (c *Conduit) Buffered() int64 {
+	return c.buffered.Load()
+}
+
+// The states a conduit is reported in, e.g. in the metrics.
+const (
+	StateWaiting        = "waiting"         // for the downloaders
+	StateTransferring   = "transferring"    // the download is under way
+	StateDownloaderAway = "downloader_away" // may be back, to resume
+	StateUploaderAway   = "uploader_away"   // may be back, to resume
+	StateSpooling       = "spooling"        // the upload to disk is under way
+	StateStored         = "stored"          // on disk, to be downloaded
+)
+
+// State tells what the conduit is doing, as one of the State* constants.
+func (c *Conduit) State() string {
+	if c.spool != nil {
+		if c.IsStored() {
+			return StateStored
+		}
+		return StateSpooling
+	}
+	switch {
+	case c.startedAt.Load() == 0:
+		return StateWaiting
+	case c.IsDetached():
+		return StateDownloaderAway
+	case c.IsUploaderAway():
+		return StateUploaderAway
+	}
+	return StateTransferring
+}
+
+// ConduitInfo is what can be told of a conduit to an admin: everything but
+// the id, which is the capability to download it, and the secret.
+type ConduitInfo struct {
+	Fingerprint string `json:"conduit"`
+	Filename    string `json:"filename"`
+	IsText      bool   `json:"text"`
+	Size        int64  `json:"size"`
+	E2E         bool   `json:"e2e"`
+	Spooled     bool   `json:"spooled"`
+	Identity    int    `json:"identity"`
+	State       string `json:"state"`
+	// Where it is in its life, and how it got there
+	Phase      Phase        `json:"phase"`
+	History    []Transition `json:"history"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastAccess time.Time    `json:"last_access"`
+	// Chunks in the plan (-1 for a stream, or if it's adaptive), and how many
+	// were received, i.e. claimed and accepted, and how many bytes they are
+	Chunks         int   `json:"chunks"`
+	ChunksReceived int   `json:"chunks_received"`
+	BytesReceived  int64 `json:"bytes_received"`
+	// How fast the upload and the download go, in bytes per second, as
+	// measured; 0 until they are. See ChunkPlan.Adaptive.
+	UploadPace   int64 `json:"upload_pace"`
+	DownloadPace int64 `json:"download_pace"`
+	// Bytes handed to each downloader; nil if spooled
+	Delivered []int64 `json:"delivered"`
+	// Chunks in ChunkQueue, out of how many fit, and bytes queued in all
+	QueueLen int   `json:"queue_len"`
+	QueueCap int   `json:"queue_cap"`
+	Buffered int64 `json:"buffered"`
+}
+
+// Info takes a snapshot of the conduit.
+func (c *Conduit) Info() ConduitInfo {
+	ret := ConduitInfo{
+		Fingerprint: c.Fingerprint,
+		Filename:    c.Filename,
+		IsText:      c.IsText,
+		Size:        c.Size,
+		E2E:         c.E2E,
+		Spooled:     c.spool != nil,
+		Identity:    c.Identity,
+		State:       c.State(),
+		History:     c.History(),
+		CreatedAt:   time.UnixMilli(c.createdAt),
+		LastAccess:  time.UnixMilli(c.lastAccessed.Load()),
+		Chunks:      c.ChunkPlan.Len(),
+		QueueLen:    len(c.ChunkQueue),
+		QueueCap:    cap(c.ChunkQueue),
+		Buffered:    c.Buffered(),
+	}
+
+	ret.Phase = ret.History[len(ret.History)-1].Phase
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret.ChunksReceived, ret.BytesReceived = c.nextChunk, c.accepted
+	ret.UploadPace, ret.DownloadPace = int64(c.upPace.value()), int64(c.downPace.value())
+	if c.spool == nil {
+		for _, d := range c.downloaders {
+			ret.Delivered = append(ret.Delivered, d.delivered)
+		}
+	}
+	return ret
+}
+
+// NextChunk returns the index in ChunkPlan of the chunk to be uploaded next;
+// it's ChunkPlan.Len() once they are all in, or for a stream, the chunks sent.
+func (c *Conduit) NextChunk() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nextChunk
+}
+
+// OfferChunk offers the chunk at index of ChunkPlan. Chunks go in plan order:
+// a chunk that was already accepted is not queued again and returns
+// ErrChunkAlreadyReceived, so that an uploader that didn't get the answer can
+// safely send it again; one that is ahead of the plan, or being uploaded by a
+// concurrent request, returns ErrChunkOutOfOrder. If the plan allows several
+// at once, one that is ahead by less than ChunkPlan.Parallel waits for the
+// ones before, see awaitTurn. A chunk of a file must be as big as the plan
+// says, or it returns ErrChunkIncomplete: only a stream knows where it ends.
+// If Offer fails the chunk is not consumed, and can be retried.
+//
+// If it returns nil, content is taken over: it must come from NewBuffer, and
+// the caller must not touch it anymore; so are the bytes that were reserved
+// for it, see Reserve. If not, the caller still holds them.
+func (c *Conduit) OfferChunk(index int, content []byte) error {
+	c.mu.Lock()
+	switch {
+	case index < c.nextChunk:
+		c.mu.Unlock()
+		return ErrChunkAlreadyReceived
+	case c.eof:
+		c.mu.Unlock()
+		return ErrStreamEnded
+	case index >= c.nextChunk+c.ChunkPlan.parallel() || c.inFlight[index]:
+		c.mu.Unlock()
+		return ErrChunkOutOfOrder
+	case !c.IsStream() && len(content) != c.chunkSizeAt(index):
+		// The chunks after start where the plan says only if it's whole
+		c.mu.Unlock()
+		return ErrChunkIncomplete
+	}
+	c.inFlight[index] = true
+	c.mu.Unlock()
+
+	err := c.awaitTurn(index)
+	if err == nil && c.spool != nil {
+		// Nothing was reserved: it's on disk, not in memory
+		c.touch()
+		if err = c.spool.append(content, c.digest); err == nil {
+			ReleaseBuffer(content)
+		}
+	} else if err == nil {
+		err = c.Offer(content)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inFlight, index)
+	if err == nil {
+		c.nextChunk++
+		close(c.turn)
+		c.turn = make(chan struct{})
+		c.accepted += int64(len(content))
+		now := time.Now()
+		c.upPace.observe(len(content), c.acceptedAt, now)
+		c.acceptedAt = now
+		if c.ChunkPlan.Adaptive {
+			c.nextSize = c.adapt(c.nextSize)
+		}
+	}
+	return err
+}
+
+// EndStream marks the end of a stream, after the chunk before index: the
+// payload is what was sent so far, and the downloaders are done once they got
+// it. Marking it again at the same index is fine, so that an uploader that
+// didn't get the answer can safely send it again.
+func (c *Conduit) EndStream(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case !c.IsStream():
+		return ErrNotAStream
+	case c.eof && index == c.nextChunk:
+		return nil
+	case c.eof:
+		return ErrStreamEnded
+	case index != c.nextChunk || len(c.inFlight) > 0:
+		return ErrChunkOutOfOrder
+	}
+	c.eof = true
+	c.touch()
+	close(c.StreamEnd)
 	return nil
 }
 
-// IsExpired reports whether this conduit was removed due to timeout.
-func (c *Conduit) IsExpired() bool {
-	return c.expired.Load()
+// IsSpooled reports whether the payload goes to disk, so that the uploader
+// doesn't wait for the downloaders.
+func (c *Conduit) IsSpooled() bool {
+	return c.spool != nil
+}
+
+// IsStored reports whether the whole payload is on disk, and the uploader can
+// leave. Only for a spooled conduit.
+func (c *Conduit) IsStored() bool {
+	return c.spool.isStored()
 }
 
-// Expire marks the conduit as expired and closes Done so downloaders and uploaders unblock.
-func (c *Conduit) Expire() {
-	if c.expired.CompareAndSwap(false, true) {
-		close(c.Done)
+// AttachSpool makes the caller a downloader of a spooled conduit. It's
+// admitted as long as there are fewer downloads under way than are owed;
+// since the whole payload stays on disk, it can start from any offset.
+func (c *Conduit) AttachSpool() error {
+	c.spool.mu.Lock()
+	if c.spool.active >= c.spool.remaining {
+		c.spool.mu.Unlock()
+		return ErrConduitAlreadyDownloading
 	}
+	c.spool.active++
+	c.spool.mu.Unlock()
+
+	c.touch()
+	c.stream()
+	return nil
 }
 
-// ClaimNextChunk reserves the next expected chunk and returns its planned size,
-// or -1 once the whole plan has been claimed. Reserving and reading the index
-// is a single atomic step, so two concurrent uploads can never size-check
-// themselves against the same entry of the plan.
-func (c *Conduit) ClaimNextChunk() int {
-	idx := int(c.chunkIndex.Add(1)) - 1
-	if idx >= len(c.ChunkPlan) {
-		return -1
+// Moves the conduit to Streaming, if it's Waiting: for a spooled conduit,
+// when the first download starts.
+func (c *Conduit) stream() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Phase() == PhaseWaiting {
+		c.transition(PhaseStreaming, ReasonDownloadStarted, "the download started")
+	}
+}
+
+// ReadSpool reads the payload at offset off into p. While the uploader is
+// still sending, there may be nothing there yet: then it returns 0 and a
+// channel that is closed when there is.
+func (c *Conduit) ReadSpool(p []byte, off int64) (int, <-chan struct{}, error) {
+	return c.spool.readAt(p, off)
+}
+
+// ReleaseSpool records that a download of a spooled conduit ended at offset
+// end, complete or not, and reports whether it was the last one owed; then
+// the conduit is Completed.
+func (c *Conduit) ReleaseSpool(end int64) bool {
+	c.spool.mu.Lock()
+	c.spool.active--
+	if end >= c.Size {
+		c.spool.remaining--
+	}
+	c.spool.delivered = max(c.spool.delivered, end)
+	last := c.spool.remaining == 0
+	c.spool.mu.Unlock()
+
+	if last {
+		c.End(PhaseCompleted, ReasonDelivered, "delivered")
+	}
+	return last
+}
+
+// SpoolExpiredBefore reports whether a spooled conduit is to be dropped: it's
+// idle since before cutoffTime while the upload is under way, or it's
+// been stored since before ttlCutoffTime and nobody is downloading it.
+func (c *Conduit) SpoolExpiredBefore(cutoffTime, ttlCutoffTime int64) bool {
+	c.spool.mu.Lock()
+	defer c.spool.mu.Unlock()
+
+	if c.spool.storedAt == 0 {
+		return !c.WasAccessedAfter(cutoffTime)
 	}
-	return c.ChunkPlan[idx]
+	return c.spool.active == 0 && c.spool.storedAt < ttlCutoffTime
 }
 
-// Offer offers a chunk of content to the Conduit (upload)
+// Offer offers a chunk of content to the Conduit (upload), waiting for room in
+// the queue. Its bytes were reserved in the budget of the set, if it has one
+// (see Reserve); queued, they stay held.
 func (c *Conduit) Offer(content []byte) error {
 	c.touch()
-	select {
-	case c.ChunkQueue <- content:
-		return nil
-	case <-c.Done:
-		return ErrConduitExpired
-	case <-time.After(30 * time.Second):
-		return ErrUploadTimeout
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case c.ChunkQueue <- content:
+			c.buffered.Add(int64(len(content)))
+			return nil
+		case <-c.Done:
+			return ErrConduitOver
+		case <-timer.C:
+			// Nobody reads because the downloader dropped: it may be back within
+			// the grace window, and if it isn't the conduit expires, closing Done.
+			if !c.IsDetached() {
+				return ErrUploadTimeout
+			}
+			timer.Reset(30 * time.Second)
+		}
 	}
 }
 
 var (
 	ErrConduitAlreadyDownloading = fmt.Errorf("conduit Already Downloading or Downloaded")
 	ErrUploadTimeout             = fmt.Errorf("upload timed out. Conduit seems stuck")
-	ErrConduitExpired            = fmt.Errorf("conduit expired while upload was in progress")
+	ErrConduitOver               = fmt.Errorf("the transfer is over; see Outcome")
+	ErrRangeNotSatisfiable       = fmt.Errorf("resume point no longer available")
+	ErrChunkAlreadyReceived      = fmt.Errorf("chunk already received")
+	ErrChunkOutOfOrder           = fmt.Errorf("chunk out of order, or already being uploaded")
+	ErrSpoolDisabled             = fmt.Errorf("spooling is not enabled")
+	ErrSpoolFull                 = fmt.Errorf("not enough spool space")
+	ErrSpoolFailed               = fmt.Errorf("error writing the spool")
+	ErrDigestMismatch            = fmt.Errorf("the payload doesn't match the declared digest")
+	ErrPipeBusy                  = fmt.Errorf("there's already a transfer on this pipe")
+	ErrNotAStream                = fmt.Errorf("the size of the transfer is known, it has no end to mark")
+	ErrStreamEnded               = fmt.Errorf("the stream already ended")
+	ErrTooManyConduits           = fmt.Errorf("too many transfers under way")
+	ErrMemoryFull                = fmt.Errorf("the memory for the transfers is all in use")
+	ErrPlanAdaptive              = fmt.Errorf("the chunk plan is adaptive, the uploader must know version 3 of it")
+	ErrChunkIncomplete           = fmt.Errorf("the chunk is not as big as the plan says")
+	ErrTurnTimeout               = fmt.Errorf("the chunks before this one didn't come in time")
 )
@@ -14,70 +14,339 @@
 package fileway
 
 import (
-	"fmt"
+	"log/slog"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ConduitSet struct {
 	conduits     map[string]*Conduit
 	expiryMillis int64
-	mu           sync.RWMutex
+	graceMillis  int64
+	// How long a started transfer waits for an uploader that went away
+	uploaderGraceMillis int64
+	// How long a transfer for several downloaders waits for all of them
+	fanOutWait time.Duration
+	mu         sync.RWMutex
+
+	// Where spooled payloads go, if enabled; see EnableSpool. Guarded by mu.
+	spoolDir       string
+	spoolQuota     int64
+	spoolUsed      int64
+	spoolTTLMillis int64
+
+	// What's left of the conduits forgotten lately, so that whoever asks
+	// about them can be told how they ended, rather than that they don't
+	// exist: at most maxTombstones, for tombstoneTTLMillis, oldest first in
+	// tombstoneIds. See KeepTombstones. Guarded by mu.
+	tombstones         map[string]*tombstone
+	tombstoneIds       []string
+	maxTombstones      int
+	tombstoneTTLMillis int64
+
+	// The conduits that are also known by a name, as named pipes, and who
+	// waits for one to come by a name; see pipe.go. Guarded by mu.
+	pipes       map[string]string
+	pipeWaiters map[string]*pipeWait
+
+	// How many conduits there can be at once, 0 for no limit, and the memory
+	// they can buffer; see Limit. Guarded by mu.
+	maxConduits int
+	budget      *budget
+
+	// How many conduits were created, and how many were garbage collected
+	created atomic.Int64
+	expired atomic.Int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// What's kept of a conduit once it's forgotten. The conduit itself is let go
+// as soon as it's over, keeping only its Result, so that what it holds, e.g.
+// its buffer, goes too.
+type tombstone struct {
+	conduit *Conduit
+	secret  string
+	result  Result
+	at      int64 // unix millis, when it was forgotten
+}
+
+// ConduitStats is a snapshot of a ConduitSet, for the metrics.
+type ConduitStats struct {
+	ByState  map[string]int // the conduits there are, by State
+	Buffered int64          // bytes queued in memory, by all the conduits
+	Created  int64          // conduits created, since the start
+	Expired  int64          // conduits garbage collected, since the start
 }
 
+// NewConduitSet creates the set. A downloader that drops can resume within
+// resumeGraceSeconds; 0 disables resuming. An uploader that drops can
+// reconnect within uploaderGraceSeconds, while the downloader waits. A
+// transfer for several downloaders starts when they are all there, or
+// fanOutWaitSeconds after the first one came.
 func NewConduitSet(
 	expirySeconds int,
+	resumeGraceSeconds int,
+	uploaderGraceSeconds int,
+	fanOutWaitSeconds int,
 ) *ConduitSet {
 	// Create a new ConduitSet instance
 	ret := &ConduitSet{
-		conduits:     make(map[string]*Conduit),
-		expiryMillis: int64(expirySeconds) * 1000,
+		conduits:            make(map[string]*Conduit),
+		tombstones:          make(map[string]*tombstone),
+		pipes:               make(map[string]string),
+		pipeWaiters:         make(map[string]*pipeWait),
+		maxTombstones:       defaultMaxTombstones,
+		tombstoneTTLMillis:  int64(expirySeconds) * 1000,
+		expiryMillis:        int64(expirySeconds) * 1000,
+		graceMillis:         int64(resumeGraceSeconds) * 1000,
+		uploaderGraceMillis: int64(uploaderGraceSeconds) * 1000,
+		fanOutWait:          time.Duration(fanOutWaitSeconds) * time.Second,
+		budget:              newBudget(),
+		stop:                make(chan struct{}),
 	}
 
 	// Setup periodic cleanup
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
-		for range ticker.C {
-			ret.cleanupStaleConduits()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ret.cleanupStaleConduits()
+			case <-ret.stop:
+				return
+			}
 		}
 	}()
 
 	return ret
 }
 
+// Close stops the periodic cleanup. Safe to call more than once.
+func (cs *ConduitSet) Close() {
+	cs.stopOnce.Do(func() { close(cs.stop) })
+}
+
+// How many tombstones are kept, unless told otherwise; see KeepTombstones.
+const defaultMaxTombstones = 10000
+
 func (cs *ConduitSet) cleanupStaleConduits() {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
-	cutoffTime := time.Now().UnixMilli() - cs.expiryMillis
+	now := time.Now().UnixMilli()
+	cutoffTime := now - cs.expiryMillis
+	graceCutoffTime := now - cs.graceMillis
+	uploaderCutoffTime := now - cs.uploaderGraceMillis
+	spoolCutoffTime := now - cs.spoolTTLMillis
 	i := 0
 	for id, conduit := range cs.conduits {
-		if !conduit.WasAccessedAfter(cutoffTime) {
+		// A conduit whose downloader, or uploader, dropped is judged by the
+		// grace window alone: nothing touches it while it waits for it to
+		// come back. Of several downloaders, the ones that don't come back are
+		// given up on, and the others go on.
+		var stale bool
+		var reason, detail string
+		switch {
+		case conduit.IsSpooled():
+			stale = conduit.SpoolExpiredBefore(cutoffTime, spoolCutoffTime)
+			if conduit.IsStored() {
+				reason, detail = ReasonNotDownloaded, "stored, and not downloaded in time"
+			} else {
+				reason, detail = ReasonUploaderStalled, "the uploader stalled"
+			}
+		case conduit.IsDetached():
+			stale = conduit.DropDetachedBefore(graceCutoffTime)
+			reason, detail = ReasonDownloaderGone, "the downloader went away, and didn't come back"
+		case conduit.IsUploaderAway():
+			stale = conduit.UploaderAwayBefore(uploaderCutoffTime)
+			_, accepted := conduit.Progress()
+			reason, detail = ReasonUploaderStalled, "the uploader stalled at "+conduit.Percent(accepted)
+		case conduit.StartedAt().IsZero():
+			stale = !conduit.WasAccessedAfter(cutoffTime)
+			reason, detail = ReasonNoDownloader, "expired waiting for the downloader"
+		default:
+			stale = !conduit.WasAccessedAfter(cutoffTime)
+			reason, detail = ReasonIdle, "the transfer stalled"
+		}
+		if stale {
 			i++
-			delete(cs.conduits, id)
+			slog.Info("Transfer expired", append(conduit.LogAttrs(),
+				slog.String("event", "conduit_expired"),
+				slog.String("state", conduit.State()),
+				slog.String("reason", reason),
+			)...)
+			cs.forget(id, conduit)
 			// Closes Done, which is what unblocks a waiting ping and a waiting
 			// upload, and is what makes them answer 410 rather than proceed.
-			conduit.Expire()
+			conduit.End(PhaseExpired, reason, detail)
 		}
 	}
-	if i > 0 {
-		fmt.Printf("%d sessions were garbage collected\n", i)
+	cs.expired.Add(int64(i))
+
+	for _, t := range cs.tombstones {
+		if t.conduit != nil && t.conduit.IsOver() {
+			t.result = t.conduit.Result()
+			t.conduit = nil
+		}
+	}
+	cs.pruneTombstones(now - cs.tombstoneTTLMillis)
+}
+
+// Removes the tombstones older than cutoffTime, and the oldest ones past
+// maxTombstones. Call with mu held.
+func (cs *ConduitSet) pruneTombstones(cutoffTime int64) {
+	for len(cs.tombstoneIds) > 0 {
+		id := cs.tombstoneIds[0]
+		if t := cs.tombstones[id]; t != nil && t.at >= cutoffTime && len(cs.tombstoneIds) <= cs.maxTombstones {
+			return
+		}
+		delete(cs.tombstones, id)
+		cs.tombstoneIds = cs.tombstoneIds[1:]
+	}
+}
+
+// KeepTombstones sets for how long, and how many at most, the conduits that
+// are over are remembered; see Tombstone. By default, for the expiry window,
+// and defaultMaxTombstones.
+func (cs *ConduitSet) KeepTombstones(ttlSeconds, max int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.tombstoneTTLMillis = int64(ttlSeconds) * 1000
+	cs.maxTombstones = max
+	cs.pruneTombstones(time.Now().UnixMilli() - cs.tombstoneTTLMillis)
+}
+
+// Limit caps the conduits there can be at once at maxConduits, and the bytes
+// that they can buffer in memory, all together, at budgetBytes; 0 is no limit.
+// Past either, a new conduit is refused, with ErrTooManyConduits or
+// ErrMemoryFull; a chunk offered past the budget waits for some to be given
+// back, as it waits for a place in the queue.
+func (cs *ConduitSet) Limit(maxConduits int, budgetBytes int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.maxConduits = maxConduits
+	cs.budget.mu.Lock()
+	defer cs.budget.mu.Unlock()
+	cs.budget.max = budgetBytes
+}
+
+// Reports why a new conduit can't be created, if it can't; a spooled one
+// takes no memory to speak of. Call with mu held.
+func (cs *ConduitSet) admit(spooled bool) error {
+	switch {
+	case cs.maxConduits > 0 && len(cs.conduits) >= cs.maxConduits:
+		return ErrTooManyConduits
+	case !spooled && cs.budget.exhausted():
+		return ErrMemoryFull
+	}
+	return nil
+}
+
+// EnableSpool lets conduits be created with NewSpooledConduit, that keep the
+// payload in dir, up to quotaBytes in total, for ttlSeconds after it's all
+// uploaded. The spool files in dir that a previous run left are deleted.
+func (cs *ConduitSet) EnableSpool(dir string, quotaBytes int64, ttlSeconds int) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	removed, err := removeSpoolFiles(dir)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		slog.Info("Removed the spool files of a previous run", "event", "spool_cleanup", "count", removed)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.spoolDir = dir
+	cs.spoolQuota = quotaBytes
+	cs.spoolTTLMillis = int64(ttlSeconds) * 1000
+	return nil
+}
+
+// SpoolEnabled reports whether EnableSpool was called.
+func (cs *ConduitSet) SpoolEnabled() bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return cs.spoolDir != ""
+}
+
+// NewSpooledConduit is NewConduit for a conduit whose payload goes to disk.
+// The declared size is reserved in the spool quota up front, and the conduit
+// is refused with ErrSpoolFull if it doesn't fit.
+func (cs *ConduitSet) NewSpooledConduit(isText, e2e bool,
+	filename string,
+	size int64,
+	secret string,
+	chunkSize, idsLength, downloads int,
+	opts ...ConduitOption) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.spoolDir == "" {
+		return "", ErrSpoolDisabled
+	}
+	if err := cs.admit(true); err != nil {
+		return "", err
+	}
+	conduit := newConduit(isText, e2e, filename, size, secret, chunkSize, 1, idsLength, 1, opts...)
+	if cs.spoolUsed+conduit.Size > cs.spoolQuota {
+		return "", ErrSpoolFull
+	}
+
+	spool, err := newSpool(cs.spoolDir, conduit.Size, downloads)
+	if err != nil {
+		return "", err
 	}
+	conduit.spool = spool
+	cs.spoolUsed += conduit.Size
+	cs.conduits[conduit.Id] = conduit
+	cs.created.Add(1)
+
+	return conduit.Id, nil
 }
 
-func (cs *ConduitSet) NewConduit(isText bool,
+// NewConduit creates a conduit for a payload of size bytes. If e2e, it's end
+// to end encrypted, and what goes through is a bit bigger; see SealedSize. It
+// fails if there are too many conduits, or they use all the memory they can;
+// see Limit. The options set it up before it's in the set, where the others
+// can see it: once it's there, it's only changed under its mu.
+func (cs *ConduitSet) NewConduit(isText, e2e bool,
 	filename string,
 	size int64,
 	secret string,
-	chunkSize, bufferQueueSize, idsLength int) string {
+	chunkSize, bufferQueueSize, idsLength, downloads int,
+	opts ...ConduitOption) (string, error) {
 	// Create a new Conduit instance
-	conduit := newConduit(isText, filename, size, secret, chunkSize, bufferQueueSize, idsLength)
+	conduit := newConduit(isText, e2e, filename, size, secret, chunkSize, bufferQueueSize, idsLength, downloads, opts...)
+	conduit.fanOutWait = cs.fanOutWait
+	// Retains as many delivered chunks as are buffered ahead, which is about
+	// what can be lost in flight when the connection drops.
+	if cs.graceMillis > 0 {
+		conduit.tailMax = bufferQueueSize
+	}
+	conduit.budget = cs.budget
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if err := cs.admit(false); err != nil {
+		return "", err
+	}
 	cs.conduits[conduit.Id] = conduit
+	cs.created.Add(1)
 
-	return conduit.Id
+	return conduit.Id, nil
 }
 
 func (cs *ConduitSet) GetConduit(conduitId string) *Conduit {
@@ -87,9 +356,122 @@ func (cs *ConduitSet) GetConduit(conduitId string) *Conduit {
 	return cs.conduits[conduitId]
 }
 
+// Returns the conduits there are, to look into them without holding mu.
+func (cs *ConduitSet) all() []*Conduit {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	ret := make([]*Conduit, 0, len(cs.conduits))
+	for _, conduit := range cs.conduits {
+		ret = append(ret, conduit)
+	}
+	return ret
+}
+
+// Stats takes a snapshot of the conduits there are, and of the counters.
+func (cs *ConduitSet) Stats() ConduitStats {
+	conduits := cs.all()
+	ret := ConduitStats{
+		ByState: make(map[string]int),
+		Created: cs.created.Load(),
+		Expired: cs.expired.Load(),
+	}
+	for _, conduit := range conduits {
+		ret.ByState[conduit.State()]++
+		ret.Buffered += conduit.Buffered()
+	}
+	return ret
+}
+
+// List takes a snapshot of all the conduits, oldest first.
+func (cs *ConduitSet) List() []ConduitInfo {
+	conduits := cs.all()
+	ret := make([]ConduitInfo, 0, len(conduits))
+	for _, conduit := range conduits {
+		ret = append(ret, conduit.Info())
+	}
+	slices.SortFunc(ret, func(a, b ConduitInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return ret
+}
+
+// GetConduitByFingerprint is GetConduit, for who only knows the fingerprint,
+// e.g. from the logs.
+func (cs *ConduitSet) GetConduitByFingerprint(fingerprint string) *Conduit {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	for _, conduit := range cs.conduits {
+		if conduit.Fingerprint == fingerprint {
+			return conduit
+		}
+	}
+	return nil
+}
+
+// ResumeEnabled reports whether a downloader that drops can come back.
+func (cs *ConduitSet) ResumeEnabled() bool {
+	return cs.graceMillis > 0
+}
+
 func (cs *ConduitSet) DelConduit(conduitId string) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
+	if conduit := cs.conduits[conduitId]; conduit != nil {
+		cs.forget(conduitId, conduit)
+	}
+}
+
+// Ended looks for a conduit that was forgotten lately, whose secret is
+// candidate. While it's not let go it returns it, to wait for it to be over,
+// and otherwise how it ended; ok is false if there is none.
+func (cs *ConduitSet) Ended(conduitId, candidate string) (conduit *Conduit, result Result, ok bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	t := cs.tombstones[conduitId]
+	if t == nil || t.secret != candidate {
+		return nil, Result{}, false
+	}
+	return t.conduit, t.result, true
+}
+
+// Tombstone tells how the conduit with that id ended, if it was forgotten
+// lately, and it's over; ok is false if not. It's for anyone with the id, as
+// the conduit itself was: see Ended for what only the uploader is told.
+func (cs *ConduitSet) Tombstone(conduitId string) (result Result, ok bool) {
+	cs.mu.RLock()
+	t := cs.tombstones[conduitId]
+	cs.mu.RUnlock()
+
+	switch {
+	case t == nil:
+		return Result{}, false
+	case t.conduit != nil:
+		// Being wound down; it's let go at the next cleanup
+		result = t.conduit.Result()
+	default:
+		result = t.result
+	}
+	return result, result.Final
+}
+
+// Removes a conduit, and its spool if any; a tombstone is left in its place.
+// Call with mu held.
+func (cs *ConduitSet) forget(conduitId string, conduit *Conduit) {
 	delete(cs.conduits, conduitId)
+	if conduit.pipe != "" && cs.pipes[conduit.pipe] == conduitId {
+		delete(cs.pipes, conduit.pipe)
+	}
+	if _, ok := cs.tombstones[conduitId]; !ok {
+		cs.tombstoneIds = append(cs.tombstoneIds, conduitId)
+	}
+	cs.tombstones[conduitId] = &tombstone{conduit: conduit, secret: conduit.secret, at: time.Now().UnixMilli()}
+	cs.pruneTombstones(0)
+	if conduit.spool != nil {
+		conduit.spool.remove()
+		cs.spoolUsed -= conduit.spool.size
+	}
 }
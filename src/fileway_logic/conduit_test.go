@@ -14,46 +14,178 @@
 package fileway
 
 import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
-func TestBuildChunkPlan(t *testing.T) {
-	cases := []struct {
+// The plan is described, and the chunks computed from it: they must be the
+// ones of the list that was built before, ramping up from 4k.
+func TestChunkPlan(t *testing.T) {
+	listed := func(size int64, chunkSize int) []int {
+		if size < chunkSizeInitial {
+			return []int{int(size)}
+		}
+		sum, last, ret := int64(chunkSizeInitial), chunkSizeInitial, []int{chunkSizeInitial}
+		for sum < size {
+			last = min(last*chunkSizeRampFactor, chunkSize, int(size-sum))
+			ret = append(ret, last)
+			sum += int64(last)
+		}
+		return ret
+	}
+	for _, c := range []struct {
 		size      int64
 		chunkSize int
 	}{
+		{1, 4096},
 		{4095, 4096},
 		{4096, 4096},
 		{4097, 4096},
 		{12288, 4096},
-		{1, 4096},
-	}
-	for _, c := range cases {
-		plan := buildChunkPlan(c.size, c.chunkSize)
-		// no zero chunks
-		for i, ch := range plan {
-			if ch == 0 {
-				t.Errorf("size=%d chunkSize=%d: chunk[%d] is zero", c.size, c.chunkSize, i)
+		{12289, 16384},
+		{1 << 20, 4 << 20},
+		{100<<20 + 5, 4 << 20},
+		{100 << 20, 5 << 20},
+	} {
+		plan := newChunkPlan(c.size, c.chunkSize)
+		want := listed(c.size, c.chunkSize)
+		if got := plan.List(); !reflect.DeepEqual(got, want) {
+			t.Errorf("size=%d chunkSize=%d: got %v, want %v", c.size, c.chunkSize, got, want)
+			continue
+		}
+		off := int64(0)
+		for i, n := range want {
+			if plan.OffsetAt(i) != off || plan.SizeAt(i) != n {
+				t.Errorf("size=%d chunkSize=%d: chunk %d at %d of %d, want at %d of %d",
+					c.size, c.chunkSize, i, plan.OffsetAt(i), plan.SizeAt(i), off, n)
 			}
+			off += int64(n)
+		}
+		if n := plan.Len(); plan.SizeAt(n) != 0 || plan.OffsetAt(n) != c.size {
+			t.Errorf("size=%d chunkSize=%d: past the end, %d at %d", c.size, c.chunkSize, plan.SizeAt(n), plan.OffsetAt(n))
+		}
+	}
+
+	// The biggest there can be, without listing it
+	plan := newChunkPlan(4<<40, 4<<20)
+	last := plan.Len() - 1
+	if last != 1<<20+9 || plan.OffsetAt(last)+int64(plan.SizeAt(last)) != 4<<40 {
+		t.Errorf("4 TiB: %d chunks, the last %d at %d", last+1, plan.SizeAt(last), plan.OffsetAt(last))
+	}
+
+	stream := newChunkPlan(-1, 16384)
+	if got, want := stream.List(), []int{4096, 8192, 16384}; !reflect.DeepEqual(got, want) || stream.Len() != -1 {
+		t.Errorf("stream: %v, %d chunks", got, stream.Len())
+	}
+	if stream.SizeAt(10) != 16384 || stream.OffsetAt(10) != 4096+8192+8*16384 {
+		t.Errorf("stream: chunk 10 at %d of %d", stream.OffsetAt(10), stream.SizeAt(10))
+	}
+}
+
+// End-to-end encrypted, the plan is about the sealed payload, a tag per
+// record bigger.
+func TestE2EChunkPlan(t *testing.T) {
+	for _, size := range []int64{1, E2ERecordSize - 1, E2ERecordSize, E2ERecordSize + 1, 1000000} {
+		c := newConduit(false, true, "f.bin", size, "s", 4096*1024, 4, 8, 1)
+		records := (size + E2ERecordSize - 1) / E2ERecordSize
+		if c.Size != size+records*E2ETagSize || c.PayloadSize() != size {
+			t.Errorf("size=%d: got %d sealed, %d opened", size, c.Size, c.PayloadSize())
 		}
-		// sum equals size
 		sum := int64(0)
-		for _, ch := range plan {
+		for _, ch := range c.ChunkPlan.List() {
 			sum += int64(ch)
 		}
-		if sum != c.size {
-			t.Errorf("size=%d chunkSize=%d: plan sum=%d", c.size, c.chunkSize, sum)
+		if sum != c.Size {
+			t.Errorf("size=%d: plan sum=%d, want %d", size, sum, c.Size)
 		}
 	}
 }
 
+// An adaptive plan ramps up as a fixed one while the transfer keeps up, and
+// follows its pace once it doesn't, within the bounds; only the next chunk
+// is known.
+func TestAdapt(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	id, _ := cs.NewConduit(false, false, "f.bin", 20000, "s", 4096, 4, 16, 1, WithAdaptivePlan(64<<10, 8<<20))
+	c := cs.GetConduit(id)
+	if p := c.ChunkPlan; !p.Adaptive || p.Version != ChunkPlanVersion || p.Len() != -1 || p.List() != nil {
+		t.Errorf("plan %+v", p)
+	}
+
+	c.mu.Lock()
+	for _, tc := range []struct {
+		up, down   float64 // bytes per second
+		prev, want int
+	}{
+		{0, 0, 4096, 8192},                       // not measured yet
+		{0, 0, 8 << 20, 8 << 20},                 // up to Max
+		{100 << 20, 0, 1 << 20, 2 << 20},         // fast: it ramps up
+		{300 << 10, 0, 1 << 20, 1 << 20},         // a bit slow: it stays
+		{100 << 10, 0, 1 << 20, 200 << 10},       // slow: what takes chunkTarget
+		{100 << 20, 10 << 10, 1 << 20, 64 << 10}, // the downloader is slower, but not below Min
+	} {
+		c.upPace, c.downPace = pace{tc.up, 1}, pace{tc.down, 1}
+		if got := c.adapt(tc.prev); got != tc.want {
+			t.Errorf("%+v: %d", tc, got)
+		}
+	}
+	c.upPace, c.downPace = pace{}, pace{}
+	c.buffered.Store(3 * 4096)
+	if got := c.adapt(4096); got != 4096 {
+		t.Errorf("with chunks waiting for the downloader: %d", got)
+	}
+	c.buffered.Store(0)
+	c.mu.Unlock()
+
+	var p pace
+	start := time.Now()
+	for range 10 {
+		p.observe(1<<20, start, start.Add(time.Millisecond))
+	}
+	p.observe(4<<20, start, start.Add(4*time.Second))
+	if v := p.value(); v > 2<<20 {
+		t.Errorf("a slow chunk after quick ones: %.0f bytes/s", v)
+	}
+
+	// Measured right away, the pace is high: it ramps up, to the end
+	for index, want := range []int{4096, 8192, 20000 - 4096 - 8192, 0} {
+		if n := c.ChunkSizeAt(index); n != want {
+			t.Fatalf("chunk %d is %d, want %d", index, n, want)
+		}
+		if n := c.ChunkSizeAt(index + 1); index < 3 && n != 8<<20 {
+			t.Errorf("past the next chunk %d: %d", index, n)
+		}
+		if off := c.ChunkOffsetAt(index); off != c.accepted {
+			t.Errorf("chunk %d at %d", index, off)
+		}
+		if want > 0 {
+			if err := c.OfferChunk(index, make([]byte, want)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if c.ChunkOffsetAt(1) != -1 || !c.uploaded() {
+		t.Error("an offset that is not known anymore, or the upload is not over")
+	}
+
+	textId, _ := cs.NewConduit(true, false, "t.txt", 10, "s", 4096, 1, 16, 1, WithAdaptivePlan(64<<10, 8<<20))
+	text := cs.GetConduit(textId)
+	if text.ChunkPlan.Adaptive || text.ChunkSizeAt(0) != 10 {
+		t.Error("a text is in a chunk")
+	}
+}
+
 func TestDownloadRace(t *testing.T) {
 	const rounds = 20000
 	const goroutines = 4
 
 	for round := 0; round < rounds; round++ {
-		c := newConduit(false, "f.bin", 4096, "s", 4096, 4, 16)
+		c := newConduit(false, false, "f.bin", 4096, "s", 4096, 4, 16, 1)
 
 		var wg sync.WaitGroup
 		admitted := 0
@@ -63,7 +195,7 @@ func TestDownloadRace(t *testing.T) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if c.Download() == nil {
+				if _, err := c.Download(); err == nil {
 					mu.Lock()
 					admitted++
 					mu.Unlock()
@@ -78,34 +210,718 @@ func TestDownloadRace(t *testing.T) {
 	}
 }
 
-// Two concurrent uploads must never be handed the same entry of the plan:
-// the second would be size-checked against the first chunk's budget.
-func TestClaimNextChunkIsAtomic(t *testing.T) {
+// Two concurrent uploads of the same chunk (a retry racing the original) must
+// never both get queued: the downloader would get the bytes twice.
+func TestOfferChunkIsAtomic(t *testing.T) {
 	const rounds = 5000
 	for round := 0; round < rounds; round++ {
-		// A large chunkSize keeps the ramp going, so the first claims return
-		// distinct sizes (4096, 8192, 16384, 32768) and a double claim shows up.
-		c := newConduit(false, "f.bin", 1000000, "s", 4096*1024, 4, 8)
+		c := newConduit(false, false, "f.bin", 4, "s", 4096*1024, 4, 8, 1)
 
 		var wg sync.WaitGroup
 		var mu sync.Mutex
-		seen := map[int]int{}
+		accepted := 0
 		for i := 0; i < 4; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				got := c.ClaimNextChunk()
-				mu.Lock()
-				seen[got]++
-				mu.Unlock()
+				err := c.OfferChunk(0, []byte("aaaa"))
+				if err != nil && err != ErrChunkAlreadyReceived && err != ErrChunkOutOfOrder {
+					t.Errorf("round %d: unexpected error %v", round, err)
+				}
+				if err == nil {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
 			}()
 		}
 		wg.Wait()
 
-		for size, n := range seen {
-			if n != 1 {
-				t.Fatalf("round %d: chunk size %d claimed %d times", round, size, n)
-			}
+		if accepted != 1 || len(c.ChunkQueue) != 1 || c.NextChunk() != 1 {
+			t.Fatalf("round %d: %d accepted, %d queued, next is %d", round, accepted, len(c.ChunkQueue), c.NextChunk())
+		}
+	}
+}
+
+// Chunks go in plan order; a retry of an accepted one is acknowledged but not
+// queued, and one that failed can be sent again.
+func TestOfferChunkOrder(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 12288, "s", 4096, 1, 8, 1)
+	a, b := bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 4096)
+
+	if err := c.OfferChunk(1, b); err != ErrChunkOutOfOrder {
+		t.Fatalf("chunk ahead of the plan: got %v", err)
+	}
+	if err := c.OfferChunk(0, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OfferChunk(0, a); err != ErrChunkAlreadyReceived {
+		t.Fatalf("retried chunk: got %v", err)
+	}
+
+	// The queue is full, so this one fails; nothing is consumed.
+	c.End(PhaseExpired, ReasonIdle, "")
+	if err := c.OfferChunk(1, b); err != ErrConduitOver {
+		t.Fatalf("chunk on a full queue of an expired conduit: got %v", err)
+	}
+	if c.NextChunk() != 1 || len(c.ChunkQueue) != 1 {
+		t.Errorf("next is %d with %d queued, want 1 and 1", c.NextChunk(), len(c.ChunkQueue))
+	}
+}
+
+// With a plan for several chunks at once, those ahead wait for the ones
+// before, and go in the queue in plan order; as many as the plan says, and
+// each one only once.
+func TestOfferChunkParallel(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 20000, "s", 4096, 8, 8, 1, WithParallelChunks(3))
+	chunk := func(index int) []byte {
+		return bytes.Repeat([]byte{byte('a' + index)}, c.ChunkPlan.SizeAt(index))
+	}
+
+	errs := make(chan error, 2)
+	for _, index := range []int{2, 1} {
+		go func() { errs <- c.OfferChunk(index, chunk(index)) }()
+	}
+	for waiting := 0; waiting < 2; {
+		time.Sleep(time.Millisecond)
+		c.mu.Lock()
+		waiting = len(c.inFlight)
+		c.mu.Unlock()
+	}
+	if err := c.OfferChunk(3, chunk(3)); err != ErrChunkOutOfOrder {
+		t.Errorf("chunk past the window: got %v", err)
+	}
+	if err := c.OfferChunk(1, chunk(1)); err != ErrChunkOutOfOrder {
+		t.Errorf("chunk being uploaded: got %v", err)
+	}
+	if err := c.OfferChunk(0, []byte("aaaa")); err != ErrChunkIncomplete {
+		t.Errorf("chunk shorter than the plan: got %v", err)
+	}
+	if err := c.OfferChunk(0, chunk(0)); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.NextChunk() != 3 || len(c.ChunkQueue) != 3 {
+		t.Fatalf("next is %d with %d queued, want 3 and 3", c.NextChunk(), len(c.ChunkQueue))
+	}
+	for index := range 3 {
+		if got := <-c.ChunkQueue; !bytes.Equal(got, chunk(index)) {
+			t.Errorf("chunk %d is %q...", index, got[:1])
 		}
 	}
+
+	// One that waits for its turn gives up when the conduit is over
+	go func() { errs <- c.OfferChunk(4, chunk(4)) }()
+	time.Sleep(10 * time.Millisecond)
+	c.End(PhaseCancelled, ReasonCancelledByUploader, "")
+	if err := <-errs; err != ErrConduitOver {
+		t.Errorf("waiting on a conduit that is over: got %v", err)
+	}
+
+	stream := newConduit(false, false, "s.bin", -1, "s", 4096, 8, 8, 1, WithParallelChunks(3))
+	if stream.ChunkPlan.Parallel != 0 {
+		t.Error("a stream is uploaded a chunk at a time")
+	}
+}
+
+// A downloader that comes back gets again what it may have lost in flight,
+// starting exactly at the offset it asks for; what fell out of the tail can't
+// be resumed from.
+func TestAttachReplaysTail(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 12, "s", 4096, 2, 16, 1)
+	c.tailMax = 2
+
+	d, _, err := c.Attach(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{"aaaa", "bbbb", "cccc"} {
+		d.Delivered([]byte(chunk))
+	}
+	if _, _, err := c.Attach(0); err != ErrConduitAlreadyDownloading {
+		t.Fatalf("second Attach while attached: got %v", err)
+	}
+	d.Detach()
+
+	if _, _, err := c.Attach(2); err != ErrRangeNotSatisfiable {
+		t.Fatalf("Attach before the tail: got %v", err)
+	}
+	if _, _, err := c.Attach(13); err != ErrRangeNotSatisfiable {
+		t.Fatalf("Attach past what was delivered: got %v", err)
+	}
+
+	_, replay, err := c.Attach(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for _, chunk := range replay {
+		got += string(chunk)
+	}
+	if got != "bbcccc" {
+		t.Errorf("replay from 6: got %q, want %q", got, "bbcccc")
+	}
+}
+
+// The buffers of the chunks come in power-of-two sizes, so that any chunk of
+// the plan fits the one before it was given back; those of other sizes aren't
+// pooled.
+func TestBuffers(t *testing.T) {
+	for _, c := range []struct{ n, cap int }{
+		{1, 4096},
+		{4096, 4096},
+		{4097, 8192},
+		{4 << 20, 4 << 20},
+		{5 << 20, 8 << 20},
+	} {
+		b := NewBuffer(c.n)
+		if len(b) != c.n || cap(b) != c.cap {
+			t.Errorf("NewBuffer(%d): len %d, cap %d; want cap %d", c.n, len(b), cap(b), c.cap)
+		}
+		ReleaseBuffer(b[:1])
+	}
+	if got := bufferClass(3000); got != bufferClassMin {
+		t.Errorf("class of 3000: got %d", got)
+	}
+	if got := bufferClass(6000); got != 13 {
+		t.Errorf("class of 6000: got %d", got)
+	}
+	if got := bufferClass(1<<bufferClassMax + 1); got != -1 {
+		t.Errorf("class past the max: got %d", got)
+	}
+	// Not from NewBuffer: ignored
+	ReleaseBuffer(make([]byte, 5000))
+	ReleaseBuffer(nil)
+}
+
+// Past the budget, a chunk waits for the downloaders to take some, and no
+// new conduit is admitted; nor past the conduits there can be at once.
+func TestLimit(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	defer cs.Close()
+	cs.Limit(2, 8192)
+
+	id, _ := cs.NewConduit(false, false, "f.bin", 20480, "s", 4096, 4, 8, 1)
+	c := cs.GetConduit(id)
+	d, err := c.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := func(index int) {
+		if err := c.Reserve(index, 4096); err != nil {
+			t.Fatalf("reserving chunk %d: %v", index, err)
+		}
+		if err := c.OfferChunk(index, NewBuffer(4096)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer(0)
+	offer(1)
+	if _, err := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 1); err != ErrMemoryFull {
+		t.Errorf("past the budget: got %v", err)
+	}
+	// One ahead of the next doesn't wait in memory; a retry of one that is in
+	// is read anyway
+	if err := c.Reserve(3, 4096); err != ErrMemoryFull {
+		t.Errorf("ahead, past the budget: got %v", err)
+	}
+	if err := c.Reserve(1, 4096); err != nil || c.held.Load() != 12288 {
+		t.Errorf("retry past the budget: %v, held %d", err, c.held.Load())
+	}
+	c.Unreserve(4096)
+
+	// The chunk being written is not held; once written, it's held as long
+	// as it's kept to resume from
+	d.Delivered(<-d.Chunks())
+	d.Delivered(<-d.Chunks())
+	if held := c.held.Load(); held != 4096 {
+		t.Errorf("with a chunk in the tail, held %d", held)
+	}
+	offer(2)
+	// Short of room, the tail goes first
+	offer(3)
+	if d.tailStart != 4096 || cs.budget.used != 8192 {
+		t.Errorf("the tail starts at %d, used %d", d.tailStart, cs.budget.used)
+	}
+
+	// Nothing left to drop: it waits for the downloader to take some
+	reserved := make(chan error)
+	go func() { reserved <- c.Reserve(4, 4096) }()
+	select {
+	case err := <-reserved:
+		t.Fatalf("reserved past the budget: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	d.Delivered(<-d.Chunks())
+	if err := <-reserved; err != nil {
+		t.Fatalf("reserved once there's room: %v", err)
+	}
+	// Meanwhile, only the chunk being written was kept
+	if len(d.tail) != 1 || cs.budget.used != 8192 {
+		t.Errorf("tail of %d, used %d", len(d.tail), cs.budget.used)
+	}
+
+	other, err := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 1)
+	if err != ErrMemoryFull {
+		t.Errorf("past the budget: got %v", err)
+	}
+	c.End(PhaseCancelled, ReasonCancelledByUploader, "cancelled")
+	if cs.budget.used != 0 {
+		t.Errorf("over, it still holds %d", cs.budget.used)
+	}
+	if other, err = cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 1); err != ErrTooManyConduits {
+		t.Errorf("past the conduits: got %v", err)
+	}
+	cs.DelConduit(other)
+	if _, err := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 1); err != nil {
+		t.Errorf("once one is gone: %v", err)
+	}
+}
+
+// What a resumed downloader writes again is its own: the tail it comes from
+// can be trimmed meanwhile, as the uploader waits for room, and its buffers
+// go to the next chunks.
+func TestReplayWhileTrimmed(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	defer cs.Close()
+	cs.Limit(1, 8192)
+
+	id, _ := cs.NewConduit(false, false, "f.bin", 20480, "s", 4096, 4, 8, 1)
+	c := cs.GetConduit(id)
+	d, err := c.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for index := range 3 {
+		if err := c.Reserve(index, 4096); err != nil {
+			t.Fatal(err)
+		}
+		chunk := NewBuffer(4096)
+		for i := range chunk {
+			chunk[i] = byte('a' + index)
+		}
+		want = append(want, chunk...)
+		if err := c.OfferChunk(index, chunk); err != nil {
+			t.Fatal(err)
+		}
+		d.Delivered(<-d.Chunks())
+	}
+	d.Detach()
+	_, replay, err := c.Attach(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reserve(3, 4096); err != nil || d.tailStart != 8192 {
+		t.Fatalf("reserving past the budget: %v, the tail starts at %d", err, d.tailStart)
+	}
+	for range 4 {
+		b := NewBuffer(4096)
+		for i := range b {
+			b[i] = 'x'
+		}
+	}
+	if got := bytes.Join(replay, nil); !bytes.Equal(got, want) {
+		t.Errorf("replay changed while trimmed: %q...", got[:16])
+	}
+	c.Unreserve(4096)
+}
+
+// An uploader is away only once the download started, with chunks still to
+// come and none of its requests being handled; Progress says where it's at.
+func TestUploaderAway(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 12288, "s", 4096*1024, 4, 8, 1) // plan: 4096, 8192
+
+	if c.IsUploaderAway() {
+		t.Fatal("away before the download started")
+	}
+	if _, err := c.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsUploaderAway() {
+		t.Fatal("not away with the download waiting")
+	}
+
+	c.BeginUpload()
+	if c.IsUploaderAway() || c.UploaderAwayBefore(time.Now().UnixMilli()+1) {
+		t.Fatal("away while uploading")
+	}
+	if err := c.OfferChunk(0, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	c.EndUpload()
+
+	if !c.IsUploaderAway() || c.UploaderAwayBefore(time.Now().UnixMilli()-1000) {
+		t.Fatal("just left, it should be away but not for long")
+	}
+	if next, offset := c.Progress(); next != 1 || offset != 4096 {
+		t.Errorf("progress: got chunk %d at %d, want 1 at 4096", next, offset)
+	}
+
+	if err := c.OfferChunk(1, make([]byte, 8192)); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsUploaderAway() {
+		t.Error("away with everything uploaded")
+	}
+}
+
+// An uploader that doesn't come back within its grace window expires the
+// conduit, however long the general expiry is.
+func TestCleanupExpiresAwayUploader(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 1, 60)
+	defer cs.Close()
+
+	id, _ := cs.NewConduit(false, false, "f.bin", 12288, "s", 4096, 4, 8, 1)
+	c := cs.GetConduit(id)
+	if _, err := c.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	cs.cleanupStaleConduits()
+	if cs.GetConduit(id) == nil {
+		t.Fatal("expired within the grace window")
+	}
+
+	c.mu.Lock()
+	c.uploaderLeftAt -= 2000
+	c.mu.Unlock()
+	cs.cleanupStaleConduits()
+	if cs.GetConduit(id) != nil || !c.IsOver() {
+		t.Error("the uploader is away for longer than the grace window, and the conduit is still there")
+	}
+	if o := c.Outcome(); o.Phase != PhaseExpired || o.Reason != ReasonUploaderStalled || o.Detail != "the uploader stalled at 0%" {
+		t.Errorf("outcome %+v", o)
+	}
+}
+
+// A conduit for several downloaders starts when the last of them comes, and
+// each one gets every chunk.
+func TestFanOutStartsWhenAllAttached(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 3)
+	c.fanOutWait = time.Hour
+
+	var ds []*Downloader
+	for i := 0; i < 3; i++ {
+		select {
+		case <-c.Started:
+			t.Fatalf("started with %d downloaders of 3", i)
+		default:
+		}
+		d, err := c.Download()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	select {
+	case <-c.Started:
+	default:
+		t.Fatal("not started with all the downloaders there")
+	}
+	if _, err := c.Download(); err != ErrConduitAlreadyDownloading {
+		t.Errorf("a fourth downloader: got %v", err)
+	}
+
+	for _, chunk := range []string{"aaaa", "bbbb"} {
+		if err := c.Offer([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, d := range ds {
+		got := string(<-d.Chunks()) + string(<-d.Chunks())
+		if got != "aaaabbbb" {
+			t.Errorf("downloader %d got %q", i, got)
+		}
+		if last := d.Drop(); last != (i == len(ds)-1) {
+			t.Errorf("downloader %d: last is %v", i, last)
+		}
+	}
+}
+
+// Without all the downloaders, the transfer starts anyway after the wait, and
+// the places left free are not waited for anymore.
+func TestFanOutWaitStartsWithThoseThere(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 3)
+	c.fanOutWait = 10 * time.Millisecond
+
+	// One comes and goes: its place is free again.
+	d, err := c.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Detach()
+	if _, err := c.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.Started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not started after the wait")
+	}
+	if _, err := c.Download(); err != ErrConduitAlreadyDownloading {
+		t.Errorf("a late downloader: got %v", err)
+	}
+}
+
+// What's queued counts as buffered until it's delivered, for every downloader
+// it's queued for.
+func TestBufferedAndState(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 8, "s", 4096, 4, 8, 2)
+	c.fanOutWait = time.Hour
+	if got := c.State(); got != StateWaiting {
+		t.Errorf("before the download: %s", got)
+	}
+
+	var ds []*Downloader
+	for i := 0; i < 2; i++ {
+		d, err := c.Download()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	c.BeginUpload()
+	if got := c.State(); got != StateTransferring {
+		t.Errorf("during the download: %s", got)
+	}
+	for _, chunk := range []string{"aaaa", "bbbb"} {
+		if err := c.Offer([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The fan out moves the chunks to the downloaders, in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Buffered() != 16 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := c.Buffered(); got != 16 {
+		t.Fatalf("buffered %d bytes, want 16", got)
+	}
+	ds[0].Delivered(<-ds[0].Chunks())
+	if got := c.Buffered(); got != 12 {
+		t.Errorf("buffered %d bytes after a delivery, want 12", got)
+	}
+
+	ds[1].Detach()
+	if got := c.State(); got != StateDownloaderAway {
+		t.Errorf("with a downloader away: %s", got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 8, "s", 4096, 4, 33, 1)
+	if c.Fingerprint != Fingerprint(c.Id) || strings.Contains(c.Id, c.Fingerprint) || len(c.Fingerprint) != 12 {
+		t.Errorf("fingerprint %q for id %q", c.Fingerprint, c.Id)
+	}
+	if Fingerprint("a") == Fingerprint("b") {
+		t.Error("same fingerprint for different ids")
+	}
+}
+
+// A conduit goes from Waiting to Streaming to a final phase, recording each
+// step, and once it's over it stays so: a waiting Offer is unblocked, and
+// nothing ends it again.
+func TestLifecycle(t *testing.T) {
+	c := newConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	if c.Phase() != PhaseWaiting || c.IsOver() {
+		t.Fatalf("a new conduit is %s", c.Phase())
+	}
+	if _, err := c.Download(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Phase() != PhaseStreaming {
+		t.Fatalf("a conduit being downloaded is %s", c.Phase())
+	}
+
+	c.ChunkQueue <- []byte("aaaa")
+	returned := make(chan error)
+	go func() { returned <- c.Offer([]byte("bbbb")) }()
+
+	if !c.End(PhaseCancelled, ReasonCancelledByUploader, "cancelled by the uploader") || !c.IsOver() {
+		t.Fatal("not cancelled")
+	}
+	if err := <-returned; err != ErrConduitOver {
+		t.Errorf("got %v, want ErrConduitOver", err)
+	}
+	if c.End(PhaseExpired, ReasonIdle, "the transfer stalled") {
+		t.Error("ended twice")
+	}
+
+	var got []string
+	for _, tr := range c.History() {
+		got = append(got, string(tr.Phase)+"/"+tr.Reason)
+	}
+	want := []string{"waiting/set_up", "streaming/download_started", "cancelled/cancelled_by_uploader"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("history %v, want %v", got, want)
+	}
+	if o := c.Outcome(); o.Detail != "cancelled by the uploader" || o.At.IsZero() {
+		t.Errorf("outcome %+v", o)
+	}
+}
+
+// Nobody came for it: the conduit expires telling so.
+func TestExpiredWaitingForDownloader(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	id, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	c := cs.GetConduit(id)
+	c.lastAccessed.Store(0)
+
+	cs.cleanupStaleConduits()
+	if o := c.Outcome(); o.Phase != PhaseExpired || o.Reason != ReasonNoDownloader {
+		t.Errorf("outcome %+v", o)
+	}
+}
+
+// A forgotten conduit is kept, to tell how it ended, for an expiry window; the
+// conduit itself is let go once it's over.
+func TestEndedAreKept(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	id, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	c := cs.GetConduit(id)
+	cs.DelConduit(id)
+
+	if got, _, ok := cs.Ended(id, "s"); !ok || got != c {
+		t.Fatal("not kept while it's being wound down")
+	}
+	if _, _, ok := cs.Ended(id, "wrong"); ok {
+		t.Error("found with a wrong secret")
+	}
+
+	c.End(PhaseCancelled, ReasonCancelledByUploader, "cancelled by the uploader")
+	cs.cleanupStaleConduits()
+	got, result, ok := cs.Ended(id, "s")
+	if !ok || got != nil || result.Phase != PhaseCancelled || !result.Final || result.Size != 8 {
+		t.Fatalf("once over: %v %+v %v", got, result, ok)
+	}
+
+	if result, ok := cs.Tombstone(id); !ok || result.Reason != ReasonCancelledByUploader {
+		t.Errorf("no tombstone: %+v %v", result, ok)
+	}
+
+	cs.tombstones[id].at -= 3601 * 1000
+	cs.cleanupStaleConduits()
+	if _, _, ok := cs.Ended(id, "s"); ok {
+		t.Error("kept past the expiry window")
+	}
+}
+
+// Past the most tombstones, the oldest go first.
+func TestTombstonesAreBounded(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	cs.KeepTombstones(3600, 2)
+	var ids []string
+	for range 3 {
+		id, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+		cs.GetConduit(id).End(PhaseExpired, ReasonIdle, "idle")
+		cs.DelConduit(id)
+		ids = append(ids, id)
+	}
+	cs.cleanupStaleConduits()
+
+	if _, ok := cs.Tombstone(ids[0]); ok {
+		t.Error("the oldest is still there")
+	}
+	for _, id := range ids[1:] {
+		if _, ok := cs.Tombstone(id); !ok {
+			t.Error("a recent one is gone")
+		}
+	}
+}
+
+// A downloader can wait on a pipe before the conduit is put there; the name is
+// taken while it's on it, and free again once it's forgotten.
+func TestPipe(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	got := make(chan *Conduit)
+	go func() { got <- cs.WaitPipe(context.Background(), "deploy-42", 5*time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+
+	id, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	if err := cs.Pipe(id, "deploy-42"); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-got; c == nil || c.Id != id {
+		t.Fatalf("the waiter got %v", c)
+	}
+	if len(cs.pipeWaiters) != 0 {
+		t.Error("a waiter was left behind")
+	}
+
+	other, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	if err := cs.Pipe(other, "deploy-42"); err != ErrPipeBusy {
+		t.Errorf("got %v, want ErrPipeBusy", err)
+	}
+	cs.DelConduit(id)
+	if err := cs.Pipe(other, "deploy-42"); err != nil {
+		t.Errorf("once forgotten: %v", err)
+	}
+
+	if c := cs.WaitPipe(context.Background(), "nobody", 10*time.Millisecond); c != nil {
+		t.Errorf("got %v on a pipe nobody sent on", c)
+	}
+	if len(cs.pipeWaiters) != 0 {
+		t.Error("a waiter that gave up was left behind")
+	}
+}
+
+// A stream ramps up like a file, then goes on with chunks as big as the last
+// one, until it's ended; only then it has a size.
+func TestStream(t *testing.T) {
+	cs := NewConduitSet(3600, 60, 60, 60)
+	id, _ := cs.NewConduit(false, false, "log.txt", -1, "s", 16384, 1, 16384, 1)
+	c := cs.GetConduit(id)
+	if !c.IsStream() || c.StreamEnd == nil {
+		t.Fatal("not a stream")
+	}
+	if want := []int{4096, 8192, 16384}; !reflect.DeepEqual(c.ChunkPlan.List(), want) {
+		t.Errorf("plan %v, want %v", c.ChunkPlan.List(), want)
+	}
+	if n := c.ChunkSizeAt(10); n != 16384 {
+		t.Errorf("chunk 10 is %d", n)
+	}
+
+	if err := c.OfferChunk(0, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if c.Total() != -1 {
+		t.Errorf("total %d before the end", c.Total())
+	}
+	if err := c.EndStream(2); err != ErrChunkOutOfOrder {
+		t.Errorf("ending past a missing chunk: %v", err)
+	}
+	if err := c.EndStream(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EndStream(1); err != nil {
+		t.Errorf("ending again: %v", err)
+	}
+	select {
+	case <-c.StreamEnd:
+	default:
+		t.Error("StreamEnd is not closed")
+	}
+	if c.Total() != 3 || !c.IsWhole(3) || c.IsWhole(2) {
+		t.Errorf("total %d", c.Total())
+	}
+	if err := c.OfferChunk(1, []byte("d")); err != ErrStreamEnded {
+		t.Errorf("a chunk after the end: %v", err)
+	}
+
+	fileId, _ := cs.NewConduit(false, false, "f.bin", 8, "s", 4096, 1, 8, 1)
+	file := cs.GetConduit(fileId)
+	if err := file.EndStream(0); err != ErrNotAStream {
+		t.Errorf("ending a file: %v", err)
+	}
 }
@@ -0,0 +1,40 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+/*
+An end-to-end encrypted payload is sealed by the uploader, and opened by the
+downloader, with a key the server never sees. It's cut in records of
+E2ERecordSize bytes (the last one shorter), each sealed on its own with
+AES-256-GCM, which adds E2ETagSize bytes to it. The server only needs to know
+how much bigger the payload gets; the format is in uploading.adoc,
+"End-to-end encryption".
+*/
+const (
+	E2ERecordSize = 64 * 1024
+	E2ETagSize    = 16
+)
+
+// SealedSize is the size of a payload of size bytes, once encrypted.
+func SealedSize(size int64) int64 {
+	records := (size + E2ERecordSize - 1) / E2ERecordSize
+	return size + records*E2ETagSize
+}
+
+// OpenedSize is the size of the payload that, once encrypted, is sealedSize
+// bytes: the inverse of SealedSize.
+func OpenedSize(sealedSize int64) int64 {
+	records := (sealedSize + E2ERecordSize + E2ETagSize - 1) / (E2ERecordSize + E2ETagSize)
+	return sealedSize - records*E2ETagSize
+}
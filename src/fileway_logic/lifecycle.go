@@ -0,0 +1,199 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/proofrock/fileway/utils"
+)
+
+/*
+Phase is where a conduit is in its life. It starts Waiting for the downloaders,
+goes Streaming when the download starts, and ends in one of the final phases,
+for good. Every change is recorded as a Transition, with why and when, so that
+whoever asks about a transfer that is over can be told what happened to it,
+not just that it's gone.
+*/
+type Phase string
+
+const (
+	PhaseWaiting   Phase = "waiting"   // for the downloaders
+	PhaseStreaming Phase = "streaming" // the download is under way
+	PhaseCompleted Phase = "completed" // delivered, in full
+	PhaseCancelled Phase = "cancelled" // one of the ends gave up on it
+	PhaseExpired   Phase = "expired"   // something didn't happen in time
+	PhaseFailed    Phase = "failed"    // something went wrong
+)
+
+// IsFinal reports whether nothing comes after p.
+func (p Phase) IsFinal() bool {
+	return p != PhaseWaiting && p != PhaseStreaming
+}
+
+// The reasons of the transitions, for programs; the details are for people.
+const (
+	ReasonSetUp                  = "set_up"
+	ReasonDownloadStarted        = "download_started"
+	ReasonDelivered              = "delivered"
+	ReasonCancelledByUploader    = "cancelled_by_uploader"
+	ReasonCancelledByDownloader  = "cancelled_by_downloader"
+	ReasonNoDownloader           = "no_downloader"   // nobody came in time
+	ReasonIdle                   = "idle"            // nothing moved for too long
+	ReasonDownloaderGone         = "downloader_gone" // went away, and didn't come back in time
+	ReasonUploaderStalled        = "uploader_stalled"
+	ReasonNotDownloaded          = "not_downloaded" // stored, and kept for as long as allowed
+	ReasonExpiredByAdmin         = "expired_by_admin"
+	ReasonDownloaderDisconnected = "downloader_disconnected"
+	ReasonUploaderDisconnected   = "uploader_disconnected" // of a /put, that can't come back
+	ReasonDigestMismatch         = "digest_mismatch"
+	ReasonSpoolFailed            = "spool_failed"
+	ReasonPipeBusy               = "pipe_busy" // set up on a pipe that another transfer is on
+)
+
+// Transition is a change of phase of a conduit.
+type Transition struct {
+	Phase  Phase     `json:"phase"`
+	Reason string    `json:"reason"`
+	Detail string    `json:"detail"`
+	At     time.Time `json:"at"`
+}
+
+// Moves the conduit to phase, unless it's already in a final one; it reports
+// whether it did. A final phase closes Done. Call with mu held.
+func (c *Conduit) transition(phase Phase, reason, detail string) bool {
+	if last := c.outcome.Load(); last != nil && last.Phase.IsFinal() {
+		return false
+	}
+	t := Transition{Phase: phase, Reason: reason, Detail: detail, At: time.Now()}
+	c.history = append(c.history, t)
+	// Before Done is closed, so that whoever sees it closed sees this too
+	c.outcome.Store(&t)
+	if phase.IsFinal() {
+		// What's left in the queues is not going anywhere
+		c.unhold(math.MaxInt64)
+		close(c.Done)
+	}
+	return true
+}
+
+// End moves the conduit to phase, that must be a final one, unless it's
+// already over; it reports whether it did. What waits on it is unblocked, and
+// told why with Outcome.
+func (c *Conduit) End(phase Phase, reason, detail string) bool {
+	if !phase.IsFinal() {
+		panic(fmt.Sprintf("%s is not a final phase", phase))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.transition(phase, reason, detail)
+}
+
+// Phase returns the phase the conduit is in.
+func (c *Conduit) Phase() Phase {
+	return c.outcome.Load().Phase
+}
+
+// IsOver reports whether the conduit is in a final phase; Done is closed.
+func (c *Conduit) IsOver() bool {
+	return c.Phase().IsFinal()
+}
+
+// Outcome returns the last transition: for a conduit that is over, what
+// happened to it.
+func (c *Conduit) Outcome() Transition {
+	return *c.outcome.Load()
+}
+
+// History returns the transitions so far, oldest first.
+func (c *Conduit) History() []Transition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Transition(nil), c.history...)
+}
+
+// Percent tells how far bytes are into the payload, e.g. in a detail; for a
+// stream, whose end is not known, how many they are.
+func (c *Conduit) Percent(bytes int64) string {
+	if c.IsStream() {
+		return utils.HumanReadableSize(bytes)
+	}
+	return fmt.Sprintf("%d%%", bytes*100/max(c.Size, 1))
+}
+
+// Result is what the uploader is told of a transfer: how it ended, if it did,
+// and how much of it got to the other end.
+type Result struct {
+	// The last transition; At is when it ended, if Final
+	Transition
+	Final bool `json:"final"` // whether Phase is final, and this is the last word
+	// The bytes to deliver, and those handed to the downloader; of several,
+	// to the one that got the least. For an end-to-end encrypted payload,
+	// they are the sealed ones. Size is -1 for a stream that didn't end.
+	Size  int64 `json:"size"`
+	Bytes int64 `json:"bytes"`
+	// From the start of the download to its end, or to now
+	DurationMillis int64 `json:"duration_ms"`
+}
+
+// Result takes a snapshot of how the transfer is going, or went.
+func (c *Conduit) Result() Result {
+	outcome := c.Outcome()
+	ret := Result{
+		Transition: outcome,
+		Final:      outcome.Phase.IsFinal(),
+		Size:       c.Total(),
+		Bytes:      c.DeliveredBytes(),
+	}
+	end := time.Now()
+	if ret.Final {
+		end = outcome.At
+	}
+	for _, t := range c.History() {
+		if t.Phase == PhaseStreaming {
+			ret.DurationMillis = end.Sub(t.At).Milliseconds()
+		}
+	}
+	return ret
+}
+
+// DeliveredBytes returns the bytes handed to the downloader that got the
+// least, of those that took part; all of them, if a spooled conduit was
+// downloaded as many times as owed.
+func (c *Conduit) DeliveredBytes() int64 {
+	if c.spool != nil {
+		c.spool.mu.Lock()
+		defer c.spool.mu.Unlock()
+
+		if c.spool.remaining == 0 {
+			return c.Size
+		}
+		return c.spool.delivered
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := int64(-1)
+	for _, d := range c.downloaders {
+		if !d.skipped && (ret < 0 || d.delivered < ret) {
+			ret = d.delivered
+		}
+	}
+	return max(ret, 0)
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import "time"
+
+// WithParallelChunks lets the uploader send up to chunks chunks of the plan at
+// once, each in a request of its own: on a link that loses packets, far away,
+// a single TCP connection doesn't go as fast as several. They are read at the
+// same time, and queued in order. Only a file can, with a plan that is set up
+// front: an adaptive one knows the size of the next chunk only, a stream
+// doesn't know where its chunks end.
+func WithParallelChunks(chunks int) ConduitOption {
+	return func(c *Conduit) { c.parallelize(chunks) }
+}
+
+// See WithParallelChunks.
+func (c *Conduit) parallelize(chunks int) {
+	if c.IsText || c.IsStream() || c.ChunkPlan.Adaptive || chunks < 2 {
+		return
+	}
+	c.ChunkPlan.Parallel = chunks
+}
+
+// Waits until the chunk at index is the next one, i.e. the ones before it were
+// accepted. The chunks ahead wait in their requests, and in memory: that's the
+// reorder buffer, bounded by ChunkPlan.Parallel. While the next one is being
+// offered it waits as long as that takes; otherwise it gives up as Offer does,
+// if it doesn't come within 30 seconds, e.g. because its upload failed and
+// the uploader went away. Or when the conduit is over.
+func (c *Conduit) awaitTurn(index int) error {
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		next, turn := c.nextChunk, c.turn
+		c.mu.Unlock()
+		if next == index {
+			return nil
+		}
+		select {
+		case <-turn:
+			timer.Reset(30 * time.Second)
+		case <-c.Done:
+			return ErrConduitOver
+		case <-timer.C:
+			c.mu.Lock()
+			offering := c.inFlight[c.nextChunk]
+			c.mu.Unlock()
+			if !offering {
+				return ErrTurnTimeout
+			}
+			timer.Reset(30 * time.Second)
+		}
+	}
+}
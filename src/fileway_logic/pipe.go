@@ -0,0 +1,106 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"context"
+	"time"
+)
+
+/*
+Named pipes. A conduit is normally found by its id, that the uploader gets at
+the setup and hands over, so the downloader can only come after. A conduit can
+also be put on a pipe, a name agreed in advance, e.g. "deploy-42": then the
+downloader can come first, and wait on the name for the uploader to show up.
+
+The name is just another way to the same conduit, that works as usual once
+both ends are there. The id is still what the uploader uses, and it's still
+secret; the name, though, is as good as the id to download, so it must be as
+hard to guess, if the payload is not for everyone.
+*/
+
+// Who waits on a pipe name that has no conduit yet: arrived is closed when
+// one comes. n is how many wait, so that it's dropped when they all gave up.
+type pipeWait struct {
+	arrived chan struct{}
+	n       int
+}
+
+// Pipe puts the conduit on the pipe name, and hands it to whoever waits on it
+// in WaitPipe. It returns ErrPipeBusy if another conduit is on it. The name is
+// free again once the conduit is forgotten.
+func (cs *ConduitSet) Pipe(conduitId, name string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	conduit := cs.conduits[conduitId]
+	if conduit == nil {
+		return ErrConduitOver
+	}
+	if _, ok := cs.pipes[name]; ok {
+		return ErrPipeBusy
+	}
+	cs.pipes[name] = conduitId
+	conduit.pipe = name
+	if w := cs.pipeWaiters[name]; w != nil {
+		close(w.arrived)
+		delete(cs.pipeWaiters, name)
+	}
+	return nil
+}
+
+// GetPipe is GetConduit, by pipe name.
+func (cs *ConduitSet) GetPipe(name string) *Conduit {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return cs.conduits[cs.pipes[name]]
+}
+
+// WaitPipe returns the conduit on the pipe name, waiting for one to be put
+// there if there's none, for timeout at most. It returns nil if none came, or
+// if ctx is done first.
+func (cs *ConduitSet) WaitPipe(ctx context.Context, name string, timeout time.Duration) *Conduit {
+	cs.mu.Lock()
+	if conduit := cs.conduits[cs.pipes[name]]; conduit != nil {
+		cs.mu.Unlock()
+		return conduit
+	}
+	w := cs.pipeWaiters[name]
+	if w == nil {
+		w = &pipeWait{arrived: make(chan struct{})}
+		cs.pipeWaiters[name] = w
+	}
+	w.n++
+	cs.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.arrived:
+		return cs.GetPipe(name)
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	// Nobody else waits: nothing of it is left
+	w.n--
+	if w.n == 0 && cs.pipeWaiters[name] == w {
+		delete(cs.pipeWaiters, name)
+	}
+	return nil
+}
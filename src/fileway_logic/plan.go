@@ -0,0 +1,148 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+const (
+	// ChunkPlanVersion is the latest version of ChunkPlan, that the uploaders
+	// ask for at ping with X-Fileway-Plan, and at setup to get an adaptive
+	// one. Those that don't, that came before it, get the list of the sizes,
+	// see List.
+	ChunkPlanVersion = 3
+	// ChunkPlanDescribed is the version of a plan that is set up front:
+	// described, but not adaptive.
+	ChunkPlanDescribed = 2
+)
+
+// ChunkPlan is how the uploader cuts the payload in chunks: the first one is
+// Initial bytes, each one after is Factor times the one before, up to Max, and
+// the last one is what's left of Size. A stream, whose Size is -1, goes on
+// with chunks of Max until it ends. It's described rather than listed: at 4
+// TiB, in chunks of 4 MiB, the list would be a million sizes.
+//
+// An Adaptive one only sets the first chunk: the size of each one after is
+// chosen as the one before is accepted, after how fast the transfer goes,
+// between Min and Max, and the uploader is told it then; see
+// Conduit.ChunkSizeAt. Its methods tell the ramp, as if the transfer were
+// as fast as can be.
+//
+// Parallel, if more than 1, is how many chunks the uploader can send at once,
+// each in a request of its own: only for a file, whose chunks are all known
+// up front. See WithParallelChunks.
+type ChunkPlan struct {
+	Version  int   `json:"version"`
+	Initial  int   `json:"initial"`
+	Factor   int   `json:"factor"`
+	Min      int   `json:"min,omitempty"`
+	Max      int   `json:"max"`
+	Size     int64 `json:"size"`
+	Adaptive bool  `json:"adaptive,omitempty"`
+	Parallel int   `json:"parallel,omitempty"`
+}
+
+// The plan of a payload of size bytes, -1 for a stream: it ramps up to
+// chunkSize, so that a slow link shows some progress from the start.
+func newChunkPlan(size int64, chunkSize int) ChunkPlan {
+	return ChunkPlan{
+		Version: ChunkPlanDescribed,
+		Initial: min(chunkSizeInitial, chunkSize),
+		Factor:  chunkSizeRampFactor,
+		Max:     chunkSize,
+		Size:    size,
+	}
+}
+
+// The offset of the chunk at index, and its size, before the end of the
+// payload cuts them. The ramp is a handful of steps, and then it's a product.
+func (p ChunkPlan) at(index int) (int64, int) {
+	off, size := int64(0), p.Initial
+	for ; index > 0 && size < p.Max; index-- {
+		off += int64(size)
+		size = p.next(size)
+	}
+	return off + int64(index)*int64(size), size
+}
+
+// How many chunks can be uploaded at once; 0 is as 1.
+func (p ChunkPlan) parallel() int {
+	return max(p.Parallel, 1)
+}
+
+// The size of the chunk after one of size, in the ramp.
+func (p ChunkPlan) next(size int) int {
+	if p.Factor < 2 {
+		return p.Max
+	}
+	return min(size*p.Factor, p.Max)
+}
+
+// SizeAt returns the size of the chunk at index, i.e. the most it can be; a
+// chunk of a stream can be shorter. It's 0 past the last one.
+func (p ChunkPlan) SizeAt(index int) int {
+	if index < 0 {
+		return 0
+	}
+	off, size := p.at(index)
+	if p.Size < 0 {
+		return size
+	}
+	return int(max(0, min(int64(size), p.Size-off)))
+}
+
+// OffsetAt returns the offset in the payload of the chunk at index; past the
+// last one, it's the size.
+func (p ChunkPlan) OffsetAt(index int) int64 {
+	off, _ := p.at(max(index, 0))
+	if p.Size < 0 {
+		return off
+	}
+	return min(off, p.Size)
+}
+
+// Len returns how many chunks there are; -1 for a stream, whose end is not
+// known, or if it's Adaptive.
+func (p ChunkPlan) Len() int {
+	if p.Size < 0 || p.Adaptive {
+		return -1
+	}
+	n, off, size := 0, int64(0), p.Initial
+	for ; off < p.Size && size < p.Max; n++ {
+		off += int64(size)
+		size = p.next(size)
+	}
+	if off < p.Size {
+		n += int((p.Size - off + int64(size) - 1) / int64(size))
+	}
+	return n
+}
+
+// List returns the sizes of the chunks, as the uploaders before
+// ChunkPlanDescribed want them; for a stream, up to the first of Max, and the
+// ones after are as big. An Adaptive plan can't be listed.
+func (p ChunkPlan) List() []int {
+	if p.Adaptive {
+		return nil
+	}
+	n := p.Len()
+	if n < 0 {
+		n = 1
+		for size := p.Initial; size < p.Max; size = p.next(size) {
+			n++
+		}
+	}
+	ret := make([]int, n)
+	for i := range ret {
+		ret[i] = p.SizeAt(i)
+	}
+	return ret
+}
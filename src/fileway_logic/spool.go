@@ -0,0 +1,197 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The prefix of the spool files, so that the ones left by a previous run can
+// be told from anything else in the dir.
+const spoolFilePrefix = "fileway_spool_"
+
+/*
+A spool holds the payload of a conduit on disk, so that the uploader doesn't
+have to wait for the downloader. It's encrypted with AES-CTR, with a key that
+only lives in memory: whoever gets the disk gets nothing, and the files left
+by a previous run can't be read anymore, so they are deleted at startup.
+CTR lets the payload be read from any offset, so a download can always be
+resumed.
+*/
+type spool struct {
+	path  string
+	file  *os.File
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+
+	mu       sync.Mutex
+	written  int64
+	size     int64
+	hash     hash.Hash     // of what's written, in clear
+	storedAt int64         // unix millis, once the whole payload is written
+	grown    chan struct{} // closed, and replaced, whenever written grows
+
+	// How many downloads are owed in all, how many are still owed, and how
+	// many are under way
+	downloads int
+	remaining int
+	active    int
+	// The furthest a download got; see Conduit.Result
+	delivered int64
+}
+
+func newSpool(dir string, size int64, downloads int) (*spool, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(dir, spoolFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	ret := &spool{
+		path:      file.Name(),
+		file:      file,
+		block:     block,
+		size:      size,
+		hash:      sha256.New(),
+		grown:     make(chan struct{}),
+		downloads: max(downloads, 1),
+		remaining: max(downloads, 1),
+	}
+	if _, err := rand.Read(ret.iv[:]); err != nil {
+		ret.remove()
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Encrypts, or decrypts, p in place, as the bytes of the payload at offset off.
+func (s *spool) xorAt(p []byte, off int64) {
+	// The counter of the block off falls in is the IV plus the number of
+	// blocks before it, as a 128 bit big endian number.
+	var iv [aes.BlockSize]byte
+	hi := binary.BigEndian.Uint64(s.iv[:8])
+	lo := binary.BigEndian.Uint64(s.iv[8:])
+	blocks := uint64(off / aes.BlockSize)
+	if lo+blocks < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(iv[:8], hi)
+	binary.BigEndian.PutUint64(iv[8:], lo+blocks)
+
+	stream := cipher.NewCTR(s.block, iv[:])
+	if skip := off % aes.BlockSize; skip > 0 {
+		var discard [aes.BlockSize]byte
+		stream.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	stream.XORKeyStream(p, p)
+}
+
+// Appends content to the payload. content is left as it is. If digest is not
+// nil, the payload must match it: the last chunk is refused if it doesn't, so
+// a payload that is not the declared one is never stored.
+func (s *spool) append(content, digest []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.written+int64(len(content)) > s.size {
+		return fmt.Errorf("%w: more than the declared size", ErrSpoolFailed)
+	}
+	// The hash goes on only once content is written, since a chunk that
+	// failed is sent again.
+	h, err := s.hash.(hash.Cloner).Clone()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSpoolFailed, err)
+	}
+	h.Write(content)
+	if s.written+int64(len(content)) == s.size && digest != nil && string(h.Sum(nil)) != string(digest) {
+		return ErrDigestMismatch
+	}
+	buf := NewBuffer(len(content))
+	defer ReleaseBuffer(buf)
+	copy(buf, content)
+	s.xorAt(buf, s.written)
+	if _, err := s.file.WriteAt(buf, s.written); err != nil {
+		return fmt.Errorf("%w: %w", ErrSpoolFailed, err)
+	}
+
+	s.written += int64(len(buf))
+	s.hash = h
+	if s.written == s.size {
+		s.storedAt = time.Now().UnixMilli()
+	}
+	close(s.grown)
+	s.grown = make(chan struct{})
+	return nil
+}
+
+// Reads the payload at offset off into p. If nothing is there yet it returns
+// 0 and a channel that is closed when something is.
+func (s *spool) readAt(p []byte, off int64) (int, <-chan struct{}, error) {
+	s.mu.Lock()
+	available := s.written - off
+	grown := s.grown
+	s.mu.Unlock()
+
+	if available <= 0 {
+		return 0, grown, nil
+	}
+	p = p[:min(int64(len(p)), available)]
+	n, err := s.file.ReadAt(p, off)
+	s.xorAt(p[:n], off)
+	return n, nil, err
+}
+
+func (s *spool) isStored() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.storedAt > 0
+}
+
+// Deletes the file. A download still reading it fails.
+func (s *spool) remove() {
+	s.file.Close()
+	os.Remove(s.path)
+}
+
+// Deletes the spool files in dir, which can only be left by a previous run.
+func removeSpoolFiles(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, spoolFilePrefix+"*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
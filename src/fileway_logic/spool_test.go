@@ -0,0 +1,108 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// What's on disk is not the payload, and the payload reads back the same from
+// any offset, across chunk and block boundaries.
+func TestSpoolReadsBackFromAnyOffset(t *testing.T) {
+	payload := make([]byte, 10000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool(t.TempDir(), int64(len(payload)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.remove()
+
+	if n, grown, _ := s.readAt(make([]byte, 10), 0); n != 0 || grown == nil {
+		t.Fatal("read something before anything was written")
+	}
+	for _, cut := range [][2]int{{0, 4096}, {4096, 4097}, {4097, 10000}} {
+		if err := s.append(payload[cut[0]:cut[1]], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.isStored() {
+		t.Error("not stored with the whole payload written")
+	}
+	if err := s.append([]byte("x"), nil); err == nil {
+		t.Error("written past the declared size")
+	}
+
+	onDisk, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, payload[:64]) {
+		t.Error("the payload is on disk in clear")
+	}
+
+	for _, off := range []int64{0, 1, 15, 16, 17, 4095, 4097, 9999} {
+		buf := make([]byte, 100)
+		n, _, err := s.readAt(buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], payload[off:off+int64(n)]) {
+			t.Errorf("reading at %d: mismatch", off)
+		}
+	}
+}
+
+// The declared sizes are taken from the quota, and given back with the file
+// when the conduit goes; files of a previous run are removed at startup.
+func TestSpoolQuota(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, spoolFilePrefix+"old")
+	if err := os.WriteFile(leftover, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cs := NewConduitSet(3600, 60, 60, 60)
+	defer cs.Close()
+	if _, err := cs.NewSpooledConduit(false, false, "f.bin", 10, "s", 4096, 8, 1); err != ErrSpoolDisabled {
+		t.Fatalf("spooling before enabling it: got %v", err)
+	}
+	if err := cs.EnableSpool(dir, 100, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("a spool file of a previous run was not removed")
+	}
+
+	id, err := cs.NewSpooledConduit(false, false, "f.bin", 60, "s", 4096, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.NewSpooledConduit(false, false, "f.bin", 50, "s", 4096, 8, 1); err != ErrSpoolFull {
+		t.Fatalf("over quota: got %v", err)
+	}
+	path := cs.GetConduit(id).spool.path
+	cs.DelConduit(id)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the spool file outlived its conduit")
+	}
+	if _, err := cs.NewSpooledConduit(false, false, "f.bin", 50, "s", 4096, 8, 1); err != nil {
+		t.Errorf("the quota was not given back: %v", err)
+	}
+}
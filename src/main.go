@@ -14,68 +14,49 @@
 package main
 
 import (
-	_ "embed"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"html"
 	"io"
-	"log"
-	"mime"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/proofrock/fileway/auth"
-	fw "github.com/proofrock/fileway/fileway_logic"
+	"github.com/proofrock/fileway/server"
 	"github.com/proofrock/fileway/utils"
 )
 
-var (
-	idsLength       = utils.GetIntEnv("RANDOM_IDS_LENGTH", 33)      // Length of ID random strings, amounts to 192 bit
-	chunkSize       = utils.GetIntEnv("CHUNK_SIZE_KB", 4096) * 1024 // 4Mb
-	bufferQueueSize = utils.GetIntEnv("BUFFER_QUEUE_SIZE", 4)       // 16Mb total
-	port            = utils.GetIntEnv("PORT", 8080)
-)
-
-//go:embed static/upload.html
-var uploadPage []byte
-
-//go:embed static/download.html
-var downloadPage []byte
-
-//go:embed static/download_for_txt.html
-var downloadPageForTxt []byte
-
-//go:embed static/favicon.png
-var favicon []byte
-
-//go:embed static/fileway_ul.py
-var cliUploader []byte
-
 var version string   // Set at build time, var VERSION
 var buildTime string // Set at build time, var SOURCE_DATE_EPOCH
 
-var authenticator *auth.Auth
-var conduits *fw.ConduitSet
-
 func main() {
-	// Replaces version in the web pages and cli uploader
-	downloadPage = utils.Replace(downloadPage, "#VERSION#", version)
-	downloadPageForTxt = utils.Replace(downloadPageForTxt, "#VERSION#", version)
-	uploadPage = utils.Replace(uploadPage, "#VERSION#", version)
-	cliUploader = utils.Replace(cliUploader, "#VERSION#", version)
+	// Client modes (send, receive...) are subcommands; no arguments is the server
+	if exitCode, isCLI := runCLI(os.Args[1:]); isCLI {
+		os.Exit(exitCode)
+	}
 
-	// https://manytools.org/hacker-tools/ascii-banner/, profile "Slant"
-	fmt.Println("    _____ __")
-	fmt.Println("   / __(_) /__ _      ______ ___  __")
-	fmt.Println("  / /_/ / / _ \\ | /| / / __ `/ / / /")
-	fmt.Println(" / __/ / /  __/ |/ |/ / /_/ / /_/ /")
-	fmt.Println("/_/ /_/_/\\___/|__/|__/\\__,_/\\__, /")
-	fmt.Println("                           /____/ " + version)
-	fmt.Println()
+	logFormat := os.Getenv("LOG_FORMAT")
+	logger, err := newLogger(os.Stderr, logFormat, os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FATAL: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	// The banner would only be in the way of a log collector
+	if logFormat != "json" {
+		// https://manytools.org/hacker-tools/ascii-banner/, profile "Slant"
+		fmt.Println("    _____ __")
+		fmt.Println("   / __(_) /__ _      ______ ___  __")
+		fmt.Println("  / /_/ / / _ \\ | /| / / __ `/ / / /")
+		fmt.Println(" / __/ / /  __/ |/ |/ / /_/ / /_/ /")
+		fmt.Println("/_/ /_/_/\\___/|__/|__/\\__,_/\\__, /")
+		fmt.Println("                           /____/ " + version)
+		fmt.Println()
+	}
 
 	if _, isthere := os.LookupEnv("REPRODUCIBLE_BUILD_INFO"); isthere {
 		fmt.Println("Variables used for this build:")
@@ -85,320 +66,194 @@ func main() {
 		return
 	}
 
-	secretHashes := os.Getenv("FILEWAY_SECRET_HASHES")
-	if secretHashes == "" {
-		log.Fatal("FATAL: missing environment variable FILEWAY_SECRET_HASHES")
+	defaults := server.DefaultConfig()
+	cfg := server.Config{
+		SecretHashes:    os.Getenv("FILEWAY_SECRET_HASHES"),
+		IdsLength:       utils.GetIntEnv("RANDOM_IDS_LENGTH", defaults.IdsLength),
+		ChunkSize:       utils.GetIntEnv("CHUNK_SIZE_KB", defaults.ChunkSize/1024) * 1024,
+		ChunkSizeMin:    utils.GetIntEnv("CHUNK_SIZE_MIN_KB", defaults.ChunkSizeMin/1024) * 1024,
+		ChunkSizeMax:    utils.GetIntEnv("CHUNK_SIZE_MAX_KB", defaults.ChunkSizeMax/1024) * 1024,
+		BufferQueueSize: utils.GetIntEnv("BUFFER_QUEUE_SIZE", defaults.BufferQueueSize),
+		ParallelChunks:  utils.GetIntEnv("PARALLEL_CHUNKS", defaults.ParallelChunks),
+		MaxConduits:     utils.GetIntEnv("MAX_CONDUITS", defaults.MaxConduits),
+		MemoryBudget:    int64(utils.GetIntEnv("MEMORY_BUDGET_MB", int(defaults.MemoryBudget/1024/1024))) * 1024 * 1024,
+		UploadTimeout:   time.Duration(utils.GetIntEnv("UPLOAD_TIMEOUT_SECS", int(defaults.UploadTimeout/time.Second))) * time.Second,
+		ResumeGrace:     time.Duration(utils.GetIntEnv("RESUME_GRACE_SECS", int(defaults.ResumeGrace/time.Second))) * time.Second,
+		UploaderGrace:   time.Duration(utils.GetIntEnv("UPLOADER_GRACE_SECS", int(defaults.UploaderGrace/time.Second))) * time.Second,
+		FanOutWait:      time.Duration(utils.GetIntEnv("FANOUT_WAIT_SECS", int(defaults.FanOutWait/time.Second))) * time.Second,
+		PipeWait:        time.Duration(utils.GetIntEnv("PIPE_WAIT_SECS", int(defaults.PipeWait/time.Second))) * time.Second,
+		SpoolDir:        os.Getenv("SPOOL_DIR"),
+		SpoolQuota:      int64(utils.GetIntEnv("SPOOL_QUOTA_MB", int(defaults.SpoolQuota/1024/1024))) * 1024 * 1024,
+		SpoolTTL:        time.Duration(utils.GetIntEnv("SPOOL_TTL_SECS", int(defaults.SpoolTTL/time.Second))) * time.Second,
+		TombstoneTTL:    time.Duration(utils.GetIntEnv("TOMBSTONE_TTL_SECS", int(defaults.TombstoneTTL/time.Second))) * time.Second,
+		MaxTombstones:   utils.GetIntEnv("MAX_TOMBSTONES", defaults.MaxTombstones),
+		Version:         version,
+
+		AdminSecretHashes: os.Getenv("ADMIN_SECRET_HASHES"),
 	}
-	if idsLength <= 0 {
-		log.Fatal("FATAL: RANDOM_IDS_LENGTH must be > 0")
+	port := utils.GetIntEnv("PORT", 8080)
+	// The metrics go along with the rest if on the same port, or else on a
+	// port of their own, so that it can be kept private
+	metricsPort := utils.GetIntEnv("METRICS_PORT", 0)
+	cfg.Metrics = metricsPort == port
+	// The admin API is only on a listener of its own: a TCP address, or a
+	// unix socket
+	adminAddr := os.Getenv("ADMIN_ADDR")
+
+	if cfg.SecretHashes == "" {
+		fatal("missing environment variable FILEWAY_SECRET_HASHES")
 	}
-	if chunkSize <= 0 {
-		log.Fatal("FATAL: CHUNK_SIZE_KB must be > 0")
-	}
-	if bufferQueueSize <= 0 {
-		log.Fatal("FATAL: BUFFER_QUEUE_SIZE must be > 0")
+	if err := cfg.Validate(); err != nil {
+		fatal(err.Error())
 	}
 	if port <= 0 || port > 65535 {
-		log.Fatal("FATAL: PORT must be between 1 and 65535")
-	}
-
-	authenticator = auth.NewAuth(secretHashes)
-
-	uploadTimeout := utils.GetIntEnv("UPLOAD_TIMEOUT_SECS", 240)
-
-	conduits = fw.NewConduitSet(uploadTimeout)
-
-	fmt.Println("Parameters:")
-	fmt.Printf("- Port: %d\n", port)
-	fmt.Printf("- Chunk size: %d Kb\n", chunkSize/1024)
-	fmt.Printf("- Internal chunk queue size: %d\n", bufferQueueSize)
-	fmt.Printf("- Random IDs length: %d chars\n", idsLength)
-	fmt.Printf("- Upload timeout: %d secs\n", uploadTimeout)
-	fmt.Println()
-
-	// Routes
-	http.HandleFunc("/dl/", dl)   // Shows a download page, if downloader "looks like" CLI redirects to ddl
-	http.HandleFunc("/ddl/", ddl) // Direct download
-	http.HandleFunc("/setup", setup)
-	http.HandleFunc("/ping/", ping)
-	http.HandleFunc("/ul/", ul)
-	http.HandleFunc("/fileway_ul.py", serveCLIUploader)
-	http.HandleFunc("/favicon.png", serveFile(favicon, "image/png"))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
-		}
-		serveFile(uploadPage, "text/html")(w, r)
-	})
-
-	addr := fmt.Sprintf(":%d", port)
-	srv := &http.Server{
-		Addr:              addr,
-		ReadHeaderTimeout: 10 * time.Second,
-		IdleTimeout:       120 * time.Second,
-		// WriteTimeout intentionally omitted: transfers can be arbitrarily long
+		fatal("PORT must be between 1 and 65535")
 	}
-	log.Printf("Starting server on %s", addr)
-	log.Fatal(srv.ListenAndServe())
-}
-
-func serveFile(file []byte, contentType string) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", contentType)
-		w.Write(file)
+	if metricsPort < 0 || metricsPort > 65535 {
+		fatal("METRICS_PORT must be between 1 and 65535, or 0")
 	}
-}
-
-func getConduit(r *string) *fw.Conduit {
-	parts := strings.Split(*r, "/")
-	conduitId := parts[len(parts)-1]
-
-	return conduits.GetConduit(conduitId)
-}
-
-// This is the basic handler for downloads; it shows a download page
-// unless the user agent "appears" to come from a CLI application.
-// In this case, forwards control to ddl(w, r) that directly downloads
-// the payload.
-func dl(w http.ResponseWriter, r *http.Request) {
-	switch strings.Split(r.UserAgent(), "/")[0] {
-	case "curl", "Wget", "HTTPie", "aria2", "Axel":
-		ddl(w, r)
-	default:
-		conduit := getConduit(&r.URL.Path)
-		if conduit == nil {
-			http.Error(w, "Conduit Not Found", http.StatusNotFound)
-			return
-		}
-
-		var _downloadPage []byte
-		if conduit.IsText {
-			_downloadPage = downloadPageForTxt
-		} else {
-			fileString := fmt.Sprintf("%s (%s)", html.EscapeString(conduit.Filename), utils.HumanReadableSize(conduit.Size))
-			_downloadPage = utils.Replace(downloadPage, "#FILE_INFO#", fileString)
-		}
-
-		serveFile(_downloadPage, "text/html")(w, r)
-	}
-}
-
-// direct download of the payload
-func ddl(w http.ResponseWriter, r *http.Request) {
-	conduit := getConduit(&r.URL.Path)
-	if conduit == nil {
-		http.Error(w, "Conduit Not Found", http.StatusNotFound)
-		return
-	}
-
-	if err := conduit.Download(); err != nil {
-		http.Error(w, err.Error(), http.StatusGone)
-		return
+	if adminAddr != "" && cfg.AdminSecretHashes == "" {
+		fatal("ADMIN_ADDR needs ADMIN_SECRET_HASHES")
 	}
 
-	var contentType string
-	if conduit.IsText {
-		contentType = "text/plain"
-	} else {
-		contentType = "application/octet-stream"
+	handler, err := server.New(cfg)
+	if err != nil {
+		fatal(err.Error())
 	}
-
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": conduit.Filename}))
-	w.Header().Set("Content-Length", strconv.FormatInt(conduit.Size, 10))
-
-	transferred := int64(0)
-	ctx := r.Context()
-loop:
-	for transferred < conduit.Size {
-		select {
-		case <-ctx.Done():
-			log.Printf("Downloader disconnected for conduit %s", conduit.Id)
-			break loop
-		case chunk, ok := <-conduit.ChunkQueue:
-			if !ok || len(chunk) == 0 {
-				break loop
-			}
-			if _, err := w.Write(chunk); err != nil {
-				log.Printf("Error writing chunk: %v", err)
-				break loop
-			}
-			conduit.Touch() // a slow but progressing transfer must not expire
-			transferred += int64(len(chunk))
-		case <-conduit.Done:
-			// The conduit expired. Whatever the uploader already handed over is
-			// still owed to the downloader, so drain the buffer before giving up:
-			// select picks a ready case at random, so without this the buffered
-			// chunks would be dropped and the body would silently fall short of
-			// the Content-Length we announced.
-			for transferred < conduit.Size {
-				var chunk []byte
-				select {
-				case chunk = <-conduit.ChunkQueue:
-				default:
-					log.Printf("Conduit %s expired during download", conduit.Id)
-					break loop
-				}
-				if len(chunk) == 0 {
-					break loop
-				}
-				if _, err := w.Write(chunk); err != nil {
-					log.Printf("Error writing chunk: %v", err)
-					break loop
-				}
-				transferred += int64(len(chunk))
-			}
-		}
+	cfg = handler.Config()
+
+	params := []any{
+		slog.String("event", "config"),
+		slog.Int("port", port),
+		slog.Int("chunk_size_kb", cfg.ChunkSize/1024),
+		slog.Int("chunk_size_min_kb", cfg.ChunkSizeMin/1024),
+		slog.Int("chunk_size_max_kb", cfg.ChunkSizeMax/1024),
+		slog.Int("buffer_queue_size", cfg.BufferQueueSize),
+		slog.Int("parallel_chunks", cfg.ParallelChunks),
+		slog.Int("max_conduits", cfg.MaxConduits),
+		slog.Int64("memory_budget_mb", cfg.MemoryBudget/1024/1024),
+		slog.Int("ids_length", cfg.IdsLength),
+		slog.Duration("upload_timeout", cfg.UploadTimeout),
+		slog.Duration("resume_grace", cfg.ResumeGrace),
+		slog.Duration("uploader_grace", cfg.UploaderGrace),
+		slog.Duration("fanout_wait", cfg.FanOutWait),
+		slog.Duration("pipe_wait", cfg.PipeWait),
 	}
-
-	conduits.DelConduit(conduit.Id)
-}
-
-const maxSizeBytes = 4 * 1024 * 1024 * 1024 * 1024 // 4 TiB
-
-func setup(w http.ResponseWriter, r *http.Request) {
-	qry := r.URL.Query()
-
-	passedSecret := r.Header.Get("x-fileway-secret")
-
-	if !authenticator.Authenticate(passedSecret) {
-		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
-		return
+	if cfg.SpoolDir != "" {
+		params = append(params,
+			slog.String("spool_dir", cfg.SpoolDir),
+			slog.Int64("spool_quota_mb", cfg.SpoolQuota/1024/1024),
+			slog.Duration("spool_ttl", cfg.SpoolTTL))
 	}
-
-	var filename string
-	sizeStr := qry.Get("size")
-	isText := qry.Get("txt") == "1"
-	if isText {
-		filename = fmt.Sprintf("fileway_%s.txt", utils.NowString())
-	} else {
-		filename = qry.Get("filename")
+	if metricsPort > 0 {
+		params = append(params, slog.Int("metrics_port", metricsPort))
 	}
-	if sizeStr == "" || filename == "" {
-		http.Error(w, "Missing required parameter", http.StatusBadRequest)
-		return
+	if adminAddr != "" {
+		params = append(params, slog.String("admin_addr", adminAddr))
 	}
-
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Non-numeric size", http.StatusBadRequest)
-		return
+	slog.Info("Parameters", params...)
+
+	if metricsPort > 0 && !cfg.Metrics {
+		metricsAddr := fmt.Sprintf(":%d", metricsPort)
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", handler.Metrics())
+		metricsSrv := &http.Server{
+			Addr:              metricsAddr,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Serving metrics", "event", "listen", "addr", metricsAddr)
+			fatal(metricsSrv.ListenAndServe().Error())
+		}()
 	}
 
-	if size <= 0 || size > maxSizeBytes {
-		http.Error(w, "Invalid size: must be between 1 byte and 4 TiB", http.StatusBadRequest)
-		return
+	if adminAddr != "" {
+		adminListener, err := listenAdmin(adminAddr)
+		if err != nil {
+			fatal(fmt.Sprintf("listening on ADMIN_ADDR: %v", err))
+		}
+		adminSrv := &http.Server{
+			Handler:           handler.Admin(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("Serving the admin API", "event", "listen", "addr", adminAddr)
+			fatal(adminSrv.Serve(adminListener).Error())
+		}()
 	}
 
-	bqs := bufferQueueSize
-	if isText {
-		bqs = 1
+	addr := fmt.Sprintf(":%d", port)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		// WriteTimeout intentionally omitted: transfers can be arbitrarily long
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 	}
-
-	conduitId := conduits.NewConduit(isText, filename, size, passedSecret, chunkSize, bqs, idsLength)
-
-	_, _ = w.Write([]byte(conduitId))
+	slog.Info("Starting server", "event", "listen", "addr", addr)
+	fatal(srv.ListenAndServe().Error())
 }
 
-func ping(w http.ResponseWriter, r *http.Request) {
-	conduit := getConduit(&r.URL.Path)
-	if conduit == nil {
-		http.Error(w, "Conduit Not Found", http.StatusNotFound)
-		return
-	}
-
-	passedSecret := r.Header.Get("x-fileway-secret")
-	if conduit.IsUploadSecretWrong(passedSecret) {
-		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
-		return
-	}
-
-	// A timer rather than time.After: this returns before the 20s are up whenever
-	// a download shows up, and time.After would keep its timer alive until it
-	// fired anyway. One uploader parks here for the whole wait, so it adds up.
-	timer := time.NewTimer(20 * time.Second)
-	defer timer.Stop()
-
-	var ret []byte
-	select {
-	case <-conduit.Done:
-		http.Error(w, "Transfer expired", http.StatusGone)
-		return
-	case <-conduit.Started:
-		// Both channels can be closed by the time we get here, and select picks
-		// among ready cases at random, so the expiry check has to be repeated:
-		// handing out a plan for a conduit that is already gone would send the
-		// uploader into chunks that can only 404.
-		if conduit.IsExpired() {
-			http.Error(w, "Transfer expired", http.StatusGone)
-			return
-		}
-		_ret, err := json.Marshal(conduit.ChunkPlan)
-		if err != nil {
-			http.Error(w, "Marshaling issue", http.StatusInternalServerError)
-			return
+// Builds the logger of the server, writing to w in format ("text", the
+// default, or "json"), from level on ("debug", "info", the default, "warn" or
+// "error").
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", level)
 		}
-		ret = _ret
-	case <-timer.C: // nobody yet; the uploader will ask again
-		ret = []byte("[]")
 	}
-
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(ret)
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be text or json, got %q", format)
 }
 
-func ul(w http.ResponseWriter, r *http.Request) {
-	conduit := getConduit(&r.URL.Path)
-	if conduit == nil {
-		http.Error(w, "Conduit Not Found", http.StatusNotFound)
-		return
+// Listens on addr, a host:port or unix:PATH. The socket is only for the user
+// running the server; one left by a previous run is replaced.
+func listenAdmin(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
 	}
-
-	passedSecret := r.Header.Get("x-fileway-secret")
-	if conduit.IsUploadSecretWrong(passedSecret) {
-		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
-		return
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
 	}
-
-	expectedSize := conduit.ClaimNextChunk()
-	if expectedSize < 0 {
-		http.Error(w, "No chunk expected", http.StatusBadRequest)
-		return
+	// The socket is made with the umask: it's bound in a directory that only
+	// the user can enter, and moved in place once it's only for the user, so
+	// that nobody else can connect in between
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".fileway-admin-")
+	if err != nil {
+		return nil, err
 	}
-	// Read one byte past the plan so an oversized body is detected rather than
-	// silently truncated.
-	content, err := io.ReadAll(io.LimitReader(r.Body, int64(expectedSize)+1))
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", bound)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	if len(content) > expectedSize {
-		http.Error(w, "Chunk exceeds declared size", http.StatusBadRequest)
-		return
+	// Close would unlink it where it was bound; where it is, it's replaced
+	// by the next run
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, 0o600); err != nil {
+		listener.Close()
+		return nil, err
 	}
-
-	if err := conduit.Offer(content); err != nil {
-		// An expired conduit is reported as 410 everywhere, matching ping, so
-		// clients can tell "this transfer is over" from "this chunk stalled".
-		if errors.Is(err, fw.ErrConduitExpired) {
-			http.Error(w, err.Error(), http.StatusGone)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusRequestTimeout)
-		return
+	if err := os.Rename(bound, path); err != nil {
+		listener.Close()
+		return nil, err
 	}
+	return listener, nil
 }
 
-func serveCLIUploader(w http.ResponseWriter, r *http.Request) {
-	scheme := "http"
-	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
-		scheme = "https"
-	}
-	base_url := fmt.Sprintf("%s://%s", scheme, r.Host)
-	ret := utils.Replace(cliUploader, "#BASE_URL#", base_url)
-
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename=\"fileway_ul.py\"")
-	w.Write(ret)
+func fatal(msg string) {
+	slog.Error("FATAL: "+msg, "event", "fatal")
+	os.Exit(1)
 }
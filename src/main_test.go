@@ -14,286 +14,125 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
-	"crypto/rand"
-	"encoding/json"
 	"net/http"
-	"net/http/httptest"
-	"strconv"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
-	"time"
 
-	"github.com/proofrock/fileway/auth"
-	fw "github.com/proofrock/fileway/fileway_logic"
+	"github.com/proofrock/fileway/server"
 )
 
-// A bcrypt hash of "mysecret", same as the one used by the bats suite.
-const testSecretHash = `$2a$10$I.NhoT1acD9XkXmXn1IMSOp0qhZDd63iSw1RfHZP7nzyg/ItX5eVa`
-
-func setupTestServer() {
-	authenticator = auth.NewAuth(testSecretHash)
-	conduits = fw.NewConduitSet(3600)
-}
-
-const maxSize = 4 * 1024 * 1024 * 1024 * 1024
-
-// Sizes outside the supported range are refused at setup time.
-func TestSetupRejectsInvalidSizes(t *testing.T) {
-	setupTestServer()
-
-	cases := []struct {
-		size string
-		want int
-	}{
-		{"0", http.StatusBadRequest},
-		{"-1", http.StatusBadRequest},
-		{"abc", http.StatusBadRequest},
-		{"1", http.StatusOK},
-		{strconv.FormatInt(maxSize, 10), http.StatusOK},
-		{strconv.FormatInt(maxSize+1, 10), http.StatusBadRequest},
-	}
-	for _, c := range cases {
-		r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size="+c.size, nil)
-		r.Header.Set("x-fileway-secret", "mysecret")
-		w := httptest.NewRecorder()
-		setup(w, r)
-		if w.Code != c.want {
-			t.Errorf("size=%s -> HTTP %d, want %d", c.size, w.Code, c.want)
+// The zip must have the layout fileway_ul.py produces, since recipients don't
+// know which client sent it: files at the root, dirs as a subtree.
+func TestWriteZipLayout(t *testing.T) {
+	dir := t.TempDir()
+	mustWrite := func(path string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
 		}
 	}
-}
-
-// A chunk larger than the plan allows must be refused, not buffered.
-func TestUploadRejectsOversizedChunk(t *testing.T) {
-	setupTestServer()
-
-	id := conduits.NewConduit(false, "a.bin", 5, "mysecret", 4096, 4, 16)
-	body := strings.Repeat("X", 5000)
-
-	r := httptest.NewRequest("PUT", "/ul/"+id, strings.NewReader(body))
-	r.Header.Set("x-fileway-secret", "mysecret")
-	w := httptest.NewRecorder()
-	ul(w, r)
+	mustWrite(filepath.Join(dir, "a.txt"))
+	mustWrite(filepath.Join(dir, "sub", "b.txt"))
+	mustWrite(filepath.Join(dir, "sub", "deeper", "c.txt"))
 
-	if w.Code != http.StatusBadRequest {
-		t.Errorf("oversized chunk -> HTTP %d, want %d", w.Code, http.StatusBadRequest)
+	var buf bytes.Buffer
+	if err := writeZip(&buf, []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "sub") + "/"}); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// A conduit that expires while chunks are still buffered must still deliver
-// them: the downloader was promised Content-Length bytes and silently getting
-// fewer corrupts the file.
-func TestDownloadDeliversBufferedChunksOnExpiry(t *testing.T) {
-	setupTestServer()
-
-	const rounds = 200
-	truncated := 0
-	for i := 0; i < rounds; i++ {
-		id := conduits.NewConduit(false, "a.bin", 12, "mysecret", 4096, 4, 16)
-		conduit := conduits.GetConduit(id)
 
-		// The uploader delivered everything and went away; the chunks sit in
-		// the buffer waiting for a slow downloader.
-		conduit.ChunkQueue <- []byte("aaaa")
-		conduit.ChunkQueue <- []byte("bbbb")
-		conduit.ChunkQueue <- []byte("cccc")
-
-		// The cleanup ticker fires right now.
-		conduit.Expire()
-
-		// ddl() claims the download itself, so it must not be claimed here.
-		r := httptest.NewRequest("GET", "/ddl/"+id, nil)
-		w := httptest.NewRecorder()
-		ddl(w, r)
-
-		if w.Body.Len() != 12 {
-			truncated++
-		}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	if truncated > 0 {
-		t.Errorf("%d/%d downloads were truncated despite the chunks being buffered", truncated, rounds)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
 	}
-}
-
-// Streaming a chunk must keep the conduit alive, otherwise a download slower
-// than UPLOAD_TIMEOUT_SECS is killed by the cleanup ticker halfway through.
-func TestDownloadKeepsConduitAlive(t *testing.T) {
-	setupTestServer()
-
-	id := conduits.NewConduit(false, "a.bin", 8, "mysecret", 4096, 4, 16)
-	conduit := conduits.GetConduit(id)
-
-	// ddl() claims the download itself, so it must not be claimed here.
-	finished := make(chan struct{})
-	go func() {
-		r := httptest.NewRequest("GET", "/ddl/"+id, nil)
-		ddl(httptest.NewRecorder(), r)
-		close(finished)
-	}()
-
-	// Let ddl() get past Download(), which touches the conduit on its own: the
-	// cutoff has to sit after that, or it would measure the wrong touch.
-	time.Sleep(30 * time.Millisecond)
-	cutoff := time.Now().UnixMilli()
-	time.Sleep(5 * time.Millisecond)
-
-	conduit.ChunkQueue <- []byte("aaaa")
-	time.Sleep(30 * time.Millisecond)
-
-	alive := conduit.WasAccessedAfter(cutoff)
-	conduit.ChunkQueue <- []byte("bbbb")
-	<-finished
-
-	if !alive {
-		t.Error("streaming a chunk did not touch the conduit; a slow transfer would expire mid-flight")
+	sort.Strings(names)
+	want := []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"}
+	if len(names) != len(want) {
+		t.Fatalf("got %v, want %v", names, want)
 	}
-}
-
-// An expired conduit must be reported as 410 by /ul/ too, not as a 408 that
-// clients would read as a transient stall.
-func TestUploadOnExpiredConduitIsGone(t *testing.T) {
-	setupTestServer()
-
-	id := conduits.NewConduit(false, "a.bin", 8, "mysecret", 4096, 1, 16)
-	conduit := conduits.GetConduit(id)
-	conduit.ChunkQueue <- []byte("full") // fill the queue so Offer() must block
-	conduit.Expire()
-
-	r := httptest.NewRequest("PUT", "/ul/"+id, strings.NewReader("aaaa"))
-	r.Header.Set("x-fileway-secret", "mysecret")
-	w := httptest.NewRecorder()
-	ul(w, r)
-
-	if w.Code != http.StatusGone {
-		t.Errorf("ul on expired conduit -> HTTP %d, want %d", w.Code, http.StatusGone)
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got %v, want %v", names, want)
+		}
 	}
 }
 
-// A conduit that expires while ping is parked on it must come back as 410, and
-// come back immediately - not sit there until the 20s long-poll runs out, and not
-// hand over a chunk plan the uploader can no longer use.
-func TestPingReportsExpiryAsGone(t *testing.T) {
-	setupTestServer()
-
-	id := conduits.NewConduit(false, "a.bin", 8, "mysecret", 4096, 1, 16)
-	conduit := conduits.GetConduit(id)
-
-	r := httptest.NewRequest("GET", "/ping/"+id, nil)
-	r.Header.Set("x-fileway-secret", "mysecret")
-	w := httptest.NewRecorder()
-
-	returned := make(chan struct{})
-	go func() {
-		defer close(returned)
-		ping(w, r)
-	}()
-
-	// Give ping time to reach the select, then expire the conduit under it.
-	time.Sleep(50 * time.Millisecond)
-	conduit.Expire()
-
-	select {
-	case <-returned:
-	case <-time.After(5 * time.Second):
-		t.Fatal("ping did not return once the conduit expired; it is waiting out the full long-poll")
+// The creds file is shared with fileway_ul.py, which XORs each character.
+func TestObfuscateMatchesPython(t *testing.T) {
+	// python3 -c "print(''.join(chr(ord(c) ^ 17) for c in 'mysecret'))"
+	if got := obfuscate("mysecret"); got != "|hbtrcte" {
+		t.Errorf("got %q", got)
 	}
-
-	if w.Code != http.StatusGone {
-		t.Errorf("ping on a conduit that expired while waiting -> HTTP %d, want %d", w.Code, http.StatusGone)
+	if got := obfuscate(obfuscate("sécret")); got != "sécret" {
+		t.Errorf("not its own inverse: %q", got)
 	}
 }
 
-// With a download started and the conduit expired, both channels ping selects on
-// are closed, and select picks among ready cases at random. Expiry has to win
-// every time, not half the time - hence the repetition.
-func TestPingPrefersExpiryOverStartedPlan(t *testing.T) {
-	setupTestServer()
-
-	id := conduits.NewConduit(false, "a.bin", 8, "mysecret", 4096, 1, 16)
-	conduit := conduits.GetConduit(id)
-	if err := conduit.Download(); err != nil {
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "warn")
+	if err != nil {
 		t.Fatal(err)
 	}
-	conduit.Expire()
+	logger.Info("hidden")
+	logger.Warn("shown", "event", "test")
+	if got := buf.String(); strings.Contains(got, "hidden") || !strings.HasPrefix(got, "{") || !strings.Contains(got, `"event":"test"`) {
+		t.Errorf("got %q", got)
+	}
 
-	for i := 0; i < 50; i++ {
-		r := httptest.NewRequest("GET", "/ping/"+id, nil)
-		r.Header.Set("x-fileway-secret", "mysecret")
-		w := httptest.NewRecorder()
-		ping(w, r)
-		if w.Code != http.StatusGone {
-			t.Fatalf("attempt %d: ping -> HTTP %d, want %d", i, w.Code, http.StatusGone)
+	for _, bad := range [][2]string{{"xml", ""}, {"", "loud"}} {
+		if _, err := newLogger(&buf, bad[0], bad[1]); err == nil {
+			t.Errorf("format %q, level %q: no error", bad[0], bad[1])
 		}
 	}
 }
 
-// The whole transfer protocol in-process: setup, the downloader connecting,
-// ping handing out the plan, every chunk uploaded, and the payload arriving
-// byte-identical. Sizes straddle the ramp boundaries, including the exact
-// multiples that used to produce a trailing zero-length chunk.
-func TestTransferRoundTrip(t *testing.T) {
-	setupTestServer()
-
-	for _, size := range []int{1, 4095, 4096, 4097, 12288, 100000, 1000000} {
-		payload := make([]byte, size)
-		if _, err := rand.Read(payload); err != nil {
-			t.Fatal(err)
-		}
-
-		r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size="+strconv.Itoa(size), nil)
-		r.Header.Set("x-fileway-secret", "mysecret")
-		w := httptest.NewRecorder()
-		setup(w, r)
-		if w.Code != http.StatusOK {
-			t.Fatalf("size=%d: setup -> HTTP %d", size, w.Code)
-		}
-		id := w.Body.String()
-
-		downloaded := make(chan []byte, 1)
-		go func() {
-			ww := httptest.NewRecorder()
-			ddl(ww, httptest.NewRequest("GET", "/ddl/"+id, nil))
-			downloaded <- ww.Body.Bytes()
-		}()
-		time.Sleep(30 * time.Millisecond) // let the downloader claim it
-
-		pr := httptest.NewRequest("GET", "/ping/"+id, nil)
-		pr.Header.Set("x-fileway-secret", "mysecret")
-		pw := httptest.NewRecorder()
-		ping(pw, pr)
-		if pw.Code != http.StatusOK {
-			t.Fatalf("size=%d: ping -> HTTP %d", size, pw.Code)
-		}
-		var plan []int
-		if err := json.Unmarshal(pw.Body.Bytes(), &plan); err != nil {
-			t.Fatalf("size=%d: bad plan: %v", size, err)
-		}
+// fileway admin reaches the admin API on a unix socket.
+func TestAdminOnUnixSocket(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.SecretHashes = `$2a$10$I.NhoT1acD9XkXmXn1IMSOp0qhZDd63iSw1RfHZP7nzyg/ItX5eVa` // mysecret
+	cfg.AdminSecretHashes = cfg.SecretHashes
+	s, err := server.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
 
-		off := 0
-		for i, cs := range plan {
-			if cs == 0 {
-				t.Errorf("size=%d: plan contains a zero-length chunk at %d", size, i)
-			}
-			ur := httptest.NewRequest("PUT", "/ul/"+id, bytes.NewReader(payload[off:off+cs]))
-			ur.Header.Set("x-fileway-secret", "mysecret")
-			uw := httptest.NewRecorder()
-			ul(uw, ur)
-			if uw.Code != http.StatusOK {
-				t.Fatalf("size=%d: chunk %d/%d (%d bytes) -> HTTP %d %q",
-					size, i+1, len(plan), cs, uw.Code, uw.Body.String())
-			}
-			off += cs
-		}
+	// Not in TempDir, whose path may be too long for a socket
+	dir, err := os.MkdirTemp("", "fw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "admin.sock")
+	listener, err := listenAdmin("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, s.Admin())
+	defer listener.Close()
 
-		select {
-		case got := <-downloaded:
-			if !bytes.Equal(got, payload) {
-				t.Errorf("size=%d: payload mismatch (%d bytes received)", size, len(got))
-			}
-		case <-time.After(3 * time.Second):
-			t.Errorf("size=%d: the download never completed", size)
-		}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket: %v, %v", fi.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left in the directory: %v", entries)
+	}
+	ret, err := adminRequest("unix:"+socket, "mysecret", "PUT", "/drain", strings.NewReader(`{"drain":true}`))
+	if err != nil || string(ret) != `{"drain":true}` || !s.Draining() {
+		t.Errorf("got %q, %v", ret, err)
+	}
+	if _, err := adminRequest("unix:"+socket, "wrong", "GET", "/conduits", nil); err == nil {
+		t.Error("a wrong secret was accepted")
 	}
 }
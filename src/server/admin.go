@@ -0,0 +1,125 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	fw "github.com/proofrock/fileway/fileway_logic"
+)
+
+// The admin API, to see and manage the transfers under way; see server.adoc,
+// "Admin API". It's not among the routes of the Server: it's meant for a
+// listener of its own, that is not exposed, so it's served by Admin. The
+// transfers are known by their fingerprints, as in the logs, since their ids
+// would let the admin download them.
+
+// Admin returns the handler of the admin API. It refuses everything unless
+// Config.AdminSecretHashes is set.
+func (s *Server) Admin() http.Handler {
+	mux := http.NewServeMux()
+	// The handlers get who the admin is, as the position of their secret
+	handle := func(pattern string, handler func(http.ResponseWriter, *http.Request, int)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if s.adminAuthenticator == nil {
+				http.Error(w, "The admin API is not enabled", http.StatusForbidden)
+				return
+			}
+			admin, ok := s.adminAuthenticator.Identify(r.Header.Get("x-fileway-secret"))
+			if !ok {
+				logEvent(r, slog.LevelWarn, "Wrong admin secret", "admin_auth_failed", nil)
+				http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+				return
+			}
+			handler(w, r, admin)
+		})
+	}
+	handle("GET /conduits", s.adminList)
+	handle("GET /conduits/{fingerprint}", s.adminShow)
+	handle("DELETE /conduits/{fingerprint}", s.adminExpire)
+	handle("GET /drain", s.adminDrain)
+	handle("PUT /drain", s.adminDrain)
+	return mux
+}
+
+// Draining reports whether the server refuses new transfers, while those
+// under way go on; see SetDraining.
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// SetDraining makes the server refuse new transfers, e.g. before a restart,
+// or accept them again.
+func (s *Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+func (s *Server) adminList(w http.ResponseWriter, _ *http.Request, _ int) {
+	writeJSON(w, s.conduits.List())
+}
+
+func (s *Server) adminShow(w http.ResponseWriter, r *http.Request, _ int) {
+	conduit := s.conduits.GetConduitByFingerprint(r.PathValue("fingerprint"))
+	if conduit == nil {
+		http.Error(w, "Conduit Not Found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, conduit.Info())
+}
+
+// Expires a transfer right away, as if it was idle for too long: the
+// uploader, and the downloaders, get what they get in that case.
+func (s *Server) adminExpire(w http.ResponseWriter, r *http.Request, admin int) {
+	conduit := s.conduits.GetConduitByFingerprint(r.PathValue("fingerprint"))
+	if conduit == nil {
+		http.Error(w, "Conduit Not Found", http.StatusNotFound)
+		return
+	}
+	logEvent(r, slog.LevelInfo, "Transfer expired by an admin", "conduit_expired_by_admin", conduit,
+		slog.Int("admin", admin), slog.String("state", conduit.State()))
+	s.conduits.DelConduit(conduit.Id)
+	conduit.End(fw.PhaseExpired, fw.ReasonExpiredByAdmin, "expired by an admin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET tells whether the server is draining; PUT, with {"drain":true} or
+// {"drain":false}, sets it.
+func (s *Server) adminDrain(w http.ResponseWriter, r *http.Request, admin int) {
+	var drain struct {
+		Drain bool `json:"drain"`
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&drain); err != nil {
+			http.Error(w, "Invalid body: must be {\"drain\":true} or {\"drain\":false}", http.StatusBadRequest)
+			return
+		}
+		s.SetDraining(drain.Drain)
+		logEvent(r, slog.LevelInfo, "Draining set by an admin", "drain", nil,
+			slog.Int("admin", admin), slog.Bool("drain", drain.Drain))
+	}
+	drain.Drain = s.Draining()
+	writeJSON(w, drain)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	ret, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Marshaling issue", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(ret)
+}
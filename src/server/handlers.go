@@ -0,0 +1,1195 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	fw "github.com/proofrock/fileway/fileway_logic"
+	"github.com/proofrock/fileway/utils"
+)
+
+func serveFile(file []byte, contentType string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(file)
+	}
+}
+
+// Checks an uploader's secret, and counts it in the metrics. It returns whose
+// it is; see auth.Identify.
+func (s *Server) authenticate(secret string) (int, bool) {
+	identity, ok := s.authenticator.Identify(secret)
+	if ok {
+		s.metrics.authSuccesses.Add(1)
+	} else {
+		s.metrics.authFailures.Add(1)
+	}
+	return identity, ok
+}
+
+// Logs an event, with the attributes that all the lines have: the event, the
+// conduit if any (see fw.Conduit.LogAttrs; never its id), and where the
+// request comes from.
+func logEvent(r *http.Request, level slog.Level, msg, event string, conduit *fw.Conduit, attrs ...any) {
+	all := []any{slog.String("event", event)}
+	if conduit != nil {
+		all = append(all, conduit.LogAttrs()...)
+	}
+	all = append(all, slog.String("remote", r.RemoteAddr))
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		all = append(all, slog.String("forwarded_for", fwd))
+	}
+	slog.Log(r.Context(), level, msg, append(all, attrs...)...)
+}
+
+func (s *Server) getConduit(r *string) *fw.Conduit {
+	return s.conduits.GetConduit(lastElem(*r))
+}
+
+func lastElem(path string) string {
+	parts := strings.Split(path, "/")
+	return parts[len(parts)-1]
+}
+
+// This is the basic handler for downloads; it shows a download page
+// unless the user agent "appears" to come from a CLI application.
+// In this case, forwards control to ddl(w, r) that directly downloads
+// the payload.
+func (s *Server) dl(w http.ResponseWriter, r *http.Request) {
+	switch strings.Split(r.UserAgent(), "/")[0] {
+	case "curl", "Wget", "HTTPie", "aria2", "Axel":
+		s.ddl(w, r)
+	default:
+		conduit := s.getConduit(&r.URL.Path)
+		if conduit == nil {
+			if result, ok := s.conduits.Tombstone(lastElem(r.URL.Path)); ok {
+				s.serveGonePage(w, &result.Transition)
+			} else {
+				s.serveGonePage(w, nil)
+			}
+			return
+		}
+		if conduit.IsOver() {
+			outcome := conduit.Outcome()
+			s.serveGonePage(w, &outcome)
+			return
+		}
+
+		var _downloadPage []byte
+		if conduit.IsText {
+			_downloadPage = s.downloadPageForTxt
+		} else {
+			size := utils.HumanReadableSize(conduit.PayloadSize())
+			if conduit.IsStream() {
+				size = "size not known yet"
+			}
+			fileString := fmt.Sprintf("%s (%s)", html.EscapeString(conduit.Filename), size)
+			_downloadPage = utils.Replace(s.downloadPage, "#FILE_INFO#", fileString)
+		}
+
+		// An end-to-end encrypted payload is decrypted by the page, that needs
+		// to know what it gets. json.Marshal escapes what could close the
+		// <script> it goes in.
+		e2eInfo := []byte("null")
+		if conduit.E2E {
+			var err error
+			e2eInfo, err = json.Marshal(map[string]any{"filename": conduit.Filename, "size": conduit.Size})
+			if err != nil {
+				http.Error(w, "Marshaling issue", http.StatusInternalServerError)
+				return
+			}
+		}
+		_downloadPage = utils.Replace(_downloadPage, "#E2E_INFO#", string(e2eInfo))
+
+		serveFile(_downloadPage, "text/html")(w, r)
+	}
+}
+
+// direct download of the payload
+func (s *Server) ddl(w http.ResponseWriter, r *http.Request) {
+	conduit := s.getConduit(&r.URL.Path)
+	if conduit == nil {
+		s.notFound(w, lastElem(r.URL.Path))
+		return
+	}
+	s.download(w, r, conduit)
+}
+
+// Direct download from a named pipe: if no upload is on it yet, it waits for
+// one, for PipeWait. See fw.ConduitSet.Pipe.
+func (s *Server) pipe(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !validPipeName(name) {
+		http.Error(w, "Invalid pipe name", http.StatusBadRequest)
+		return
+	}
+	conduit := s.conduits.WaitPipe(r.Context(), name, s.cfg.PipeWait)
+	if conduit == nil {
+		if r.Context().Err() == nil {
+			http.Error(w, "Nothing was sent on this pipe in time", http.StatusNotFound)
+		}
+		return
+	}
+	s.download(w, r, conduit)
+}
+
+// A pipe name is agreed in advance, and goes in paths and in shell scripts:
+// letters, digits, '.', '-' and '_', up to 64 of them.
+func validPipeName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Streams the payload of conduit to a downloader; see ddl.
+func (s *Server) download(w http.ResponseWriter, r *http.Request, conduit *fw.Conduit) {
+	// A downloader that lost the connection comes back asking for the rest
+	// (curl -C -, a browser resuming). The ETag lets a browser check that it's
+	// still the same payload; it must not give away the id, which is the
+	// capability, so it's a hash of it.
+	idHash := sha256.Sum256([]byte(conduit.Id))
+	etag := fmt.Sprintf(`"%x"`, idHash[:16])
+	// A stream can't be resumed: where would a range end?
+	from, isRange := int64(0), false
+	if !conduit.IsStream() {
+		from, isRange = parseRange(r.Header.Get("Range"), conduit.Size)
+	}
+	if ifRange := r.Header.Get("If-Range"); isRange && ifRange != "" && ifRange != etag {
+		from, isRange = 0, false
+	}
+
+	if conduit.IsSpooled() {
+		s.ddlSpooled(w, r, conduit, etag, from, isRange)
+		return
+	}
+
+	downloader, replay, err := conduit.Attach(from)
+	if errors.Is(err, fw.ErrRangeNotSatisfiable) && !isRange {
+		// Not a resume, but a new download of one that is under way
+		err = fw.ErrConduitAlreadyDownloading
+	}
+	if errors.Is(err, fw.ErrRangeNotSatisfiable) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", conduit.Size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil && conduit.IsOver() {
+		writeOver(w, conduit.Outcome())
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	// What this request sends is timed from when it comes, or when the
+	// download starts, if it's after
+	start := time.Now()
+
+	// Without a declared digest, the one of what's sent is given at the end,
+	// as a trailer; HTTP/1.1 can't have one along with a Content-Length. A
+	// stream has no Content-Length, and is sent chunked: the trailers tell
+	// its size, once it's known, and that it's complete.
+	withTrailer := conduit.Digest() == nil && (r.ProtoMajor >= 2 || conduit.IsStream())
+	switch {
+	case conduit.IsStream():
+		w.Header().Set("Trailer", "Repr-Digest, X-Fileway-Size, X-Fileway-Status")
+	case withTrailer:
+		w.Header().Set("Trailer", "Repr-Digest")
+	}
+	writeDownloadHeaders(w, conduit, etag, from, isRange, s.conduits.ResumeEnabled() && !conduit.IsStream())
+
+	transferred := from
+	defer func() { s.metrics.relayedBytes.Add(transferred - from) }()
+	// The end of what was already delivered, before the disconnection, is
+	// written again: it may have been lost in flight.
+	for _, chunk := range replay {
+		if _, err := w.Write(chunk); err != nil {
+			logEvent(r, slog.LevelWarn, "Error writing to the downloader", "write_failed", conduit,
+				slog.Int64("bytes", transferred), slog.Any("error", err))
+			s.releaseDownload(r, conduit, downloader, transferred)
+			return
+		}
+		transferred += int64(len(chunk))
+	}
+
+	// Hands a chunk to the downloader. The last one is not written if the
+	// payload doesn't match the declared digest, and the connection is
+	// aborted: the downloader sees a failed transfer, not a wrong file.
+	deliver := func(chunk []byte) error {
+		downloader.Delivered(chunk)
+		if downloader.DigestMismatch() {
+			logEvent(r, slog.LevelWarn, "The payload doesn't match the declared digest", "digest_mismatch", conduit)
+			downloader.Drop()
+			s.conduits.DelConduit(conduit.Id)
+			conduit.End(fw.PhaseFailed, fw.ReasonDigestMismatch, "the payload doesn't match the declared digest")
+			panic(http.ErrAbortHandler)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		transferred += int64(len(chunk))
+		return nil
+	}
+
+	ctx := r.Context()
+	streamEnd := conduit.StreamEnd // nil, and never ready, if it's not a stream
+loop:
+	for !conduit.IsWhole(transferred) {
+		select {
+		case <-streamEnd:
+			// The loop ends once what was sent before the end is delivered
+			streamEnd = nil
+		case <-ctx.Done():
+			logEvent(r, slog.LevelInfo, "Downloader disconnected", "downloader_disconnected", conduit,
+				slog.Int64("bytes", transferred))
+			break loop
+		case chunk, ok := <-downloader.Chunks():
+			if !ok || len(chunk) == 0 {
+				break loop
+			}
+			if err := deliver(chunk); err != nil {
+				logEvent(r, slog.LevelWarn, "Error writing to the downloader", "write_failed", conduit,
+					slog.Int64("bytes", transferred), slog.Any("error", err))
+				break loop
+			}
+			conduit.Touch() // a slow but progressing transfer must not expire
+		case <-conduit.Done:
+			// Cancelled, nothing more is owed: the body falls short, and the
+			// downloader sees a failed transfer.
+			if conduit.Phase() == fw.PhaseCancelled {
+				logEvent(r, slog.LevelInfo, "Transfer cancelled during the download", "cancelled_during_download", conduit,
+					slog.Int64("bytes", transferred))
+				break loop
+			}
+			// The conduit is over otherwise. Whatever the uploader already handed over is
+			// still owed to the downloader, so drain the buffer before giving up:
+			// select picks a ready case at random, so without this the buffered
+			// chunks would be dropped and the body would silently fall short of
+			// the Content-Length we announced.
+			for !conduit.IsWhole(transferred) {
+				var chunk []byte
+				select {
+				case chunk = <-downloader.Chunks():
+				default:
+					logEvent(r, slog.LevelWarn, "Transfer expired during the download", "expired_during_download", conduit,
+						slog.Int64("bytes", transferred))
+					break loop
+				}
+				if len(chunk) == 0 {
+					break loop
+				}
+				if err := deliver(chunk); err != nil {
+					logEvent(r, slog.LevelWarn, "Error writing to the downloader", "write_failed", conduit,
+						slog.Int64("bytes", transferred), slog.Any("error", err))
+					break loop
+				}
+			}
+		}
+	}
+
+	complete := conduit.IsWhole(transferred)
+	if complete {
+		if withTrailer {
+			w.Header().Set("Repr-Digest", formatDigest(downloader.Sum()))
+		}
+		if conduit.IsStream() {
+			w.Header().Set("X-Fileway-Size", strconv.FormatInt(transferred, 10))
+			w.Header().Set("X-Fileway-Status", "complete")
+		}
+		if started := conduit.StartedAt(); started.After(start) {
+			start = started
+		}
+		s.metrics.observeDownload(transferred-from, start)
+		logEvent(r, slog.LevelInfo, "Download completed", "download_completed", conduit,
+			slog.Int64("bytes", transferred-from), slog.Duration("duration", time.Since(start)))
+	}
+	s.releaseDownload(r, conduit, downloader, transferred)
+	// Without a Content-Length, a body that falls short looks complete, if
+	// it ends well: the connection is aborted, so that the downloader sees
+	// a failed transfer.
+	if conduit.IsStream() && !complete {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func writeDownloadHeaders(w http.ResponseWriter, conduit *fw.Conduit, etag string, from int64, isRange, resumable bool) {
+	var contentType string
+	if conduit.IsText {
+		contentType = "text/plain"
+	} else {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": conduit.Filename}))
+	if !conduit.IsStream() {
+		w.Header().Set("Content-Length", strconv.FormatInt(conduit.Size-from, 10))
+	}
+	w.Header().Set("ETag", etag)
+	if conduit.E2E {
+		// What follows is sealed, and the downloader must open it
+		w.Header().Set("X-Fileway-E2E", "1")
+	}
+	if digest := conduit.Digest(); digest != nil {
+		w.Header().Set("Repr-Digest", formatDigest(digest))
+	}
+	if resumable {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	if isRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, conduit.Size-1, conduit.Size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+}
+
+// Direct download of a spooled payload, from the disk. It can start before the
+// upload is over, and then follows it; and since the whole payload is kept
+// until it's downloaded, it can be resumed from anywhere.
+func (s *Server) ddlSpooled(w http.ResponseWriter, r *http.Request, conduit *fw.Conduit, etag string, from int64, isRange bool) {
+	if err := conduit.AttachSpool(); err != nil && conduit.IsOver() {
+		writeOver(w, conduit.Outcome())
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	writeDownloadHeaders(w, conduit, etag, from, isRange, true)
+
+	ctx := r.Context()
+	buf := make([]byte, 256*1024)
+	start := time.Now()
+	transferred := from
+	defer func() { s.metrics.relayedBytes.Add(transferred - from) }()
+loop:
+	for transferred < conduit.Size {
+		// The spool is gone with the conduit
+		if conduit.IsOver() {
+			logEvent(r, slog.LevelWarn, "Transfer expired during the download", "expired_during_download", conduit,
+				slog.Int64("bytes", transferred))
+			break
+		}
+		n, grown, err := conduit.ReadSpool(buf, transferred)
+		if err != nil {
+			logEvent(r, slog.LevelError, "Error reading the spool", "spool_read_failed", conduit, slog.Any("error", err))
+			break
+		}
+		if n == 0 {
+			select {
+			case <-grown:
+				continue
+			case <-ctx.Done():
+				logEvent(r, slog.LevelInfo, "Downloader disconnected", "downloader_disconnected", conduit,
+					slog.Int64("bytes", transferred))
+				break loop
+			case <-conduit.Done:
+				logEvent(r, slog.LevelWarn, "Transfer expired during the download", "expired_during_download", conduit,
+					slog.Int64("bytes", transferred))
+				break loop
+			}
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			logEvent(r, slog.LevelWarn, "Error writing to the downloader", "write_failed", conduit,
+				slog.Int64("bytes", transferred), slog.Any("error", err))
+			break
+		}
+		conduit.Touch()
+		transferred += int64(n)
+	}
+
+	if transferred >= conduit.Size {
+		s.metrics.observeDownload(transferred-from, start)
+		logEvent(r, slog.LevelInfo, "Download completed", "download_completed", conduit,
+			slog.Int64("bytes", transferred-from), slog.Duration("duration", time.Since(start)))
+	}
+	if conduit.ReleaseSpool(transferred) {
+		s.conduits.DelConduit(conduit.Id)
+	}
+}
+
+// Called when a download ends, well or not. A complete or expired transfer is
+// forgotten, once its last downloader is done, and it ends as Completed or
+// Failed; an interrupted one waits for its downloader to come back, if
+// resuming is enabled.
+func (s *Server) releaseDownload(r *http.Request, conduit *fw.Conduit, downloader *fw.Downloader, transferred int64) {
+	if conduit.IsWhole(transferred) || conduit.IsOver() || !s.conduits.ResumeEnabled() || conduit.IsStream() {
+		if downloader.Drop() {
+			s.conduits.DelConduit(conduit.Id)
+			// Of several downloaders, one that went away before the end
+			// fails the transfer
+			delivered := min(transferred, conduit.DeliveredBytes())
+			if conduit.IsWhole(delivered) {
+				conduit.End(fw.PhaseCompleted, fw.ReasonDelivered, "delivered")
+			} else if conduit.End(fw.PhaseFailed, fw.ReasonDownloaderDisconnected,
+				"downloader disconnected at "+conduit.Percent(delivered)) {
+				// Nobody is left to take the rest: the uploader is told now,
+				// rather than when its chunk times out.
+				logEvent(r, slog.LevelInfo, "Transfer failed, no downloader left", "conduit_failed", conduit,
+					slog.String("reason", fw.ReasonDownloaderDisconnected), slog.Int64("bytes", transferred))
+			}
+		}
+		return
+	}
+	logEvent(r, slog.LevelInfo, "Waiting for the downloader to resume", "download_detached", conduit,
+		slog.Int64("bytes", transferred))
+	downloader.Detach()
+}
+
+// Formats a SHA-256 as an RFC 9530 digest, for Repr-Digest.
+func formatDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Gets the SHA-256 out of an RFC 9530 Content-Digest or Repr-Digest header,
+// e.g. "sha-256=:X48E9q...=:"; nil if there is none. Other algorithms are
+// ignored.
+func parseDigest(header string) []byte {
+	for _, member := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || alg != "sha-256" || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err == nil && len(sum) == sha256.Size {
+			return sum
+		}
+	}
+	return nil
+}
+
+// Parses a Range header for the only form a resume uses, "bytes=N-", or
+// "bytes=N-M" with M the last byte. Anything else is ignored, which per
+// RFC 9110 means serving the whole payload.
+func parseRange(header string, size int64) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, false
+	}
+	from, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || from < 0 || from >= size {
+		return 0, false
+	}
+	if last != "" {
+		if to, err := strconv.ParseInt(last, 10, 64); err != nil || to < size-1 {
+			return 0, false
+		}
+	}
+	return from, true
+}
+
+func (s *Server) setup(w http.ResponseWriter, r *http.Request) {
+	qry := r.URL.Query()
+
+	identity, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+
+	var filename string
+	sizeStr := qry.Get("size")
+	isText := qry.Get("txt") == "1"
+	if isText {
+		filename = fmt.Sprintf("fileway_%s.txt", utils.NowString())
+	} else {
+		filename = qry.Get("filename")
+	}
+	// A stream has no size: it ends when the uploader says so
+	stream := qry.Get("stream") == "1"
+	if (sizeStr == "" && !stream) || filename == "" {
+		http.Error(w, "Missing required parameter", http.StatusBadRequest)
+		return
+	}
+
+	// The size is the one of the payload: if it's end-to-end encrypted, the
+	// conduit accounts for the encryption on its own.
+	size := int64(-1)
+	if stream && sizeStr != "" {
+		http.Error(w, "A stream can't have a size", http.StatusBadRequest)
+		return
+	} else if !stream {
+		var err error
+		size, err = strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Non-numeric size", http.StatusBadRequest)
+			return
+		}
+
+		if size <= 0 || size > MaxSizeBytes {
+			http.Error(w, "Invalid size: must be between 1 byte and 4 TiB", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// An uploader that knows adaptive plans says so, as it does at ping
+	conduit := s.openConduit(w, r, identity, filename, size, isText, planVersion(r) >= fw.ChunkPlanVersion)
+	if conduit == nil {
+		return
+	}
+	_, _ = w.Write([]byte(conduit.Id))
+}
+
+// Checks the secret of a new transfer, and that the server takes them; the
+// identity is the one of the secret. If not, the answer is written already.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	identity, ok := s.authenticate(r.Header.Get("x-fileway-secret"))
+	if !ok {
+		logEvent(r, slog.LevelWarn, "Wrong secret", "auth_failed", nil)
+		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	// An admin asked not to take new transfers, e.g. before a restart
+	if s.Draining() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "The server is not accepting new transfers, retry later", http.StatusServiceUnavailable)
+		return 0, false
+	}
+	return identity, true
+}
+
+// Refuses a new transfer, because the server has too many, or its memory is
+// all in use (see Config.MaxConduits): it's for a while, so it's 503 with a
+// Retry-After. The memory is given back as the downloaders read, the places
+// as the transfers end.
+func (s *Server) refuse(w http.ResponseWriter, r *http.Request, err error) {
+	reason, retryAfter := "memory", "10"
+	if errors.Is(err, fw.ErrTooManyConduits) {
+		reason, retryAfter = "conduits", "60"
+	}
+	s.metrics.refused(reason)
+	logEvent(r, slog.LevelWarn, "Transfer refused, the server is busy", "setup_refused", nil, slog.String("reason", reason))
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, "The server is busy: "+err.Error()+", retry later", http.StatusServiceUnavailable)
+}
+
+// Creates the conduit of a new transfer, with the options in the query string
+// of r besides the name and the size (-1 for a stream); with adaptive, its
+// chunk plan is adaptive (see fw.ChunkPlan). If it can't, the answer is
+// written already and it's nil.
+func (s *Server) openConduit(w http.ResponseWriter, r *http.Request, identity int, filename string, size int64, isText, adaptive bool) *fw.Conduit {
+	qry := r.URL.Query()
+	passedSecret := r.Header.Get("x-fileway-secret")
+	stream := size < 0
+
+	var err error
+	downloads := 1
+	if downloadsStr := qry.Get("downloads"); downloadsStr != "" {
+		downloads, err = strconv.Atoi(downloadsStr)
+		if err != nil || downloads < 1 || downloads > MaxDownloads {
+			http.Error(w, fmt.Sprintf("Invalid downloads: must be between 1 and %d", MaxDownloads), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	e2e := qry.Get("e2e") == "1"
+
+	// The uploader may declare the SHA-256 of the payload, that's then
+	// checked as it goes through.
+	var digest []byte
+	if digestStr := qry.Get("sha256"); digestStr != "" {
+		digest, err = hex.DecodeString(digestStr)
+		if err != nil || len(digest) != sha256.Size {
+			http.Error(w, "Invalid sha256: must be 64 hex digits", http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	// On a named pipe, the downloader may already be waiting for it
+	pipe := qry.Get("pipe")
+	if pipe != "" && !validPipeName(pipe) {
+		http.Error(w, "Invalid pipe name: must be up to 64 letters, digits, '.', '-' or '_'", http.StatusBadRequest)
+		return nil
+	}
+
+	// Spooled, the payload goes to disk and the uploader can leave before
+	// the download
+	spooled := qry.Get("spool") == "1"
+
+	// What needs the size up front can't be streamed: the spool reserves it,
+	// the encryption and the digest cover the whole payload before it's sent.
+	if stream && (isText || spooled || e2e || digest != nil) {
+		http.Error(w, "A stream can't be a text, spooled, end-to-end encrypted, or have a sha256", http.StatusBadRequest)
+		return nil
+	}
+	// All set before it's in the set, where List and the metrics see it
+	opts := []fw.ConduitOption{fw.WithDigest(digest), fw.WithIdentity(identity)}
+	if adaptive {
+		opts = append(opts, fw.WithAdaptivePlan(s.cfg.ChunkSizeMin, s.cfg.ChunkSizeMax))
+	}
+	// After the plan, that may not allow it
+	opts = append(opts, fw.WithParallelChunks(s.cfg.ParallelChunks))
+	var conduitId string
+	if spooled {
+		conduitId, err = s.conduits.NewSpooledConduit(isText, e2e, filename, size, passedSecret, s.cfg.ChunkSize, s.cfg.IdsLength, downloads, opts...)
+		switch {
+		case errors.Is(err, fw.ErrSpoolDisabled):
+			http.Error(w, "Spooling is not enabled on this server", http.StatusBadRequest)
+			return nil
+		case errors.Is(err, fw.ErrSpoolFull):
+			http.Error(w, "Not enough spool space", http.StatusInsufficientStorage)
+			return nil
+		case errors.Is(err, fw.ErrTooManyConduits):
+			s.refuse(w, r, err)
+			return nil
+		case err != nil:
+			logEvent(r, slog.LevelError, "Error creating a spool", "spool_create_failed", nil, slog.Any("error", err))
+			http.Error(w, "Error creating the spool", http.StatusInternalServerError)
+			return nil
+		}
+	} else {
+		bqs := s.cfg.BufferQueueSize
+		if isText {
+			bqs = 1
+		}
+		conduitId, err = s.conduits.NewConduit(isText, e2e, filename, size, passedSecret, s.cfg.ChunkSize, bqs, s.cfg.IdsLength, downloads, opts...)
+		if err != nil {
+			s.refuse(w, r, err)
+			return nil
+		}
+	}
+
+	conduit := s.conduits.GetConduit(conduitId)
+	if pipe != "" {
+		// Last, as a downloader may get it at once
+		if err := s.conduits.Pipe(conduitId, pipe); err != nil {
+			s.conduits.DelConduit(conduitId)
+			conduit.End(fw.PhaseFailed, fw.ReasonPipeBusy, "there's already a transfer on the pipe")
+			http.Error(w, "There's already a transfer on this pipe", http.StatusConflict)
+			return nil
+		}
+	}
+	logEvent(r, slog.LevelInfo, "Transfer set up", "conduit_created", conduit,
+		slog.Int("downloads", downloads), slog.Bool("spooled", spooled), slog.Bool("e2e", e2e), slog.Bool("pipe", pipe != ""),
+		slog.Bool("stream", stream))
+	return conduit
+}
+
+func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
+	conduit := s.getConduit(&r.URL.Path)
+	if conduit == nil {
+		s.notFound(w, lastElem(r.URL.Path))
+		return
+	}
+
+	passedSecret := r.Header.Get("x-fileway-secret")
+	if conduit.IsUploadSecretWrong(passedSecret) {
+		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+		return
+	}
+
+	// A spooled upload doesn't wait for anybody. Once it's all on disk the
+	// uploader is told, and can leave.
+	if conduit.IsSpooled() {
+		if conduit.IsStored() {
+			w.Header().Set("X-Fileway-Spool", "stored")
+		} else {
+			w.Header().Set("X-Fileway-Spool", "receiving")
+		}
+		ret, err := planJSON(r, conduit)
+		if err != nil {
+			writePlanError(w, err)
+			return
+		}
+		w.Header().Set("X-Fileway-Phase", string(conduit.Phase()))
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(ret)
+		return
+	}
+
+	// A timer rather than time.After: this returns before the 20s are up whenever
+	// a download shows up, and time.After would keep its timer alive until it
+	// fired anyway. One uploader parks here for the whole wait, so it adds up.
+	timer := time.NewTimer(20 * time.Second)
+	defer timer.Stop()
+
+	var ret []byte
+	select {
+	case <-conduit.Done:
+		writeOver(w, conduit.Outcome())
+		return
+	case <-conduit.Started:
+		// Both channels can be closed by the time we get here, and select picks
+		// among ready cases at random, so the expiry check has to be repeated:
+		// handing out a plan for a conduit that is already gone would send the
+		// uploader into chunks that can only 404.
+		if conduit.IsOver() {
+			writeOver(w, conduit.Outcome())
+			return
+		}
+		_ret, err := planJSON(r, conduit)
+		if err != nil {
+			writePlanError(w, err)
+			return
+		}
+		ret = _ret
+	case <-timer.C: // nobody yet; the uploader will ask again
+		ret = []byte("[]")
+		if planVersion(r) >= fw.ChunkPlanDescribed {
+			ret = []byte("null")
+		}
+	}
+
+	w.Header().Set("X-Fileway-Phase", string(conduit.Phase()))
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(ret)
+}
+
+// The version of fw.ChunkPlan that the uploader knows, as it says in
+// X-Fileway-Plan; 0 if it doesn't, and wants the list.
+func planVersion(r *http.Request) int {
+	version, _ := strconv.Atoi(r.Header.Get("X-Fileway-Plan"))
+	return version
+}
+
+// The plan, described, or listed for the uploaders that don't know its
+// version; the list is as long as the chunks are many, up to a million. An
+// adaptive plan can't be listed: it's fw.ErrPlanAdaptive.
+func planJSON(r *http.Request, conduit *fw.Conduit) ([]byte, error) {
+	switch plan := conduit.ChunkPlan; {
+	case planVersion(r) >= plan.Version:
+		return json.Marshal(plan)
+	case plan.Adaptive:
+		return nil, fw.ErrPlanAdaptive
+	}
+	return json.Marshal(conduit.ChunkPlan.List())
+}
+
+// Answers a plan that planJSON couldn't give.
+func writePlanError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fw.ErrPlanAdaptive) {
+		// Set up by an uploader that knew it, resumed by one that doesn't
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, "Marshaling issue", http.StatusInternalServerError)
+}
+
+// Uploads a chunk, at /ul/{id}/{index} with index its position in the chunk
+// plan. A chunk that failed can be sent again, and one that was already
+// received is acknowledged again without being queued twice, so an uploader
+// can retry without fear. /ul/{id} uploads whichever chunk is next, as the
+// uploaders before indexing did. The end of a stream is marked by an empty
+// chunk past the last one, with X-Fileway-Eof: 1.
+func (s *Server) ul(w http.ResponseWriter, r *http.Request) {
+	id, rawIndex, indexed := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ul/"), "/")
+	conduit := s.conduits.GetConduit(id)
+	if conduit == nil {
+		s.notFound(w, id)
+		return
+	}
+
+	passedSecret := r.Header.Get("x-fileway-secret")
+	if conduit.IsUploadSecretWrong(passedSecret) {
+		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+		return
+	}
+
+	// The downloader waits for an uploader that went away, for a while; this
+	// is how it's known to be there.
+	conduit.BeginUpload()
+	defer conduit.EndUpload()
+
+	index := conduit.NextChunk()
+	if indexed {
+		var err error
+		if index, err = strconv.Atoi(rawIndex); err != nil || index < 0 {
+			http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Header.Get("X-Fileway-Eof") == "1" {
+		if conduit.IsOver() {
+			writeOver(w, conduit.Outcome())
+			return
+		}
+		switch err := conduit.EndStream(index); {
+		case err == nil:
+			w.Header().Set("X-Fileway-Phase", string(conduit.Phase()))
+			logEvent(r, slog.LevelDebug, "Stream ended", "stream_ended", conduit,
+				slog.Int("chunks", index), slog.Int64("bytes", conduit.Total()))
+		case errors.Is(err, fw.ErrChunkOutOfOrder), errors.Is(err, fw.ErrStreamEnded):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	expectedSize := conduit.ChunkSizeAt(index)
+	if expectedSize == 0 {
+		http.Error(w, "No chunk expected", http.StatusBadRequest)
+		return
+	}
+
+	// The memory comes from the budget before the body is read, and
+	// straight into the buffer that goes to the downloader; both are given
+	// back unless the conduit takes them.
+	if err := conduit.Reserve(index, expectedSize); err != nil {
+		s.chunkFailed(w, r, conduit, index, err)
+		return
+	}
+	content := fw.NewBuffer(expectedSize)
+	reserved := expectedSize
+	taken := false
+	defer func() {
+		if !taken {
+			fw.ReleaseBuffer(content)
+			conduit.Unreserve(reserved)
+		}
+	}()
+	read, err := readChunk(r.Body, content)
+	conduit.Unreserve(reserved - read)
+	reserved = read
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Read one byte past the plan so an oversized body is detected rather than
+	// silently truncated.
+	if err == nil {
+		var past [1]byte
+		if n, _ := io.ReadFull(r.Body, past[:]); n > 0 {
+			http.Error(w, "Chunk exceeds declared size", http.StatusBadRequest)
+			return
+		}
+	}
+	content = content[:read]
+	// A chunk that got corrupted on the way is refused, and can be sent again
+	if digest := parseDigest(r.Header.Get("Content-Digest")); digest != nil {
+		if sum := sha256.Sum256(content); string(sum[:]) != string(digest) {
+			http.Error(w, "Chunk doesn't match its Content-Digest", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	switch err := conduit.OfferChunk(index, content); {
+	case err == nil:
+		taken = true
+		w.Header().Set("X-Fileway-Phase", string(conduit.Phase()))
+		next := setNextChunk(w, conduit, index)
+		s.metrics.uploadedBytes.Add(int64(len(content)))
+		logEvent(r, slog.LevelDebug, "Chunk received", "chunk_received", conduit,
+			slog.Int("chunk", index), slog.Int("bytes", len(content)), slog.Int("next", next))
+	case errors.Is(err, fw.ErrChunkAlreadyReceived):
+		// A retry of a chunk that made it: the answer was lost, not the chunk.
+		setNextChunk(w, conduit, index)
+	default:
+		s.chunkFailed(w, r, conduit, index, err)
+	}
+}
+
+// Answers a chunk at index that couldn't be reserved or offered, with err.
+func (s *Server) chunkFailed(w http.ResponseWriter, r *http.Request, conduit *fw.Conduit, index int, err error) {
+	switch {
+	case errors.Is(err, fw.ErrChunkOutOfOrder), errors.Is(err, fw.ErrStreamEnded):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, fw.ErrChunkIncomplete):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, fw.ErrMemoryFull):
+		// Only a chunk ahead of the next one, that would wait in memory: it
+		// can be sent again once the next one is in, or the budget has room
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, fw.ErrConduitOver):
+		// A conduit that is over is reported as 410 everywhere, matching ping,
+		// so clients can tell "this transfer is over" from "this chunk stalled".
+		writeOver(w, conduit.Outcome())
+	case errors.Is(err, fw.ErrDigestMismatch):
+		// The payload is not the declared one, so nobody gets it
+		logEvent(r, slog.LevelWarn, "The payload doesn't match the declared digest", "digest_mismatch", conduit)
+		s.conduits.DelConduit(conduit.Id)
+		conduit.End(fw.PhaseFailed, fw.ReasonDigestMismatch, "the payload doesn't match the declared digest")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, fw.ErrSpoolFailed):
+		logEvent(r, slog.LevelError, "Error spooling a chunk", "spool_write_failed", conduit, slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		if errors.Is(err, fw.ErrUploadTimeout) {
+			s.metrics.uploadTimeouts.Add(1)
+			logEvent(r, slog.LevelWarn, "The downloaders didn't take a chunk in time", "upload_timeout", conduit,
+				slog.Int("chunk", index))
+		}
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+	}
+}
+
+// Tells the uploader, in X-Fileway-Next-Chunk, the size of the chunk after
+// the one at index, that was accepted; it's how it follows an adaptive plan.
+// It's 0 if there's none. It's not told if it's not the next one to send
+// anymore, e.g. for a retry of an older one: then it returns -1.
+func setNextChunk(w http.ResponseWriter, conduit *fw.Conduit, index int) int {
+	if conduit.NextChunk() != index+1 {
+		return -1
+	}
+	next := conduit.ChunkSizeAt(index + 1)
+	w.Header().Set("X-Fileway-Next-Chunk", strconv.Itoa(next))
+	return next
+}
+
+// Reads from r until chunk is full, or r ends: then the error is io.EOF,
+// while a body that breaks gives another one. Unlike io.ReadFull, the two are
+// not mixed up in io.ErrUnexpectedEOF.
+func readChunk(r io.Reader, chunk []byte) (int, error) {
+	read := 0
+	for read < len(chunk) {
+		n, err := r.Read(chunk[read:])
+		read += n
+		// The end can come with the last bytes: it's seen again at the
+		// next read
+		if err == io.EOF && read == len(chunk) {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Tells an uploader that lost its connection, or was restarted, where the
+// upload got to: the index in the chunk plan of the next chunk to send, its
+// offset in the payload and its size. The downloader waits for it for
+// UploaderGrace.
+func (s *Server) resume(w http.ResponseWriter, r *http.Request) {
+	conduit := s.getConduit(&r.URL.Path)
+	if conduit == nil {
+		s.notFound(w, lastElem(r.URL.Path))
+		return
+	}
+
+	passedSecret := r.Header.Get("x-fileway-secret")
+	if conduit.IsUploadSecretWrong(passedSecret) {
+		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+		return
+	}
+
+	if conduit.IsOver() {
+		writeOver(w, conduit.Outcome())
+		return
+	}
+
+	var progress struct {
+		Chunk  int   `json:"chunk"`
+		Offset int64 `json:"offset"`
+		Size   int   `json:"size"`
+	}
+	progress.Chunk, progress.Offset = conduit.Progress()
+	progress.Size = conduit.ChunkSizeAt(progress.Chunk)
+	ret, err := json.Marshal(progress)
+	if err != nil {
+		http.Error(w, "Marshaling issue", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(ret)
+}
+
+// Tells the uploader how the transfer went, at /result/{id}: it's how it knows
+// that the downloader got the whole payload, and not only that the server got
+// it. It's a long poll, like ping, that returns as soon as the transfer is
+// over, or after a while anyway; the answer tells which. The transfer is
+// known for an expiry window after it's over.
+func (s *Server) result(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	passedSecret := r.Header.Get("x-fileway-secret")
+
+	var result fw.Result
+	conduit := s.conduits.GetConduit(id)
+	if conduit != nil {
+		if conduit.IsUploadSecretWrong(passedSecret) {
+			http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		var ok bool
+		// Once it's forgotten, a wrong secret is as good as a wrong id
+		if conduit, result, ok = s.conduits.Ended(id, passedSecret); !ok {
+			http.Error(w, "Conduit Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if conduit != nil {
+		timer := time.NewTimer(20 * time.Second)
+		defer timer.Stop()
+		select {
+		case <-conduit.Done:
+		case <-timer.C: // not over yet; the uploader will ask again
+		case <-r.Context().Done():
+			return
+		}
+		result = conduit.Result()
+	}
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Marshaling issue", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(ret)
+}
+
+// Answers about a transfer that is over: 410, with what happened to it in
+// X-Fileway-Phase and X-Fileway-Reason, for programs, and in the body, for
+// people. See fw.Phase.
+func writeOver(w http.ResponseWriter, outcome fw.Transition) {
+	w.Header().Set("X-Fileway-Phase", string(outcome.Phase))
+	w.Header().Set("X-Fileway-Reason", outcome.Reason)
+	http.Error(w, "Transfer "+string(outcome.Phase)+": "+outcome.Detail, http.StatusGone)
+}
+
+// Answers about a transfer that isn't there: if it's over, and remembered,
+// as writeOver, and otherwise 404.
+func (s *Server) notFound(w http.ResponseWriter, id string) {
+	if result, ok := s.conduits.Tombstone(id); ok {
+		writeOver(w, result.Transition)
+		return
+	}
+	http.Error(w, "Conduit Not Found", http.StatusNotFound)
+}
+
+// The download page of a transfer that is over, telling what happened to it;
+// or, if outcome is nil, of one that isn't known.
+func (s *Server) serveGonePage(w http.ResponseWriter, outcome *fw.Transition) {
+	title, detail, code := "This link doesn't work", "It's not a valid link, or it's too old.", http.StatusNotFound
+	if outcome != nil {
+		code = http.StatusGone
+		when := outcome.At.UTC().Format("2006-01-02 15:04 UTC")
+		switch outcome.Phase {
+		case fw.PhaseCompleted:
+			title, detail = "This transfer was already delivered", "On "+when+"."
+		case fw.PhaseCancelled:
+			title, detail = "This transfer was cancelled", "On "+when+", "+outcome.Detail+"."
+		case fw.PhaseExpired:
+			title, detail = "This transfer expired", "On "+when+": "+outcome.Detail+"."
+		default:
+			title, detail = "This transfer failed", "On "+when+": "+outcome.Detail+"."
+		}
+		w.Header().Set("X-Fileway-Phase", string(outcome.Phase))
+		w.Header().Set("X-Fileway-Reason", outcome.Reason)
+	}
+
+	page := utils.Replace(s.gonePage, "#TITLE#", html.EscapeString(title))
+	page = utils.Replace(page, "#DETAIL#", html.EscapeString(detail))
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(code)
+	_, _ = w.Write(page)
+}
+
+// Cancels a transfer at the uploader's request, at DELETE /ul/{id}, e.g.
+// because it picked the wrong file: the link stops working at once, and a
+// download under way is cut short.
+func (s *Server) cancelUpload(w http.ResponseWriter, r *http.Request) {
+	conduit := s.conduits.GetConduit(r.PathValue("id"))
+	if conduit == nil {
+		s.notFound(w, r.PathValue("id"))
+		return
+	}
+
+	passedSecret := r.Header.Get("x-fileway-secret")
+	if conduit.IsUploadSecretWrong(passedSecret) {
+		http.Error(w, "Secret Mismatch", http.StatusUnauthorized)
+		return
+	}
+
+	s.cancel(w, r, conduit, "uploader")
+}
+
+// Cancels a transfer at the downloader's request, at DELETE /dl/{id} or
+// /ddl/{id}, e.g. because it doesn't want it: the uploader is told at once.
+// The link is all it takes, as for downloading; so a transfer for several
+// downloaders, who share the link, can't be cancelled this way.
+func (s *Server) cancelDownload(w http.ResponseWriter, r *http.Request) {
+	conduit := s.conduits.GetConduit(r.PathValue("id"))
+	if conduit == nil {
+		s.notFound(w, r.PathValue("id"))
+		return
+	}
+
+	if conduit.Downloads() > 1 {
+		http.Error(w, "The transfer is for several downloaders, and can't be cancelled by one", http.StatusForbidden)
+		return
+	}
+
+	s.cancel(w, r, conduit, "downloader")
+}
+
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request, conduit *fw.Conduit, by string) {
+	reason := fw.ReasonCancelledByUploader
+	if by == "downloader" {
+		reason = fw.ReasonCancelledByDownloader
+	}
+	s.conduits.DelConduit(conduit.Id)
+	if !conduit.End(fw.PhaseCancelled, reason, "cancelled by the "+by) {
+		writeOver(w, conduit.Outcome())
+		return
+	}
+	if by == "uploader" {
+		s.metrics.cancelledByUploader.Add(1)
+	} else {
+		s.metrics.cancelledByDownloader.Add(1)
+	}
+	logEvent(r, slog.LevelInfo, "Transfer cancelled", "conduit_cancelled", conduit,
+		slog.String("by", by), slog.String("state", conduit.State()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The address of the server as the clients see it, with no trailing slash:
+// BaseURL, or else as guessed from r.
+func (s *Server) baseURL(r *http.Request) string {
+	base_url := s.cfg.BaseURL
+	if base_url == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base_url = fmt.Sprintf("%s://%s", scheme, r.Host)
+	}
+	return strings.TrimRight(base_url, "/")
+}
+
+func (s *Server) serveCLIUploader(w http.ResponseWriter, r *http.Request) {
+	ret := utils.Replace(s.cliUploader, "#BASE_URL#", s.baseURL(r))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"fileway_ul.py\"")
+	w.Write(ret)
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	fw "github.com/proofrock/fileway/fileway_logic"
+)
+
+// The metrics of a Server, served in the Prometheus text format; see
+// server.adoc, "Metrics". It's little enough that it's written by hand, rather
+// than pulling in the Prometheus client. The counters are kept here; the state
+// of the conduits is taken from the ConduitSet when scraped.
+type metrics struct {
+	authSuccesses  atomic.Int64
+	authFailures   atomic.Int64
+	uploadedBytes  atomic.Int64
+	relayedBytes   atomic.Int64
+	uploadTimeouts atomic.Int64
+	completed      atomic.Int64
+
+	cancelledByUploader   atomic.Int64
+	cancelledByDownloader atomic.Int64
+
+	// New transfers refused, because of MaxConduits or of MemoryBudget
+	refusedConduits atomic.Int64
+	refusedMemory   atomic.Int64
+
+	duration   *histogram // seconds, of a complete download
+	throughput *histogram // bytes per second, of a complete download
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		duration:   newHistogram(1, 5, 15, 60, 300, 900, 3600, 4*3600, 24*3600),
+		throughput: newHistogram(64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20, 256<<20, 1<<30),
+	}
+}
+
+// Records a download that got the whole payload, in the time since start.
+func (m *metrics) observeDownload(size int64, start time.Time) {
+	m.completed.Add(1)
+	secs := time.Since(start).Seconds()
+	m.duration.observe(secs)
+	if secs > 0 {
+		m.throughput.observe(float64(size) / secs)
+	}
+}
+
+// Records a new transfer refused, with reason "conduits" or "memory".
+func (m *metrics) refused(reason string) {
+	if reason == "conduits" {
+		m.refusedConduits.Add(1)
+	} else {
+		m.refusedMemory.Add(1)
+	}
+}
+
+// A histogram with fixed buckets, as Prometheus wants it: cumulative counts
+// for each upper bound, plus the sum and the count of what was observed.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64 // not cumulative; the last one is for +Inf
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(b *bytes.Buffer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var count int64
+	for i, bound := range h.bounds {
+		count += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	count += h.counts[len(h.bounds)]
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, count)
+}
+
+func writeMetric(b *bytes.Buffer, name, kind, help string, samples ...string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintf(b, "%s%s\n", name, sample)
+	}
+}
+
+// Metrics returns the handler for the metrics, to serve them elsewhere than
+// at /metrics, e.g. on a port of their own.
+func (s *Server) Metrics() http.Handler {
+	return http.HandlerFunc(s.serveMetrics)
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	stats := s.conduits.Stats()
+	m := s.metrics
+
+	var b bytes.Buffer
+	var states []string
+	for _, state := range []string{
+		fw.StateWaiting, fw.StateTransferring, fw.StateDownloaderAway,
+		fw.StateUploaderAway, fw.StateSpooling, fw.StateStored,
+	} {
+		states = append(states, fmt.Sprintf("{state=\"%s\"} %d", state, stats.ByState[state]))
+	}
+	writeMetric(&b, "fileway_conduits", "gauge", "Transfers there are, by state.", states...)
+	writeMetric(&b, "fileway_buffered_bytes", "gauge", "Bytes queued in memory, between uploaders and downloaders.",
+		fmt.Sprintf(" %d", stats.Buffered))
+	writeMetric(&b, "fileway_conduits_created_total", "counter", "Transfers set up.",
+		fmt.Sprintf(" %d", stats.Created))
+	writeMetric(&b, "fileway_conduits_expired_total", "counter", "Transfers garbage collected, because idle for too long.",
+		fmt.Sprintf(" %d", stats.Expired))
+	writeMetric(&b, "fileway_conduits_cancelled_total", "counter", "Transfers cancelled, by the end that gave up on them.",
+		fmt.Sprintf("{by=\"uploader\"} %d", m.cancelledByUploader.Load()),
+		fmt.Sprintf("{by=\"downloader\"} %d", m.cancelledByDownloader.Load()))
+	writeMetric(&b, "fileway_conduits_refused_total", "counter", "Transfers refused with 503, by what was exhausted.",
+		fmt.Sprintf("{reason=\"conduits\"} %d", m.refusedConduits.Load()),
+		fmt.Sprintf("{reason=\"memory\"} %d", m.refusedMemory.Load()))
+	writeMetric(&b, "fileway_auth_total", "counter", "Checks of an uploader's secret, by result.",
+		fmt.Sprintf("{result=\"success\"} %d", m.authSuccesses.Load()),
+		fmt.Sprintf("{result=\"failure\"} %d", m.authFailures.Load()))
+	writeMetric(&b, "fileway_uploaded_bytes_total", "counter", "Bytes received from uploaders.",
+		fmt.Sprintf(" %d", m.uploadedBytes.Load()))
+	writeMetric(&b, "fileway_relayed_bytes_total", "counter", "Bytes sent to downloaders.",
+		fmt.Sprintf(" %d", m.relayedBytes.Load()))
+	writeMetric(&b, "fileway_upload_timeouts_total", "counter", "Chunks refused because the downloaders didn't take them in time.",
+		fmt.Sprintf(" %d", m.uploadTimeouts.Load()))
+	writeMetric(&b, "fileway_downloads_completed_total", "counter", "Downloads that got the whole payload.",
+		fmt.Sprintf(" %d", m.completed.Load()))
+	m.duration.write(&b, "fileway_download_duration_seconds", "Duration of the downloads that got the whole payload.")
+	m.throughput.write(&b, "fileway_download_throughput_bytes_per_second", "Throughput of the downloads that got the whole payload.")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
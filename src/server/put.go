@@ -0,0 +1,221 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	fw "github.com/proofrock/fileway/fileway_logic"
+)
+
+// How many times a chunk of a /put is offered to downloaders that don't take
+// it, as the clients retry a chunk of /ul/, before giving up.
+const maxPutAttempts = 5
+
+// Uploads a whole payload in a single request, at PUT /put/{name}, so that
+// plain curl can send:
+//
+//	curl -T file.bin -H 'x-fileway-secret: ...' https://host/put/
+//
+// (curl appends the file name to a URL that ends with /). The answer is
+// 201 Created, with the link in Location and as the first line of a text body,
+// right away; then the body goes on with the progress, and ends telling how
+// the transfer went. The payload is read from the request as the downloader
+// takes it, so the chunk plan is all on this side. Without a Content-Length,
+// e.g. with curl -T -, it's a stream. The options are the ones of /setup, in
+// the query string, but e2e and txt.
+//
+// There's no resuming: if the request breaks, the transfer fails, and if the
+// transfer fails the connection is cut, so that curl fails too.
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.admit(w, r)
+	if !ok {
+		return
+	}
+
+	qry := r.URL.Query()
+	if qry.Get("e2e") == "1" || qry.Get("txt") == "1" {
+		http.Error(w, "A /put can't be end-to-end encrypted, or a text", http.StatusBadRequest)
+		return
+	}
+	// -1 if the length is not given
+	size := r.ContentLength
+	if size == 0 || size > MaxSizeBytes {
+		http.Error(w, "Invalid size: must be between 1 byte and 4 TiB", http.StatusBadRequest)
+		return
+	}
+
+	// The server is the uploader, and follows an adaptive plan
+	conduit := s.openConduit(w, r, identity, r.PathValue("name"), size, false, true)
+	if conduit == nil {
+		return
+	}
+	conduit.BeginUpload()
+	defer conduit.EndUpload()
+
+	// HTTP/1.1 reads all the request before writing the answer, unless told
+	// otherwise; HTTP/2 doesn't need to be told.
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex()
+	// A client that expects 100 Continue must get it before the answer, or it
+	// takes the answer as a refusal, and doesn't send the body.
+	_, _ = r.Body.Read(nil)
+
+	link := s.baseURL(r) + "/dl/" + conduit.Id
+	w.Header().Set("Location", link)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusCreated)
+	say := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\n", args...)
+		_ = rc.Flush()
+	}
+	say("%s", link)
+
+	// The uploader can't come back: once it's gone, the transfer is over
+	var sent int64
+	gone := func() {
+		s.conduits.DelConduit(conduit.Id)
+		if conduit.End(fw.PhaseFailed, fw.ReasonUploaderDisconnected, "uploader disconnected at "+conduit.Percent(sent)) {
+			logEvent(r, slog.LevelInfo, "Transfer failed, the uploader is gone", "conduit_failed", conduit,
+				slog.String("reason", fw.ReasonUploaderDisconnected), slog.Int64("bytes", sent))
+		}
+	}
+
+	if !conduit.IsSpooled() {
+		say("Waiting for the downloader...")
+		select {
+		case <-conduit.Started:
+		case <-conduit.Done:
+		case <-r.Context().Done():
+			gone()
+			return
+		}
+	}
+
+	shown := time.Now()
+	for index := 0; !conduit.IsOver(); index++ {
+		n := conduit.ChunkSizeAt(index)
+		if n == 0 {
+			break
+		}
+		// The conduit takes it over, if it's offered, with the memory
+		// reserved for it before it's read
+		if !s.tryPutChunk(r, conduit, index, func() error { return conduit.Reserve(index, n) }) {
+			break
+		}
+		chunk := fw.NewBuffer(n)
+		read, err := readChunk(r.Body, chunk)
+		conduit.Unreserve(n - read)
+		if (err != nil && err != io.EOF) || (err == io.EOF && !conduit.IsStream()) {
+			fw.ReleaseBuffer(chunk)
+			conduit.Unreserve(read)
+			gone()
+			return
+		}
+		if read == 0 {
+			fw.ReleaseBuffer(chunk)
+		} else {
+			if !s.tryPutChunk(r, conduit, index, func() error { return conduit.OfferChunk(index, chunk[:read]) }) {
+				fw.ReleaseBuffer(chunk)
+				conduit.Unreserve(read)
+				break
+			}
+			s.metrics.uploadedBytes.Add(int64(read))
+			logEvent(r, slog.LevelDebug, "Chunk received", "chunk_received", conduit,
+				slog.Int("chunk", index), slog.Int("bytes", read), slog.Int("next", conduit.ChunkSizeAt(index+1)))
+			sent += int64(read)
+		}
+		if err == io.EOF {
+			if read > 0 {
+				index++
+			}
+			if conduit.EndStream(index) == nil {
+				logEvent(r, slog.LevelDebug, "Stream ended", "stream_ended", conduit,
+					slog.Int("chunks", index), slog.Int64("bytes", sent))
+			}
+			break
+		}
+		if time.Since(shown) >= time.Second {
+			shown = time.Now()
+			say("Sent %s", conduit.Percent(sent))
+		}
+	}
+
+	if conduit.IsSpooled() && !conduit.IsOver() {
+		say("All stored on the server, it can be downloaded later.")
+		return
+	}
+	if !conduit.IsOver() {
+		say("All sent, waiting for the downloader to get it all...")
+		select {
+		case <-conduit.Done:
+		case <-r.Context().Done():
+			// Nothing left to send: the download goes on anyway
+			return
+		}
+	}
+
+	result := conduit.Result()
+	if result.Phase != fw.PhaseCompleted {
+		say("ERROR: Transfer %s: %s", result.Phase, result.Detail)
+		panic(http.ErrAbortHandler)
+	}
+	say("All delivered, in %s.", (time.Duration(result.DurationMillis) * time.Millisecond).Round(100*time.Millisecond))
+}
+
+// Reserves or offers the chunk at index of a /put, with step, as ul does, but
+// with nobody else to retry it. It returns false if the transfer is over, also
+// because of it.
+func (s *Server) tryPutChunk(r *http.Request, conduit *fw.Conduit, index int, step func() error) bool {
+	for attempt := 1; ; attempt++ {
+		err := step()
+		switch {
+		case err == nil:
+			return true
+		case errors.Is(err, fw.ErrConduitOver):
+			return false
+		case errors.Is(err, fw.ErrDigestMismatch):
+			logEvent(r, slog.LevelWarn, "The payload doesn't match the declared digest", "digest_mismatch", conduit)
+			s.conduits.DelConduit(conduit.Id)
+			conduit.End(fw.PhaseFailed, fw.ReasonDigestMismatch, "the payload doesn't match the declared digest")
+			return false
+		case errors.Is(err, fw.ErrSpoolFailed):
+			logEvent(r, slog.LevelError, "Error spooling a chunk", "spool_write_failed", conduit, slog.Any("error", err))
+			s.conduits.DelConduit(conduit.Id)
+			conduit.End(fw.PhaseFailed, fw.ReasonSpoolFailed, "the server couldn't store it")
+			return false
+		case errors.Is(err, fw.ErrUploadTimeout):
+			s.metrics.uploadTimeouts.Add(1)
+			logEvent(r, slog.LevelWarn, "The downloaders didn't take a chunk in time", "upload_timeout", conduit,
+				slog.Int("chunk", index))
+			if attempt == maxPutAttempts {
+				s.conduits.DelConduit(conduit.Id)
+				conduit.End(fw.PhaseExpired, fw.ReasonIdle, "the downloader stopped reading")
+				return false
+			}
+		default:
+			// Out of order, or already received: with a single uploader, it's a bug
+			logEvent(r, slog.LevelError, "Error uploading a chunk", "put_failed", conduit, slog.Any("error", err))
+			s.conduits.DelConduit(conduit.Id)
+			conduit.End(fw.PhaseFailed, fw.ReasonUploaderDisconnected, "the upload failed")
+			return false
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package server is the fileway service as an http.Handler, so that it can be
+mounted in an existing HTTP server, or several differently configured
+instances can run in one process. The fileway binary is a thin wrapper around
+it that reads the configuration from the environment.
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+	mux.Handle("/fileway/", http.StripPrefix("/fileway", srv))
+*/
+package server
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/proofrock/fileway/auth"
+	fw "github.com/proofrock/fileway/fileway_logic"
+	"github.com/proofrock/fileway/utils"
+)
+
+//go:embed static/upload.html
+var uploadPage []byte
+
+//go:embed static/download.html
+var downloadPage []byte
+
+//go:embed static/download_for_txt.html
+var downloadPageForTxt []byte
+
+//go:embed static/gone.html
+var gonePage []byte
+
+//go:embed static/e2e.js
+var e2eScript []byte
+
+//go:embed static/e2e_sw.js
+var e2eServiceWorker []byte
+
+//go:embed static/favicon.png
+var favicon []byte
+
+//go:embed static/fileway_ul.py
+var cliUploader []byte
+
+// MaxSizeBytes is the largest transfer accepted; see server.adoc, "Transfer
+// size limit".
+const MaxSizeBytes = 4 * 1024 * 1024 * 1024 * 1024 // 4 TiB
+
+// MaxDownloads is the most downloaders a transfer can be set up for; see
+// server.adoc, "Several downloaders".
+const MaxDownloads = 16
+
+// Config is the configuration of a Server. The env vars in server.adoc map
+// one to one to these fields.
+type Config struct {
+	// Comma-separated BCrypt hashes of the secrets (FILEWAY_SECRET_HASHES).
+	SecretHashes string
+	// Length of ID random strings (RANDOM_IDS_LENGTH).
+	IdsLength int
+	// Chunk size for upload and internal buffer, in bytes (CHUNK_SIZE_KB * 1024).
+	ChunkSize int
+	// The bounds of the chunk size for the uploaders that can follow an
+	// adaptive plan, in bytes (CHUNK_SIZE_MIN_KB * 1024 and
+	// CHUNK_SIZE_MAX_KB * 1024); for them, they replace ChunkSize. A
+	// ChunkSizeMax of 0 is ChunkSize, or ChunkSizeMin if that's bigger.
+	ChunkSizeMin int
+	ChunkSizeMax int
+	// Internal buffer queue of chunks (BUFFER_QUEUE_SIZE).
+	BufferQueueSize int
+	// How many chunks an uploader can send at once (PARALLEL_CHUNKS), for a
+	// file with a plan that isn't adaptive; 1 is one at a time.
+	ParallelChunks int
+	// How many transfers there can be at once (MAX_CONDUITS), and how many
+	// bytes they can buffer in memory, all together
+	// (MEMORY_BUDGET_MB * 1024 * 1024). Past either, /setup answers 503.
+	MaxConduits  int
+	MemoryBudget int64
+	// How long an upload waits for a download (UPLOAD_TIMEOUT_SECS). The
+	// check runs every 10 seconds, and the granularity is the second.
+	UploadTimeout time.Duration
+	// How long a download that lost its connection can be resumed
+	// (RESUME_GRACE_SECS). 0 disables resuming.
+	ResumeGrace time.Duration
+	// How long a transfer under way waits for an uploader that lost its
+	// connection to come back (UPLOADER_GRACE_SECS).
+	UploaderGrace time.Duration
+	// How long a transfer for several downloaders waits for all of them,
+	// after the first one came, before starting with those that are there
+	// (FANOUT_WAIT_SECS).
+	FanOutWait time.Duration
+	// How long a downloader waits on a named pipe for the upload to be set up
+	// (PIPE_WAIT_SECS).
+	PipeWait time.Duration
+	// Where the payloads of spooled transfers are kept (SPOOL_DIR). Empty,
+	// the default, disables spooling.
+	SpoolDir string
+	// How many bytes the spooled payloads can take in total
+	// (SPOOL_QUOTA_MB * 1024 * 1024).
+	SpoolQuota int64
+	// How long a spooled payload is kept, once uploaded, if it's not
+	// downloaded (SPOOL_TTL_SECS).
+	SpoolTTL time.Duration
+	// How long a transfer that is over is remembered, so that its link tells
+	// how it ended rather than that it doesn't exist (TOMBSTONE_TTL_SECS), and
+	// how many are, at most (MAX_TOMBSTONES).
+	TombstoneTTL  time.Duration
+	MaxTombstones int
+	// Comma-separated BCrypt hashes of the secrets of the admins
+	// (ADMIN_SECRET_HASHES). If empty, the admin API refuses everything.
+	AdminSecretHashes string
+	// Whether the metrics are served at /metrics, along with the rest. The
+	// fileway binary does so when METRICS_PORT is the same as PORT; see
+	// Server.Metrics to serve them elsewhere.
+	Metrics bool
+	// Shown in the pages and in the CLI uploader.
+	Version string
+	// Base URL baked into the CLI uploader, e.g. "https://example.com/fileway".
+	// If empty it's derived from each request, which is right unless the
+	// handler is mounted under a path prefix.
+	BaseURL string
+}
+
+// DefaultConfig returns the defaults documented in server.adoc. SecretHashes
+// has no default and must always be set.
+func DefaultConfig() Config {
+	return Config{
+		IdsLength:       33,          // amounts to 192 bit
+		ChunkSize:       4096 * 1024, // 4Mb
+		ChunkSizeMin:    64 * 1024,
+		ChunkSizeMax:    0, // as ChunkSize
+		BufferQueueSize: 4, // 16Mb total
+		ParallelChunks:  4,
+		MaxConduits:     1000,
+		MemoryBudget:    1024 * 1024 * 1024, // 1Gb
+		UploadTimeout:   240 * time.Second,
+		ResumeGrace:     60 * time.Second,
+		UploaderGrace:   60 * time.Second,
+		FanOutWait:      60 * time.Second,
+		PipeWait:        240 * time.Second,
+		SpoolQuota:      10 * 1024 * 1024 * 1024, // 10Gb
+		SpoolTTL:        24 * time.Hour,
+		TombstoneTTL:    24 * time.Hour,
+		MaxTombstones:   10000,
+	}
+}
+
+// Validate reports the first invalid field, if any.
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.SecretHashes == "":
+		return errors.New("missing secret hashes")
+	case cfg.IdsLength <= 0:
+		return errors.New("RANDOM_IDS_LENGTH must be > 0")
+	case cfg.ChunkSize <= 0:
+		return errors.New("CHUNK_SIZE_KB must be > 0")
+	case cfg.ChunkSizeMin <= 0:
+		return errors.New("CHUNK_SIZE_MIN_KB must be > 0")
+	case cfg.ChunkSizeMax < 0 || (cfg.ChunkSizeMax > 0 && cfg.ChunkSizeMax < cfg.ChunkSizeMin):
+		return errors.New("CHUNK_SIZE_MAX_KB must be >= CHUNK_SIZE_MIN_KB")
+	case cfg.BufferQueueSize <= 0:
+		return errors.New("BUFFER_QUEUE_SIZE must be > 0")
+	case cfg.ParallelChunks <= 0:
+		return errors.New("PARALLEL_CHUNKS must be > 0")
+	case cfg.MaxConduits <= 0:
+		return errors.New("MAX_CONDUITS must be > 0")
+	case cfg.MemoryBudget <= 0:
+		return errors.New("MEMORY_BUDGET_MB must be > 0")
+	case cfg.UploadTimeout < time.Second:
+		return errors.New("UPLOAD_TIMEOUT_SECS must be > 0")
+	case cfg.ResumeGrace < 0:
+		return errors.New("RESUME_GRACE_SECS must be >= 0")
+	case cfg.UploaderGrace < time.Second:
+		return errors.New("UPLOADER_GRACE_SECS must be > 0")
+	case cfg.FanOutWait < time.Second:
+		return errors.New("FANOUT_WAIT_SECS must be > 0")
+	case cfg.PipeWait < time.Second:
+		return errors.New("PIPE_WAIT_SECS must be > 0")
+	case cfg.SpoolDir != "" && cfg.SpoolQuota <= 0:
+		return errors.New("SPOOL_QUOTA_MB must be > 0")
+	case cfg.SpoolDir != "" && cfg.SpoolTTL < time.Second:
+		return errors.New("SPOOL_TTL_SECS must be > 0")
+	case cfg.TombstoneTTL < time.Second:
+		return errors.New("TOMBSTONE_TTL_SECS must be > 0")
+	case cfg.MaxTombstones <= 0:
+		return errors.New("MAX_TOMBSTONES must be > 0")
+	}
+	return nil
+}
+
+// Server is a fileway instance. It holds its own set of transfers, so two
+// Servers never see each other's.
+type Server struct {
+	cfg           Config
+	authenticator *auth.Auth
+	conduits      *fw.ConduitSet
+	mux           *http.ServeMux
+	metrics       *metrics
+
+	// The admins, or nil if there are none; see Admin
+	adminAuthenticator *auth.Auth
+	// Whether new transfers are refused
+	draining atomic.Bool
+
+	// The embedded files, with the version already in
+	uploadPage         []byte
+	downloadPage       []byte
+	downloadPageForTxt []byte
+	gonePage           []byte
+	cliUploader        []byte
+}
+
+// New returns a Server for cfg, or an error if cfg is not valid, or the spool
+// dir can't be set up. Close it when done, to stop the cleanup of stale
+// transfers.
+func New(cfg Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ChunkSizeMax == 0 {
+		cfg.ChunkSizeMax = max(cfg.ChunkSize, cfg.ChunkSizeMin)
+	}
+
+	s := &Server{
+		cfg:           cfg,
+		authenticator: auth.NewAuth(cfg.SecretHashes),
+		conduits: fw.NewConduitSet(
+			int(cfg.UploadTimeout/time.Second),
+			int(cfg.ResumeGrace/time.Second),
+			int(cfg.UploaderGrace/time.Second),
+			int(cfg.FanOutWait/time.Second),
+		),
+		mux:     http.NewServeMux(),
+		metrics: newMetrics(),
+
+		// Replaces version in the web pages and cli uploader
+		uploadPage:         utils.Replace(uploadPage, "#VERSION#", cfg.Version),
+		downloadPage:       utils.Replace(downloadPage, "#VERSION#", cfg.Version),
+		downloadPageForTxt: utils.Replace(downloadPageForTxt, "#VERSION#", cfg.Version),
+		gonePage:           utils.Replace(gonePage, "#VERSION#", cfg.Version),
+		cliUploader:        utils.Replace(cliUploader, "#VERSION#", cfg.Version),
+	}
+
+	if cfg.AdminSecretHashes != "" {
+		s.adminAuthenticator = auth.NewAuth(cfg.AdminSecretHashes)
+	}
+
+	s.conduits.KeepTombstones(int(cfg.TombstoneTTL/time.Second), cfg.MaxTombstones)
+	s.conduits.Limit(cfg.MaxConduits, cfg.MemoryBudget)
+
+	if cfg.SpoolDir != "" {
+		if err := s.conduits.EnableSpool(cfg.SpoolDir, cfg.SpoolQuota, int(cfg.SpoolTTL/time.Second)); err != nil {
+			s.conduits.Close()
+			return nil, fmt.Errorf("setting up the spool dir: %w", err)
+		}
+	}
+
+	// Routes
+	s.mux.HandleFunc("/dl/", s.dl)   // Shows a download page, if downloader "looks like" CLI redirects to ddl
+	s.mux.HandleFunc("/ddl/", s.ddl) // Direct download
+	s.mux.HandleFunc("/setup", s.setup)
+	s.mux.HandleFunc("/ping/", s.ping)
+	s.mux.HandleFunc("/ul/", s.ul)
+	s.mux.HandleFunc("DELETE /ul/{id}", s.cancelUpload)
+	s.mux.HandleFunc("DELETE /dl/{id}", s.cancelDownload)
+	s.mux.HandleFunc("DELETE /ddl/{id}", s.cancelDownload)
+	s.mux.HandleFunc("GET /pipe/{name}", s.pipe) // Direct download that can wait for the upload
+	s.mux.HandleFunc("/resume/", s.resume)
+	s.mux.HandleFunc("PUT /put/{name}", s.put) // The whole upload in a request, for curl -T
+	s.mux.HandleFunc("GET /result/{id}", s.result)
+	s.mux.HandleFunc("/fileway_ul.py", s.serveCLIUploader)
+	s.mux.HandleFunc("/favicon.png", serveFile(favicon, "image/png"))
+	s.mux.HandleFunc("/e2e.js", serveFile(e2eScript, "text/javascript"))
+	s.mux.HandleFunc("/e2e_sw.js", serveFile(e2eServiceWorker, "text/javascript"))
+	if cfg.Metrics {
+		s.mux.HandleFunc("/metrics", s.serveMetrics)
+	}
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		serveFile(s.uploadPage, "text/html")(w, r)
+	})
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Config returns the configuration s runs with, with what New derives, as
+// ChunkSizeMax, filled in.
+func (s *Server) Config() Config {
+	return s.cfg
+}
+
+// Close stops the background cleanup. Transfers in flight are not
+// interrupted, but they won't expire anymore: close the Server only when the
+// handler is no longer served.
+func (s *Server) Close() {
+	s.conduits.Close()
+}
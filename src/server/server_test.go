@@ -0,0 +1,2158 @@
+// Copyright 2024 @proofrock
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/proofrock/fileway/client"
+	fw "github.com/proofrock/fileway/fileway_logic"
+)
+
+// A bcrypt hash of "mysecret", same as the one used by the bats suite.
+const testSecretHash = `$2a$10$I.NhoT1acD9XkXmXn1IMSOp0qhZDd63iSw1RfHZP7nzyg/ItX5eVa`
+
+// Each test gets its own instance, so nothing leaks between them.
+func newTestServer(t testing.TB) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.UploadTimeout = time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Sends a request to s with the secret, as an uploader that knows the chunk
+// plan up to version; "" for one from before the versions.
+func doPlanned(s *Server, method, path, version string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	r.Header.Set("X-Fileway-Plan", version)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// Sets up the upload of a file of size bytes on s, as an uploader that knows
+// the chunk plan up to version.
+func newPlannedUpload(t testing.TB, s *Server, version string, size int64) *fw.Conduit {
+	t.Helper()
+	w := doPlanned(s, "GET", "/setup?filename=a.bin&size="+strconv.FormatInt(size, 10), version, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("setup -> HTTP %d", w.Code)
+	}
+	return s.conduits.GetConduit(w.Body.String())
+}
+
+// Sizes outside the supported range are refused at setup time.
+func TestSetupRejectsInvalidSizes(t *testing.T) {
+	s := newTestServer(t)
+
+	cases := []struct {
+		size string
+		want int
+	}{
+		{"0", http.StatusBadRequest},
+		{"-1", http.StatusBadRequest},
+		{"abc", http.StatusBadRequest},
+		{"1", http.StatusOK},
+		{strconv.FormatInt(MaxSizeBytes, 10), http.StatusOK},
+		{strconv.FormatInt(MaxSizeBytes+1, 10), http.StatusBadRequest},
+		{"1&downloads=0", http.StatusBadRequest},
+		{"1&downloads=" + strconv.Itoa(MaxDownloads), http.StatusOK},
+		{"1&downloads=" + strconv.Itoa(MaxDownloads+1), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size="+c.size, nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.setup(w, r)
+		if w.Code != c.want {
+			t.Errorf("size=%s -> HTTP %d, want %d", c.size, w.Code, c.want)
+		}
+	}
+}
+
+// A chunk larger than the plan allows must be refused, not buffered.
+func TestUploadRejectsOversizedChunk(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 5, "mysecret", 4096, 4, 16, 1)
+	body := strings.Repeat("X", 5000)
+
+	r := httptest.NewRequest("PUT", "/ul/"+id, strings.NewReader(body))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ul(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("oversized chunk -> HTTP %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// A conduit that expires while chunks are still buffered must still deliver
+// them: the downloader was promised Content-Length bytes and silently getting
+// fewer corrupts the file.
+func TestDownloadDeliversBufferedChunksOnExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	const rounds = 200
+	truncated := 0
+	for i := 0; i < rounds; i++ {
+		id, _ := s.conduits.NewConduit(false, false, "a.bin", 12, "mysecret", 4096, 4, 16, 1)
+		conduit := s.conduits.GetConduit(id)
+
+		// The uploader delivered everything and went away; the chunks sit in
+		// the buffer waiting for a slow downloader.
+		conduit.ChunkQueue <- []byte("aaaa")
+		conduit.ChunkQueue <- []byte("bbbb")
+		conduit.ChunkQueue <- []byte("cccc")
+
+		// The cleanup ticker fires right now.
+		conduit.End(fw.PhaseExpired, fw.ReasonIdle, "the transfer stalled")
+
+		// ddl() claims the download itself, so it must not be claimed here.
+		r := httptest.NewRequest("GET", "/ddl/"+id, nil)
+		w := httptest.NewRecorder()
+		s.ddl(w, r)
+
+		if w.Body.Len() != 12 {
+			truncated++
+		}
+	}
+
+	if truncated > 0 {
+		t.Errorf("%d/%d downloads were truncated despite the chunks being buffered", truncated, rounds)
+	}
+}
+
+// Streaming a chunk must keep the conduit alive, otherwise a download slower
+// than UPLOAD_TIMEOUT_SECS is killed by the cleanup ticker halfway through.
+func TestDownloadKeepsConduitAlive(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+
+	// ddl() claims the download itself, so it must not be claimed here.
+	finished := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest("GET", "/ddl/"+id, nil)
+		s.ddl(httptest.NewRecorder(), r)
+		close(finished)
+	}()
+
+	// Let ddl() get past Download(), which touches the conduit on its own: the
+	// cutoff has to sit after that, or it would measure the wrong touch.
+	time.Sleep(30 * time.Millisecond)
+	cutoff := time.Now().UnixMilli()
+	time.Sleep(5 * time.Millisecond)
+
+	conduit.ChunkQueue <- []byte("aaaa")
+	time.Sleep(30 * time.Millisecond)
+
+	alive := conduit.WasAccessedAfter(cutoff)
+	conduit.ChunkQueue <- []byte("bbbb")
+	<-finished
+
+	if !alive {
+		t.Error("streaming a chunk did not touch the conduit; a slow transfer would expire mid-flight")
+	}
+}
+
+// An expired conduit must be reported as 410 by /ul/ too, not as a 408 that
+// clients would read as a transient stall.
+func TestUploadOnExpiredConduitIsGone(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 1, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	conduit.ChunkQueue <- []byte("full") // fill the queue so Offer() must block
+	conduit.End(fw.PhaseExpired, fw.ReasonIdle, "the transfer stalled")
+
+	r := httptest.NewRequest("PUT", "/ul/"+id, strings.NewReader("aaaaaaaa"))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ul(w, r)
+
+	if w.Code != http.StatusGone {
+		t.Errorf("ul on expired conduit -> HTTP %d, want %d", w.Code, http.StatusGone)
+	}
+}
+
+// A conduit that expires while ping is parked on it must come back as 410, and
+// come back immediately - not sit there until the 20s long-poll runs out, and not
+// hand over a chunk plan the uploader can no longer use.
+func TestPingReportsExpiryAsGone(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 1, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+
+	r := httptest.NewRequest("GET", "/ping/"+id, nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		s.ping(w, r)
+	}()
+
+	// Give ping time to reach the select, then expire the conduit under it.
+	time.Sleep(50 * time.Millisecond)
+	conduit.End(fw.PhaseExpired, fw.ReasonNoDownloader, "expired waiting for the downloader")
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not return once the conduit expired; it is waiting out the full long-poll")
+	}
+
+	if w.Code != http.StatusGone {
+		t.Errorf("ping on a conduit that expired while waiting -> HTTP %d, want %d", w.Code, http.StatusGone)
+	}
+}
+
+// With a download started and the conduit expired, both channels ping selects on
+// are closed, and select picks among ready cases at random. Expiry has to win
+// every time, not half the time - hence the repetition.
+func TestPingPrefersExpiryOverStartedPlan(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 1, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	if _, err := conduit.Download(); err != nil {
+		t.Fatal(err)
+	}
+	conduit.End(fw.PhaseExpired, fw.ReasonIdle, "the transfer stalled")
+
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/ping/"+id, nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.ping(w, r)
+		if w.Code != http.StatusGone {
+			t.Fatalf("attempt %d: ping -> HTTP %d, want %d", i, w.Code, http.StatusGone)
+		}
+	}
+}
+
+// The whole transfer protocol in-process: setup, the downloader connecting,
+// ping handing out the plan, every chunk uploaded, and the payload arriving
+// byte-identical. Sizes straddle the ramp boundaries, including the exact
+// multiples that used to produce a trailing zero-length chunk.
+func TestTransferRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, size := range []int{1, 4095, 4096, 4097, 12288, 100000, 1000000} {
+		payload := make([]byte, size)
+		if _, err := rand.Read(payload); err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size="+strconv.Itoa(size), nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.setup(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("size=%d: setup -> HTTP %d", size, w.Code)
+		}
+		id := w.Body.String()
+
+		downloaded := make(chan []byte, 1)
+		go func() {
+			ww := httptest.NewRecorder()
+			s.ddl(ww, httptest.NewRequest("GET", "/ddl/"+id, nil))
+			downloaded <- ww.Body.Bytes()
+		}()
+		time.Sleep(30 * time.Millisecond) // let the downloader claim it
+
+		pr := httptest.NewRequest("GET", "/ping/"+id, nil)
+		pr.Header.Set("x-fileway-secret", "mysecret")
+		pw := httptest.NewRecorder()
+		s.ping(pw, pr)
+		if pw.Code != http.StatusOK {
+			t.Fatalf("size=%d: ping -> HTTP %d", size, pw.Code)
+		}
+		var plan []int
+		if err := json.Unmarshal(pw.Body.Bytes(), &plan); err != nil {
+			t.Fatalf("size=%d: bad plan: %v", size, err)
+		}
+
+		off := 0
+		for i, cs := range plan {
+			if cs == 0 {
+				t.Errorf("size=%d: plan contains a zero-length chunk at %d", size, i)
+			}
+			ur := httptest.NewRequest("PUT", "/ul/"+id, bytes.NewReader(payload[off:off+cs]))
+			ur.Header.Set("x-fileway-secret", "mysecret")
+			uw := httptest.NewRecorder()
+			s.ul(uw, ur)
+			if uw.Code != http.StatusOK {
+				t.Fatalf("size=%d: chunk %d/%d (%d bytes) -> HTTP %d %q",
+					size, i+1, len(plan), cs, uw.Code, uw.Body.String())
+			}
+			off += cs
+		}
+
+		select {
+		case got := <-downloaded:
+			if !bytes.Equal(got, payload) {
+				t.Errorf("size=%d: payload mismatch (%d bytes received)", size, len(got))
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("size=%d: the download never completed", size)
+		}
+	}
+}
+
+// An uploader that asks for the plan with X-Fileway-Plan gets it described,
+// the others the list of the sizes, as before.
+func TestPingDescribesPlan(t *testing.T) {
+	s := newTestServer(t)
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 100<<20, "mysecret", 4096*1024, 4, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	if _, err := conduit.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := func(version string) []byte {
+		w := doPlanned(s, "GET", "/ping/"+id, version, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("ping -> HTTP %d", w.Code)
+		}
+		return w.Body.Bytes()
+	}
+
+	var plan fw.ChunkPlan
+	if err := json.Unmarshal(ping("2"), &plan); err != nil || plan != conduit.ChunkPlan {
+		t.Errorf("described: %+v, %v", plan, err)
+	}
+	if plan.Version != 2 || plan.Initial != 4096 || plan.Factor != 2 || plan.Max != 4096*1024 || plan.Size != 100<<20 {
+		t.Errorf("described: %+v", plan)
+	}
+	for _, version := range []string{"", "1", "x"} {
+		var list []int
+		if err := json.Unmarshal(ping(version), &list); err != nil || len(list) != plan.Len() || list[len(list)-1] != plan.SizeAt(plan.Len()-1) {
+			t.Errorf("version %q: %d chunks, %v", version, len(list), err)
+		}
+	}
+}
+
+// An uploader that knows the adaptive plan asks for it at setup, and is told
+// the size of each chunk as it sends the one before; one that doesn't can't
+// go on with it.
+func TestAdaptivePlan(t *testing.T) {
+	s := newTestServer(t)
+
+	if newPlannedUpload(t, s, "2", 100000).ChunkPlan.Adaptive {
+		t.Error("adaptive for an uploader that doesn't know it")
+	}
+	conduit := newPlannedUpload(t, s, "3", 100000)
+	if _, err := conduit.Download(); err != nil {
+		t.Fatal(err)
+	}
+
+	var plan fw.ChunkPlan
+	w := doPlanned(s, "GET", "/ping/"+conduit.Id, "3", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil || plan != conduit.ChunkPlan {
+		t.Fatalf("ping -> HTTP %d %+v, %v", w.Code, plan, err)
+	}
+	if !plan.Adaptive || plan.Initial != 4096 || plan.Min != 64<<10 || plan.Max != 4<<20 {
+		t.Errorf("plan %+v", plan)
+	}
+	for _, version := range []string{"", "2"} {
+		if w := doPlanned(s, "GET", "/ping/"+conduit.Id, version, nil); w.Code != http.StatusConflict {
+			t.Errorf("version %q: ping -> HTTP %d", version, w.Code)
+		}
+	}
+
+	// A retry is told the same
+	for range 2 {
+		w := doPlanned(s, "PUT", "/ul/"+conduit.Id+"/0", "", make([]byte, 4096))
+		if got := w.Header().Get("X-Fileway-Next-Chunk"); w.Code != http.StatusOK || got != "8192" {
+			t.Errorf("PUT chunk 0 -> HTTP %d, next %q", w.Code, got)
+		}
+	}
+	if w := doPlanned(s, "GET", "/resume/"+conduit.Id, "", nil); !strings.Contains(w.Body.String(), `"size":8192`) {
+		t.Errorf("resume -> %q", w.Body.String())
+	}
+}
+
+// A plan that is set up front lets the uploader send several chunks at once,
+// and they get to the downloader in order; an adaptive one doesn't.
+func TestParallelChunks(t *testing.T) {
+	s := newTestServer(t)
+
+	if plan := newPlannedUpload(t, s, "2", 100000).ChunkPlan; plan.Parallel != 4 {
+		t.Errorf("fixed plan %+v", plan)
+	}
+	if plan := newPlannedUpload(t, s, "3", 100000).ChunkPlan; plan.Parallel != 0 {
+		t.Errorf("adaptive plan %+v", plan)
+	}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 3000000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	c := client.New(srv.URL, "mysecret")
+	c.Parallel = 4
+	c.Digest = true
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), payload) {
+		t.Errorf("payload mismatch (%d bytes received)", got.Len())
+	}
+}
+
+// A chunk of a file is as big as the plan says, also with a chunk at a time:
+// a short one would move where the uploader resumes from.
+func TestShortChunkRefused(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.ParallelChunks = 1
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, version := range []string{"2", "3"} {
+		conduit := newPlannedUpload(t, s, version, 10000)
+		id := conduit.Id
+		if _, err := conduit.Download(); err != nil {
+			t.Fatal(err)
+		}
+
+		if w := doPlanned(s, "PUT", "/ul/"+id+"/0", "", make([]byte, 100)); w.Code != http.StatusBadRequest {
+			t.Errorf("version %s: short chunk -> HTTP %d", version, w.Code)
+		}
+		if w := doPlanned(s, "GET", "/resume/"+id, "", nil); !strings.Contains(w.Body.String(), `"offset":0,`) {
+			t.Errorf("version %s: resume -> %q", version, w.Body.String())
+		}
+		if w := doPlanned(s, "PUT", "/ul/"+id+"/0", "", make([]byte, 4096)); w.Code != http.StatusOK {
+			t.Errorf("version %s: whole chunk -> HTTP %d", version, w.Code)
+		}
+	}
+}
+
+// The client package against the real handlers, over real HTTP: what Send
+// uploads is what Receive gets, name included.
+func TestClientRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(srv.URL, "mysecret")
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a b.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	d, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if !bytes.Equal(got.Bytes(), payload) {
+		t.Errorf("payload mismatch (%d bytes received)", got.Len())
+	}
+	if d.Filename != "a b.bin" || d.Size != int64(len(payload)) || d.IsText {
+		t.Errorf("got filename=%q size=%d isText=%v", d.Filename, d.Size, d.IsText)
+	}
+
+	// One-shot: the link is spent.
+	_, err = client.New(srv.URL, "").Open(context.Background(), up.URL)
+	if !errors.Is(err, client.ErrConduitExpired) && !errors.Is(err, client.ErrConduitAlreadyDownloading) {
+		t.Errorf("second download: got %v", err)
+	}
+}
+
+// End-to-end encrypted, the server relays a sealed payload it can't read, and
+// announces its size; the link with the key gets the payload back.
+func TestE2ERoundTrip(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(srv.URL, "mysecret")
+	c.E2E = true
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Key == "" || !strings.HasSuffix(up.URL, "#"+up.Key) {
+		t.Fatalf("no key in the link %s", up.URL)
+	}
+	conduit := s.conduits.GetConduit(up.ID)
+	if !conduit.E2E || conduit.Size != fw.SealedSize(int64(len(payload))) || conduit.PayloadSize() != int64(len(payload)) {
+		t.Fatalf("got size %d for a sealed payload of %d", conduit.Size, fw.SealedSize(int64(len(payload))))
+	}
+
+	var got bytes.Buffer
+	d, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), payload) || d.Size != int64(len(payload)) {
+		t.Errorf("payload mismatch (%d bytes received, size %d)", got.Len(), d.Size)
+	}
+}
+
+// A transfer nobody downloads ends with ErrConduitExpired, which the CLI turns
+// into "transfer expired" and exit status 1, like fileway_ul.py.
+func TestClientReportsExpiry(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	up, err := client.New(srv.URL, "mysecret").SendText(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What the cleanup ticker does, minus the wait.
+	time.Sleep(50 * time.Millisecond)
+	s.conduits.GetConduit(up.ID).End(fw.PhaseExpired, fw.ReasonNoDownloader, "expired waiting for the downloader")
+
+	if err := up.Wait(); !errors.Is(err, client.ErrConduitExpired) {
+		t.Errorf("got %v, want ErrConduitExpired", err)
+	}
+}
+
+// Two instances in one process don't share transfers, nor configuration.
+func TestInstancesAreIsolated(t *testing.T) {
+	a := newTestServer(t)
+	b := newTestServer(t)
+
+	r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size=10", nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("setup -> HTTP %d", w.Code)
+	}
+	id := w.Body.String()
+
+	w = httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/dl/"+id, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("conduit of one instance seen by the other: HTTP %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/dl/"+id, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("conduit not found on its own instance: HTTP %d", w.Code)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	broken := []func(*Config){
+		func(c *Config) { c.SecretHashes = "" },
+		func(c *Config) { c.ChunkSize = 0 },
+		func(c *Config) { c.ChunkSizeMax = c.ChunkSizeMin - 1 },
+		func(c *Config) { c.ParallelChunks = 0 },
+		func(c *Config) { c.BufferQueueSize = -1 },
+		func(c *Config) { c.IdsLength = 0 },
+		func(c *Config) { c.UploadTimeout = 0 },
+		func(c *Config) { c.UploaderGrace = 0 },
+	}
+	for i, breakIt := range broken {
+		cfg := DefaultConfig()
+		cfg.SecretHashes = testSecretHash
+		breakIt(&cfg)
+		if s, err := New(cfg); err == nil {
+			s.Close()
+			t.Errorf("case %d: invalid config accepted", i)
+		}
+	}
+}
+
+// Mounted under a prefix, the CLI uploader must point at the prefix, not at
+// the root of the host.
+func TestCLIUploaderBaseURL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.BaseURL = "https://example.com/fileway/"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/fileway/", http.StripPrefix("/fileway", s))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/fileway/fileway_ul.py", nil))
+
+	if !strings.Contains(w.Body.String(), `BASE_URL = "https://example.com/fileway"`) {
+		t.Error("the served script doesn't carry the configured base URL")
+	}
+}
+
+// Unless it's set, the biggest chunk of an adaptive plan is the one of a fixed
+// plan.
+func TestChunkSizeMaxDefault(t *testing.T) {
+	for _, c := range []struct {
+		size, min, max, want int
+	}{
+		{8 << 20, 64 << 10, 0, 8 << 20},
+		{1 << 20, 64 << 10, 0, 1 << 20},
+		{32 << 10, 64 << 10, 0, 64 << 10},
+		{1 << 20, 64 << 10, 16 << 20, 16 << 20},
+	} {
+		cfg := DefaultConfig()
+		cfg.SecretHashes = testSecretHash
+		cfg.ChunkSize, cfg.ChunkSizeMin, cfg.ChunkSizeMax = c.size, c.min, c.max
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Config().ChunkSizeMax; got != c.want {
+			t.Errorf("%+v: max %d", c, got)
+		}
+		s.Close()
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		from   int64
+		ok     bool
+	}{
+		{"bytes=4-", 4, true},
+		{"bytes=0-", 0, true},
+		{"bytes=4-9", 4, true},
+		{"bytes=4-5", 0, false}, // not up to the end
+		{"bytes=10-", 0, false}, // past the end
+		{"bytes=-4", 0, false},  // suffix
+		{"bytes=0-1,4-", 0, false},
+		{"items=4-", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		from, ok := parseRange(c.header, 10)
+		if from != c.from || ok != c.ok {
+			t.Errorf("%q: got (%d, %v), want (%d, %v)", c.header, from, ok, c.from, c.ok)
+		}
+	}
+}
+
+// Starts a download of conduit id that goes away after the first chunk, as if
+// the connection dropped.
+func dropAfterFirstChunk(t *testing.T, s *Server, id string) {
+	t.Helper()
+	conduit := s.conduits.GetConduit(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest("GET", "/ddl/"+id, nil).WithContext(ctx)
+		s.ddl(httptest.NewRecorder(), r)
+		close(finished)
+	}()
+	conduit.ChunkQueue <- []byte("aaaa")
+	// Wait for the chunk to be taken, then drop the connection.
+	for len(conduit.ChunkQueue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-finished
+}
+
+// A downloader that lost the connection can come back with a Range and get the
+// rest, including what was lost in flight; nobody else can take over.
+func TestDownloadResumesWithRange(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	dropAfterFirstChunk(t, s, id)
+
+	conduit := s.conduits.GetConduit(id)
+	if conduit == nil || !conduit.IsDetached() {
+		t.Fatal("the conduit was not kept for the downloader to come back")
+	}
+
+	// The downloader got only the first 2 bytes
+	r := httptest.NewRequest("GET", "/ddl/"+id, nil)
+	r.Header.Set("Range", "bytes=2-")
+	w := httptest.NewRecorder()
+	resumed := time.Now()
+	finished := make(chan struct{})
+	go func() {
+		s.ddl(w, r)
+		close(finished)
+	}()
+	conduit.ChunkQueue <- []byte("bbbb")
+	<-finished
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got %d, want 206", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 2-7/8" {
+		t.Errorf("Content-Range: got %q", got)
+	}
+	if got := w.Body.String(); got != "aabbbb" {
+		t.Errorf("body: got %q, want %q", got, "aabbbb")
+	}
+	// Only what this request sent, in its own time, is in the metrics
+	secs := s.metrics.duration.sum
+	if n := s.metrics.throughput.sum * secs; math.Round(n) != 6 || secs > time.Since(resumed).Seconds() {
+		t.Errorf("observed %g bytes in %gs", n, secs)
+	}
+	if s.conduits.GetConduit(id) != nil {
+		t.Error("a completed transfer was not forgotten")
+	}
+}
+
+// A Range that goes back further than what is kept is refused with 416, and
+// one for a different payload (If-Range) is not honored.
+func TestDownloadResumeLimits(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	dropAfterFirstChunk(t, s, id)
+
+	r := httptest.NewRequest("GET", "/ddl/"+id, nil)
+	r.Header.Set("Range", "bytes=6-")
+	w := httptest.NewRecorder()
+	s.ddl(w, r)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Range past what was delivered: got %d, want 416", w.Code)
+	}
+
+	// If-Range names something else, so it's a fresh download; the start of
+	// the payload is still in the tail, so it can be served.
+	r = httptest.NewRequest("GET", "/ddl/"+id, nil)
+	r.Header.Set("Range", "bytes=2-")
+	r.Header.Set("If-Range", `"not-this-one"`)
+	w = httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		s.ddl(w, r)
+		close(finished)
+	}()
+	s.conduits.GetConduit(id).ChunkQueue <- []byte("bbbb")
+	<-finished
+	if w.Code != http.StatusOK || w.Body.String() != "aaaabbbb" {
+		t.Errorf("mismatching If-Range: got %d %q, want 200 %q", w.Code, w.Body.String(), "aaaabbbb")
+	}
+}
+
+// Without a Range, a download that went away and can't be resumed from the
+// start is being downloaded already, not a range that can't be satisfied.
+func TestDownloadWithoutRangeWhileDetached(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 12, "mysecret", 4096, 1, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		r := httptest.NewRequest("GET", "/ddl/"+id, nil).WithContext(ctx)
+		s.ddl(httptest.NewRecorder(), r)
+		close(finished)
+	}()
+	// With a tail of 1 chunk, it can be resumed from the second one only
+	for _, chunk := range []string{"aaaa", "bbbb"} {
+		conduit.ChunkQueue <- []byte(chunk)
+	}
+	for len(conduit.ChunkQueue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-finished
+
+	r := httptest.NewRequest("GET", "/ddl/"+id, nil)
+	w := httptest.NewRecorder()
+	s.ddl(w, r)
+	if w.Code != http.StatusGone || w.Header().Get("Content-Range") != "" {
+		t.Errorf("without a Range: got %d, Content-Range %q, want 410", w.Code, w.Header().Get("Content-Range"))
+	}
+	r = httptest.NewRequest("GET", "/ddl/"+id, nil)
+	r.Header.Set("Range", "bytes=2-")
+	w = httptest.NewRecorder()
+	s.ddl(w, r)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Range before the tail: got %d, want 416", w.Code)
+	}
+}
+
+// With RESUME_GRACE_SECS=0 a dropped download ends the transfer, as it
+// always did.
+func TestDownloadWithoutResume(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.UploadTimeout = time.Hour
+	cfg.ResumeGrace = 0
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	dropAfterFirstChunk(t, s, id)
+	if s.conduits.GetConduit(id) != nil {
+		t.Error("the conduit survived its downloader with resuming disabled")
+	}
+}
+
+// Chunks addressed by index can be retried: a repeated one is acknowledged
+// without being delivered twice, one ahead of the plan is refused.
+func TestIndexedUploadRetries(t *testing.T) {
+	s := newTestServer(t)
+
+	payload := make([]byte, 12288) // plan: 4096, 8192
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", int64(len(payload)), "mysecret", 4096*1024, 4, 16, 1)
+
+	downloaded := make(chan []byte, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/ddl/"+id, nil))
+		downloaded <- w.Body.Bytes()
+	}()
+
+	put := func(index int, body []byte) int {
+		r := httptest.NewRequest("PUT", "/ul/"+id+"/"+strconv.Itoa(index), bytes.NewReader(body))
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	steps := []struct {
+		index    int
+		from, to int
+		want     int
+	}{
+		{1, 4096, 12288, http.StatusConflict}, // ahead of the plan
+		{0, 0, 4096, http.StatusOK},
+		{0, 0, 4096, http.StatusOK}, // a retry
+		{1, 4096, 12288, http.StatusOK},
+	}
+	for i, step := range steps {
+		if got := put(step.index, payload[step.from:step.to]); got != step.want {
+			t.Fatalf("step %d: PUT chunk %d -> HTTP %d, want %d", i, step.index, got, step.want)
+		}
+	}
+
+	select {
+	case got := <-downloaded:
+		if !bytes.Equal(got, payload) {
+			t.Errorf("payload mismatch (%d bytes received)", len(got))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("the download never completed")
+	}
+}
+
+// An uploader that went away after the first chunk comes back, asks where it
+// got to and sends the rest; the downloader, that waited, gets it all.
+func TestUploaderResumes(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 12288) // plan: 4096, 8192
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", int64(len(payload)), "mysecret", 4096*1024, 4, 16, 1)
+
+	downloaded := make(chan []byte, 1)
+	go func() {
+		var got bytes.Buffer
+		client.New(srv.URL, "").Receive(context.Background(), srv.URL+"/dl/"+id, &got)
+		downloaded <- got.Bytes()
+	}()
+	time.Sleep(30 * time.Millisecond) // let the downloader claim it
+
+	r := httptest.NewRequest("PUT", "/ul/"+id+"/0", bytes.NewReader(payload[:4096]))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT chunk 0 -> HTTP %d", w.Code)
+	}
+	// ...and the uploader is gone.
+
+	r = httptest.NewRequest("GET", "/resume/"+id, nil)
+	r.Header.Set("x-fileway-secret", "wrong")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("resume with a wrong secret -> HTTP %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	r = httptest.NewRequest("GET", "/resume/"+id, nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != `{"chunk":1,"offset":4096,"size":8192}` {
+		t.Errorf("resume -> HTTP %d %q", w.Code, got)
+	}
+
+	up, err := client.New(srv.URL, "mysecret").Resume(context.Background(), id, bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("resumed upload: %v", err)
+	}
+
+	select {
+	case got := <-downloaded:
+		if !bytes.Equal(got, payload) {
+			t.Errorf("payload mismatch (%d bytes received)", len(got))
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("the download never completed")
+	}
+}
+
+// One upload for several downloaders: it starts when they are all there, and
+// each one gets the whole payload.
+func TestFanOutRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	const downloads = 3
+	c := client.New(srv.URL, "mysecret")
+	c.Downloads = downloads
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte, downloads)
+	for i := 0; i < downloads; i++ {
+		go func() {
+			var got bytes.Buffer
+			if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, &got); err != nil {
+				t.Error(err)
+			}
+			received <- got.Bytes()
+		}()
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	for i := 0; i < downloads; i++ {
+		select {
+		case got := <-received:
+			if !bytes.Equal(got, payload) {
+				t.Errorf("payload mismatch (%d bytes received)", len(got))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a download never completed")
+		}
+	}
+	// The handlers end a moment after the clients read the last byte.
+	for i := 0; s.conduits.GetConduit(up.ID) != nil; i++ {
+		if i == 100 {
+			t.Fatal("a transfer completed by all its downloaders was not forgotten")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A spooled upload completes with nobody downloading; the download comes
+// later, can be resumed from anywhere, and takes the spool file with it.
+func TestSpoolRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.SpoolDir = t.TempDir()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(srv.URL, "mysecret")
+	c.Spool = true
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-up.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the spooled upload waited for a downloader")
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A resume, that a queued transfer couldn't serve from this far back
+	r := httptest.NewRequest("GET", "/ddl/"+up.ID, nil)
+	r.Header.Set("Range", "bytes=1000-")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), payload[1000:]) {
+		t.Fatalf("ranged download: HTTP %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if s.conduits.GetConduit(up.ID) != nil {
+		t.Error("a downloaded spool was not forgotten")
+	}
+	if files, _ := os.ReadDir(cfg.SpoolDir); len(files) > 0 {
+		t.Errorf("%d files left in the spool dir", len(files))
+	}
+}
+
+// Spooling is opt-in on the server too.
+func TestSpoolDisabledByDefault(t *testing.T) {
+	s := newTestServer(t)
+
+	r := httptest.NewRequest("GET", "/setup?filename=a.bin&txt=0&size=10&spool=1", nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("spooled setup with spooling disabled -> HTTP %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// A declared digest reaches the downloader, which checks it; a chunk that
+// doesn't match its Content-Digest is refused, and can be sent again.
+func TestDigestRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.New(srv.URL, "mysecret")
+	c.Digest = true
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(payload)
+	if got := s.conduits.GetConduit(up.ID).Digest(); !bytes.Equal(got, sum[:]) {
+		t.Fatalf("declared digest %x, want %x", got, sum)
+	}
+
+	var got bytes.Buffer
+	if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), payload) {
+		t.Errorf("payload mismatch (%d bytes received)", got.Len())
+	}
+}
+
+func TestChunkContentDigest(t *testing.T) {
+	s := newTestServer(t)
+
+	payload := []byte("some text")
+	id, _ := s.conduits.NewConduit(true, false, "", int64(len(payload)), "mysecret", 4096*1024, 4, 16, 1)
+
+	downloaded := make(chan []byte, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/ddl/"+id, nil))
+		downloaded <- w.Body.Bytes()
+	}()
+
+	put := func(body []byte, digest string) int {
+		r := httptest.NewRequest("PUT", "/ul/"+id+"/0", bytes.NewReader(body))
+		r.Header.Set("x-fileway-secret", "mysecret")
+		r.Header.Set("Content-Digest", digest)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	sum := sha256.Sum256(payload)
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	if got := put([]byte("some tExt"), digest); got != http.StatusUnprocessableEntity {
+		t.Fatalf("altered chunk -> HTTP %d", got)
+	}
+	if got := put(payload, digest); got != http.StatusOK {
+		t.Fatalf("chunk -> HTTP %d", got)
+	}
+
+	select {
+	case got := <-downloaded:
+		if !bytes.Equal(got, payload) {
+			t.Errorf("payload mismatch: %q", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("the download never completed")
+	}
+}
+
+// A payload that isn't the declared one is cut short, before its last byte,
+// and the transfer is over.
+func TestDigestMismatchAbortsDownload(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 12288) // plan: 4096, 8192
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("something else"))
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", int64(len(payload)), "mysecret", 4096*1024, 4, 16, 1, fw.WithDigest(sum[:]))
+
+	go func() {
+		for i, chunk := range [][]byte{payload[:4096], payload[4096:]} {
+			r := httptest.NewRequest("PUT", "/ul/"+id+"/"+strconv.Itoa(i), bytes.NewReader(chunk))
+			r.Header.Set("x-fileway-secret", "mysecret")
+			s.ServeHTTP(httptest.NewRecorder(), r)
+		}
+	}()
+
+	var got bytes.Buffer
+	_, err := client.New(srv.URL, "").Receive(context.Background(), srv.URL+"/dl/"+id, &got)
+	if err == nil {
+		t.Fatal("a payload that doesn't match its digest was received")
+	}
+	if got.Len() >= len(payload) {
+		t.Errorf("%d bytes received, all of them", got.Len())
+	}
+	if s.conduits.GetConduit(id) != nil {
+		t.Error("the transfer is still there")
+	}
+}
+
+// A spooled payload is checked as it's stored, and refused as a whole.
+func TestSpoolRefusesDigestMismatch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.SpoolDir = t.TempDir()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sum := sha256.Sum256([]byte("something else"))
+	r := httptest.NewRequest("GET", "/setup?txt=1&size=9&spool=1&sha256="+hex.EncodeToString(sum[:]), nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("setup -> HTTP %d", w.Code)
+	}
+	id := w.Body.String()
+
+	r = httptest.NewRequest("PUT", "/ul/"+id+"/0", strings.NewReader("some text"))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("chunk -> HTTP %d", w.Code)
+	}
+	if s.conduits.GetConduit(id) != nil {
+		t.Error("the transfer is still there")
+	}
+	if files, _ := os.ReadDir(cfg.SpoolDir); len(files) > 0 {
+		t.Errorf("%d files left in the spool dir", len(files))
+	}
+}
+
+// The metrics account for a transfer, and are only at /metrics if asked for.
+func TestMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.Metrics = true
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	up, err := client.New(srv.URL, "mysecret").Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, "wrong").SendText(context.Background(), "abc"); err == nil {
+		t.Fatal("a wrong secret was accepted")
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics -> HTTP %d", w.Code)
+	}
+	for _, want := range []string{
+		`fileway_conduits{state="waiting"} 0`,
+		`fileway_conduits_created_total 1`,
+		`fileway_auth_total{result="success"} 1`,
+		`fileway_auth_total{result="failure"} 1`,
+		`fileway_uploaded_bytes_total 300000`,
+		`fileway_relayed_bytes_total 300000`,
+		`fileway_downloads_completed_total 1`,
+		`fileway_download_duration_seconds_count 1`,
+		`fileway_buffered_bytes 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("no %q in the metrics", want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	newTestServer(t).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("metrics not enabled -> HTTP %d", w.Code)
+	}
+}
+
+// The logs tell the transfers apart without the ids, that are what gives
+// access to the payload.
+func TestLogsHaveNoIds(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	s := newTestServer(t)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	up, err := client.New(srv.URL, "mysecret").SendText(context.Background(), "some text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(logs.String(), up.ID) {
+		t.Fatalf("the id is in the logs:\n%s", logs.String())
+	}
+	events := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Event    string `json:"event"`
+			Conduit  string `json:"conduit"`
+			Identity int    `json:"identity"`
+			Remote   string `json:"remote"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("not JSON: %s", line)
+		}
+		if entry.Conduit != fw.Fingerprint(up.ID) || entry.Identity != 1 || entry.Remote == "" {
+			t.Errorf("missing fields: %s", line)
+		}
+		events[entry.Event] = true
+	}
+	for _, event := range []string{"conduit_created", "chunk_received", "download_completed"} {
+		if !events[event] {
+			t.Errorf("no %s event in the logs:\n%s", event, logs.String())
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.AdminSecretHashes = testSecretHash
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	admin := s.Admin()
+
+	call := func(method, path, body, secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("x-fileway-secret", secret)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	setup := func() int {
+		r := httptest.NewRequest("GET", "/setup?txt=1&size=3", nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if w := call("GET", "/conduits", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret -> HTTP %d", w.Code)
+	}
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 12288, "mysecret", 4096*1024, 4, 16, 1)
+	fp := fw.Fingerprint(id)
+	w := call("GET", "/conduits", "", "mysecret")
+	var infos []fw.ConduitInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil || len(infos) != 1 {
+		t.Fatalf("list: %v, %s", err, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), id) {
+		t.Error("the list gives away the id")
+	}
+	if info := infos[0]; info.Fingerprint != fp || info.Filename != "a.bin" || info.State != fw.StateWaiting || info.Chunks != 2 || info.QueueCap != 4 {
+		t.Errorf("list: %+v", info)
+	}
+	if w := call("GET", "/conduits/"+fp, "", "mysecret"); w.Code != http.StatusOK {
+		t.Errorf("show -> HTTP %d", w.Code)
+	}
+
+	if w := call("PUT", "/drain", `{"drain":true}`, "mysecret"); w.Code != http.StatusOK || !s.Draining() {
+		t.Fatalf("drain -> HTTP %d", w.Code)
+	}
+	if code := setup(); code != http.StatusServiceUnavailable {
+		t.Errorf("setup while draining -> HTTP %d", code)
+	}
+	call("PUT", "/drain", `{"drain":false}`, "mysecret")
+	if code := setup(); code != http.StatusOK {
+		t.Errorf("setup after draining -> HTTP %d", code)
+	}
+
+	conduit := s.conduits.GetConduit(id)
+	if w := call("DELETE", "/conduits/"+fp, "", "mysecret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expire -> HTTP %d", w.Code)
+	}
+	if s.conduits.GetConduit(id) != nil || conduit.Outcome().Reason != fw.ReasonExpiredByAdmin {
+		t.Error("the transfer is still there")
+	}
+	if w := call("DELETE", "/conduits/"+fp, "", "mysecret"); w.Code != http.StatusNotFound {
+		t.Errorf("expire again -> HTTP %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	newTestServer(t).Admin().ServeHTTP(w, httptest.NewRequest("GET", "/conduits", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("admin not enabled -> HTTP %d", w.Code)
+	}
+}
+
+// A conduit is all set up once the others can see it: under -race, listing
+// them while they are set up finds nothing that changes.
+func TestSetupWhileListing(t *testing.T) {
+	s := newTestServer(t)
+
+	done := make(chan struct{})
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				s.conduits.List()
+			}
+		}
+	}()
+	for i := range 50 {
+		newPlannedUpload(t, s, strconv.Itoa(2+i%2), 100000)
+	}
+	close(done)
+	<-listed
+}
+
+// Past the transfers there can be at once, or the memory they can buffer, a
+// new one is refused with 503, and a Retry-After, until there's room again.
+func TestSetupRefusedWhenBusy(t *testing.T) {
+	s := newTestServer(t)
+	setup := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/setup?filename=a.bin&size=8", nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.setup(w, r)
+		return w
+	}
+
+	s.conduits.Limit(1, 4096)
+	if w := setup(); w.Code != http.StatusOK {
+		t.Fatalf("first setup -> HTTP %d", w.Code)
+	}
+	if w := setup(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("past MaxConduits -> HTTP %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	s.conduits.Limit(10, 4096)
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 12288, "mysecret", 4096, 4, 16, 1, fw.WithParallelChunks(4))
+	conduit := s.conduits.GetConduit(id)
+	if err := conduit.Reserve(0, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := conduit.OfferChunk(0, fw.NewBuffer(4096)); err != nil {
+		t.Fatal(err)
+	}
+	if w := setup(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("past MemoryBudget -> HTTP %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// A chunk is refused before it's read, if it would wait in memory
+	r := httptest.NewRequest("PUT", "/ul/"+id+"/2", bytes.NewReader(make([]byte, 4096)))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("chunk ahead, past MemoryBudget -> HTTP %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Over, it gives back what it held, though nobody took it
+	conduit.End(fw.PhaseCancelled, fw.ReasonCancelledByUploader, "cancelled")
+	if w := setup(); w.Code != http.StatusOK {
+		t.Errorf("once the memory is back -> HTTP %d", w.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	s.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`fileway_conduits_refused_total{reason="conduits"} 1`,
+		`fileway_conduits_refused_total{reason="memory"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics: no %s", want)
+		}
+	}
+}
+
+// The uploader cancels a transfer that nobody is downloading yet: its parked
+// ping is told at once, and the link stops working.
+func TestCancelUpload(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	cancel := func(secret string) int {
+		r := httptest.NewRequest("DELETE", "/ul/"+id, nil)
+		r.Header.Set("x-fileway-secret", secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	r := httptest.NewRequest("GET", "/ping/"+id, nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		s.ping(w, r)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if code := cancel("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("cancel with a wrong secret -> HTTP %d", code)
+	}
+	if code := cancel("mysecret"); code != http.StatusNoContent {
+		t.Fatalf("cancel -> HTTP %d", code)
+	}
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping did not return once the transfer was cancelled")
+	}
+	if w.Code != http.StatusGone || w.Header().Get("X-Fileway-Phase") != "cancelled" ||
+		w.Header().Get("X-Fileway-Reason") != "cancelled_by_uploader" ||
+		strings.TrimSpace(w.Body.String()) != "Transfer cancelled: cancelled by the uploader" {
+		t.Errorf("ping -> HTTP %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	// It's over, and remembered as such
+	if code := cancel("mysecret"); code != http.StatusGone {
+		t.Errorf("cancel again -> HTTP %d", code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/ddl/"+id, nil))
+	if w.Code != http.StatusGone || w.Header().Get("X-Fileway-Reason") != "cancelled_by_uploader" {
+		t.Errorf("download of a cancelled transfer -> HTTP %d %v", w.Code, w.Header())
+	}
+}
+
+// Cancelled while a chunk waits for room in the queue, the upload is told at
+// once; and a download under way is cut short, rather than completed.
+func TestCancelUnblocksTransfer(t *testing.T) {
+	s := newTestServer(t)
+
+	put := func(id string, index int, size int) chan *httptest.ResponseRecorder {
+		ret := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			r := httptest.NewRequest("PUT", "/ul/"+id+"/"+strconv.Itoa(index), bytes.NewReader(make([]byte, size)))
+			r.Header.Set("x-fileway-secret", "mysecret")
+			w := httptest.NewRecorder()
+			s.ul(w, r)
+			ret <- w
+		}()
+		return ret
+	}
+	cancel := func(id string) {
+		r := httptest.NewRequest("DELETE", "/ul/"+id, nil)
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("cancel -> HTTP %d", w.Code)
+		}
+	}
+
+	// Nobody downloads: the first chunk fills the queue, the second waits
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 12288, "mysecret", 8192, 1, 16, 1)
+	if w := <-put(id, 0, 4096); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0 -> HTTP %d", w.Code)
+	}
+	blocked := put(id, 1, 8192)
+	time.Sleep(50 * time.Millisecond)
+	cancel(id)
+	select {
+	case w := <-blocked:
+		if w.Code != http.StatusGone || w.Header().Get("X-Fileway-Reason") != "cancelled_by_uploader" {
+			t.Errorf("waiting chunk -> HTTP %d %q", w.Code, w.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload did not end once the transfer was cancelled")
+	}
+
+	// The download got the first chunk, and waits for the second
+	id, _ = s.conduits.NewConduit(false, false, "a.bin", 12288, "mysecret", 8192, 1, 16, 1)
+	dl := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.ddl(dl, httptest.NewRequest("GET", "/ddl/"+id, nil))
+	}()
+	if w := <-put(id, 0, 4096); w.Code != http.StatusOK {
+		t.Fatalf("chunk 0 -> HTTP %d", w.Code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel(id)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the download did not end once the transfer was cancelled")
+	}
+	if dl.Body.Len() != 4096 {
+		t.Errorf("the download got %d bytes, want 4096", dl.Body.Len())
+	}
+}
+
+// The downloader can cancel a transfer for it alone, with the link; the
+// uploader is told so.
+func TestCancelDownload(t *testing.T) {
+	s := newTestServer(t)
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/dl/"+id, nil))
+	if w.Code != http.StatusNoContent || conduit.Outcome().Reason != fw.ReasonCancelledByDownloader {
+		t.Fatalf("cancel -> HTTP %d", w.Code)
+	}
+
+	r := httptest.NewRequest("PUT", "/ul/"+id, strings.NewReader("aaaa"))
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusGone || w.Header().Get("X-Fileway-Reason") != "cancelled_by_downloader" {
+		t.Errorf("upload after the cancel -> HTTP %d %v", w.Code, w.Header())
+	}
+
+	// The link of several downloaders is shared, so none of them can
+	id, _ = s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 4, 16, 2)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("DELETE", "/ddl/"+id, nil))
+	if w.Code != http.StatusForbidden || s.conduits.GetConduit(id).IsOver() {
+		t.Errorf("cancel of a shared link -> HTTP %d", w.Code)
+	}
+}
+
+// A downloader that goes away for good, with resuming disabled, fails the
+// transfer: an upload waiting for it is told at once, not after its timeout.
+func TestDownloaderGoneUnblocksUpload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.UploadTimeout = time.Hour
+	cfg.ResumeGrace = 0
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 1, 16, 1)
+	conduit := s.conduits.GetConduit(id)
+	downloader, err := conduit.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conduit.ChunkQueue <- []byte("aaaa") // nobody reads it, so the next chunk waits
+
+	returned := make(chan error)
+	go func() { returned <- conduit.Offer([]byte("bbbb")) }()
+	time.Sleep(50 * time.Millisecond)
+	s.releaseDownload(httptest.NewRequest("GET", "/ddl/"+id, nil), conduit, downloader, 0)
+
+	select {
+	case err := <-returned:
+		if !errors.Is(err, fw.ErrConduitOver) {
+			t.Errorf("got %v, want ErrConduitOver", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upload is still waiting for a downloader that is gone")
+	}
+	if s.conduits.GetConduit(id) != nil {
+		t.Error("the transfer is still there")
+	}
+	if o := conduit.Outcome(); o.Phase != fw.PhaseFailed || o.Detail != "downloader disconnected at 0%" {
+		t.Errorf("outcome %+v", o)
+	}
+}
+
+// Client.Cancel ends an upload that is waiting for its downloader.
+func TestClientCancel(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c := client.New(srv.URL, "mysecret")
+	up, err := c.SendText(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Cancel(context.Background(), up.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); !errors.Is(err, client.ErrConduitCancelled) {
+		t.Errorf("got %v, want ErrConduitCancelled", err)
+	}
+	if err := c.Cancel(context.Background(), up.ID); !errors.Is(err, client.ErrConduitCancelled) {
+		t.Errorf("cancel again: got %v, want ErrConduitCancelled", err)
+	}
+}
+
+// With Confirm, Wait returns once the downloader got it all, and the Upload
+// tells how it went.
+func TestClientConfirmsDelivery(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := make([]byte, 300000)
+	c := client.New(srv.URL, "mysecret")
+	c.Confirm = true
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.New(srv.URL, "").Receive(context.Background(), up.URL, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if r := up.Result(); r == nil || r.Phase != "completed" || r.Bytes != int64(len(payload)) || !r.Final {
+		t.Errorf("result %+v", r)
+	}
+}
+
+// A downloader that went away halfway is told to the uploader, with how far
+// it got, also once the transfer is forgotten; but only to the uploader.
+func TestResultOfFailedTransfer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SecretHashes = testSecretHash
+	cfg.UploadTimeout = time.Hour
+	cfg.ResumeGrace = 0
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 8, "mysecret", 4096, 1, 16, 1)
+	result := func(secret string) (int, fw.Result) {
+		r := httptest.NewRequest("GET", "/result/"+id, nil)
+		r.Header.Set("x-fileway-secret", secret)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		var ret fw.Result
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, ret
+	}
+	if code, _ := result("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("result with a wrong secret -> HTTP %d", code)
+	}
+
+	conduit := s.conduits.GetConduit(id)
+	downloader, err := conduit.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conduit.ChunkQueue <- []byte("aaaa")
+	downloader.Delivered(<-downloader.Chunks())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.releaseDownload(httptest.NewRequest("GET", "/ddl/"+id, nil), conduit, downloader, 4)
+	}()
+
+	// It's waited for
+	code, got := result("mysecret")
+	if code != http.StatusOK || got.Phase != fw.PhaseFailed || got.Reason != fw.ReasonDownloaderDisconnected ||
+		got.Detail != "downloader disconnected at 50%" || got.Bytes != 4 || got.Size != 8 || !got.Final {
+		t.Errorf("result -> HTTP %d %+v", code, got)
+	}
+
+	if s.conduits.GetConduit(id) != nil {
+		t.Fatal("the transfer is still there")
+	}
+	if code, again := result("mysecret"); code != http.StatusOK || again != got {
+		t.Errorf("result once forgotten -> HTTP %d %+v", code, again)
+	}
+	if code, _ := result("wrong"); code != http.StatusNotFound {
+		t.Errorf("result once forgotten, with a wrong secret -> HTTP %d", code)
+	}
+}
+
+// Once a transfer is over, its link tells how it ended, for as long as it's
+// remembered; a link never seen is just not found.
+func TestTombstones(t *testing.T) {
+	s := newTestServer(t)
+	id, _ := s.conduits.NewConduit(false, false, "a.bin", 4, "mysecret", 4096, 4, 16, 1)
+	r := httptest.NewRequest("DELETE", "/ul/"+id, nil)
+	r.Header.Set("x-fileway-secret", "mysecret")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("cancel -> HTTP %d", w.Code)
+	}
+
+	for _, path := range []string{"/ddl/", "/ping/", "/ul/", "/resume/"} {
+		r := httptest.NewRequest("GET", path+id, nil)
+		if path == "/ul/" {
+			r = httptest.NewRequest("PUT", path+id, strings.NewReader("aaaa"))
+		}
+		r.Header.Set("x-fileway-secret", "mysecret")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusGone || w.Header().Get("X-Fileway-Phase") != "cancelled" ||
+			w.Header().Get("X-Fileway-Reason") != "cancelled_by_uploader" {
+			t.Errorf("%s -> HTTP %d %v", path, w.Code, w.Header())
+		}
+	}
+
+	browser := "Mozilla/5.0 (X11; Linux x86_64)"
+	r = httptest.NewRequest("GET", "/dl/"+id, nil)
+	r.Header.Set("User-Agent", browser)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "This transfer was cancelled") {
+		t.Errorf("page -> HTTP %d %q", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/dl/nope", nil)
+	r.Header.Set("User-Agent", browser)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "not a valid link") {
+		t.Errorf("unknown page -> HTTP %d %q", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/ddl/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown -> HTTP %d", w.Code)
+	}
+}
+
+// The downloader of a pipe can come first, and wait for the upload; a second
+// upload on the same pipe is refused while the first is on it.
+func TestPipeReceiverFirst(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := bytes.Repeat([]byte("fileway"), 50000)
+	received := make(chan []byte, 1)
+	go func() {
+		res, err := http.Get(srv.URL + "/pipe/deploy-42")
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		received <- body
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.New(srv.URL, "mysecret")
+	c.Pipe = "deploy-42"
+	up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", int64(len(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.PipeURL != srv.URL+"/pipe/deploy-42" {
+		t.Errorf("pipe URL %q", up.PipeURL)
+	}
+	if _, err := c.Send(context.Background(), bytes.NewReader(payload), "b.bin", int64(len(payload))); !errors.Is(err, client.ErrPipeBusy) {
+		t.Errorf("second upload: got %v, want ErrPipeBusy", err)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Errorf("received %d bytes, want %d", len(got), len(payload))
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/pipe/no%20way", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid name -> HTTP %d", w.Code)
+	}
+}
+
+// A stream of unknown size is sent until it ends, and downloaded chunked, with
+// the size and how it went in the trailer.
+func TestStream(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := bytes.Repeat([]byte("fileway"), 50000)
+	c := client.New(srv.URL, "mysecret")
+	up, err := c.SendStream(context.Background(), io.MultiReader(bytes.NewReader(payload)), "log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(strings.Replace(up.URL, "/dl/", "/ddl/", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ContentLength != -1 || res.Header.Get("Accept-Ranges") == "bytes" {
+		t.Errorf("length %d, ranges %q", res.ContentLength, res.Header.Get("Accept-Ranges"))
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("received %d bytes, want %d", len(body), len(payload))
+	}
+	if res.Trailer.Get("X-Fileway-Size") != strconv.Itoa(len(payload)) || res.Trailer.Get("X-Fileway-Status") != "complete" {
+		t.Errorf("trailer %v", res.Trailer)
+	}
+	if err := up.Wait(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	for _, qry := range []string{"stream=1&size=10", "stream=1&spool=1", "stream=1&e2e=1", "stream=1&txt=1"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/setup?filename=a&"+qry, nil)
+		req.Header.Set("x-fileway-secret", "mysecret")
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s -> HTTP %d", qry, w.Code)
+		}
+	}
+}
+
+// A stream that breaks down doesn't look complete to the downloader: the
+// connection is cut, rather than ended.
+func TestStreamBrokenDown(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(bytes.Repeat([]byte("x"), 100000))
+		pw.CloseWithError(errors.New("tar died"))
+	}()
+	c := client.New(srv.URL, "mysecret")
+	up, err := c.SendStream(context.Background(), pr, "a.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.New(srv.URL, "").Receive(context.Background(), up.URL, io.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("receive: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if err := up.Wait(); err == nil || !strings.Contains(err.Error(), "tar died") {
+		t.Errorf("send: got %v", err)
+	}
+}
+
+// A whole upload in a single PUT, as curl -T does: the link comes back first,
+// and the rest of the answer tells how it went. Without a length, it's a
+// stream.
+func TestPut(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	payload := bytes.Repeat([]byte("fileway"), 50000)
+	for _, body := range []io.Reader{bytes.NewReader(payload), io.MultiReader(bytes.NewReader(payload))} {
+		req, _ := http.NewRequest("PUT", srv.URL+"/put/a.bin", body)
+		req.Header.Set("x-fileway-secret", "mysecret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bufio.NewReader(res.Body)
+		link, _ := lines.ReadString('\n')
+		if res.StatusCode != http.StatusCreated || strings.TrimSpace(link) != res.Header.Get("Location") {
+			t.Fatalf("HTTP %d, link %q, location %q", res.StatusCode, link, res.Header.Get("Location"))
+		}
+
+		var got bytes.Buffer
+		dl, err := client.New(srv.URL, "").Receive(context.Background(), strings.TrimSpace(link), &got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), payload) || dl.Filename != "a.bin" {
+			t.Errorf("received %d bytes of %q", got.Len(), dl.Filename)
+		}
+		rest, err := io.ReadAll(lines)
+		res.Body.Close()
+		if err != nil || !strings.Contains(string(rest), "All delivered") {
+			t.Errorf("answer %q, %v", rest, err)
+		}
+	}
+
+	for secret, qry := range map[string]string{"wrong": "", "mysecret": "?e2e=1"} {
+		req, _ := http.NewRequest("PUT", srv.URL+"/put/a.bin"+qry, bytes.NewReader(payload))
+		req.Header.Set("x-fileway-secret", secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s%s -> HTTP %d", secret, qry, res.StatusCode)
+		}
+	}
+}
+
+// A PUT that breaks halfway can't be resumed: the transfer fails, and the
+// downloader is not left with a short file that looks whole.
+func TestPutBrokenDown(t *testing.T) {
+	s := newTestServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("PUT", srv.URL+"/put/a.bin", pr)
+	req.ContentLength = 1000000
+	req.Header.Set("x-fileway-secret", "mysecret")
+	// It breaks once the download started
+	ids := make(chan string, 1)
+	go func() {
+		pw.Write(make([]byte, 100000))
+		conduit := s.conduits.GetConduit(<-ids)
+		for conduit.Phase() == fw.PhaseWaiting {
+			time.Sleep(10 * time.Millisecond)
+		}
+		pw.CloseWithError(errors.New("the disk died"))
+	}()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	link, _ := bufio.NewReader(res.Body).ReadString('\n')
+	id := link[strings.LastIndex(link, "/")+1 : len(link)-1]
+	ids <- id
+
+	_, err = client.New(srv.URL, "").Receive(context.Background(), strings.TrimSpace(link), io.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("receive: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	if result, ok := s.conduits.Tombstone(id); !ok || result.Reason != fw.ReasonUploaderDisconnected {
+		t.Errorf("outcome %+v", result)
+	}
+}
+
+// The relay of a payload, from the uploader to the downloaders, through HTTP
+// on the loopback: with the chunks of /ul/, as fileway send does, to one
+// downloader or to two, and with a single /put. Besides the throughput, it
+// reports the heap allocated per GB relayed, by the server and the clients,
+// as alloc-MB/GB; see server.adoc, "Memory".
+func BenchmarkRelay(b *testing.B) {
+	const size = 256 << 20
+	payload := make([]byte, size)
+
+	relay := func(b *testing.B, downloads int, send func(srv string) (string, func() error)) {
+		s := newTestServer(b)
+		srv := httptest.NewServer(s)
+		defer srv.Close()
+
+		b.SetBytes(size)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			link, wait := send(srv.URL)
+			errs := make(chan error, downloads)
+			for range downloads {
+				go func() {
+					_, err := client.New(srv.URL, "").Receive(context.Background(), link, io.Discard)
+					errs <- err
+				}()
+			}
+			for range downloads {
+				if err := <-errs; err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := wait(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		runtime.ReadMemStats(&after)
+		gbs := float64(b.N) * size * float64(downloads) / (1 << 30)
+		b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/(1<<20)/gbs, "alloc-MB/GB")
+	}
+
+	for _, downloads := range []int{1, 2} {
+		b.Run(fmt.Sprintf("ul-%d", downloads), func(b *testing.B) {
+			relay(b, downloads, func(srv string) (string, func() error) {
+				c := client.New(srv, "mysecret")
+				c.Downloads = downloads
+				up, err := c.Send(context.Background(), bytes.NewReader(payload), "a.bin", size)
+				if err != nil {
+					b.Fatal(err)
+				}
+				return up.URL, up.Wait
+			})
+		})
+	}
+	b.Run("put", func(b *testing.B) {
+		relay(b, 1, func(srv string) (string, func() error) {
+			req, _ := http.NewRequest("PUT", srv+"/put/a.bin", bytes.NewReader(payload))
+			req.Header.Set("x-fileway-secret", "mysecret")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			lines := bufio.NewReader(res.Body)
+			link, _ := lines.ReadString('\n')
+			return strings.TrimSpace(link), func() error {
+				defer res.Body.Close()
+				_, err := io.Copy(io.Discard, lines)
+				return err
+			}
+		})
+	})
+}
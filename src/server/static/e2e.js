@@ -0,0 +1,106 @@
+/*
+ Copyright 2024 @proofrock
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// End-to-end encryption, for the pages and the service worker. The payload is
+// cut in records, each sealed with AES-256-GCM on its own, with a nonce made of
+// the index of the record and of a flag for the last one. The key is in the
+// fragment of the links, that browsers never send. See uploading.adoc,
+// "End-to-end encryption".
+
+const E2E_RECORD_SIZE = 64 * 1024;
+const E2E_TAG_SIZE = 16;
+const E2E_SEALED_RECORD_SIZE = E2E_RECORD_SIZE + E2E_TAG_SIZE;
+
+function e2eNonce(index, last) {
+    const nonce = new Uint8Array(12);
+    nonce[0] = last ? 1 : 0;
+    new DataView(nonce.buffer).setBigUint64(4, BigInt(index));
+    return nonce;
+}
+
+function e2eOpenedSize(sealedSize) {
+    return sealedSize - Math.ceil(sealedSize / E2E_SEALED_RECORD_SIZE) * E2E_TAG_SIZE;
+}
+
+// A new random key, and the string for the links
+async function e2eNewKey() {
+    const raw = crypto.getRandomValues(new Uint8Array(32));
+    const key = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['encrypt']);
+    const str = btoa(String.fromCharCode(...raw)).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    return { key, str };
+}
+
+// The key from the string in a link; throws if malformed
+async function e2eKeyFromString(str) {
+    const b64 = str.replace(/-/g, '+').replace(/_/g, '/');
+    const raw = Uint8Array.from(atob(b64), c => c.charCodeAt(0));
+    if (raw.length !== 32) {
+        throw new Error('malformed key');
+    }
+    return crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+}
+
+// The len bytes at offset off of blob, sealed. Only the records they fall in
+// are sealed, so any piece can be asked for, in any order.
+async function e2eSealedSlice(blob, key, off, len) {
+    const records = Math.ceil(blob.size / E2E_RECORD_SIZE);
+    const first = Math.floor(off / E2E_SEALED_RECORD_SIZE);
+    const last = Math.floor((off + len - 1) / E2E_SEALED_RECORD_SIZE);
+    const parts = [];
+    for (let i = first; i <= last; i++) {
+        const plain = await blob.slice(i * E2E_RECORD_SIZE, (i + 1) * E2E_RECORD_SIZE).arrayBuffer();
+        const iv = e2eNonce(i, i === records - 1);
+        parts.push(await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, key, plain));
+    }
+    const start = off - first * E2E_SEALED_RECORD_SIZE;
+    return new Blob(parts).slice(start, start + len);
+}
+
+// A TransformStream that opens a sealed payload of sealedSize bytes, as it
+// streams. It errors if a record doesn't decrypt, i.e. the key is wrong or the
+// payload was altered, or if the payload is cut short.
+function e2eOpener(key, sealedSize) {
+    const records = Math.ceil(sealedSize / E2E_SEALED_RECORD_SIZE);
+    let index = 0;
+    let pending = new Uint8Array(0);
+
+    const open = async (sealed) => {
+        const iv = e2eNonce(index, index === records - 1);
+        const plain = await crypto.subtle.decrypt({ name: 'AES-GCM', iv }, key, sealed);
+        index++;
+        return new Uint8Array(plain);
+    };
+
+    return new TransformStream({
+        async transform(chunk, controller) {
+            const data = new Uint8Array(pending.length + chunk.length);
+            data.set(pending);
+            data.set(chunk, pending.length);
+            let pos = 0;
+            for (; data.length - pos >= E2E_SEALED_RECORD_SIZE; pos += E2E_SEALED_RECORD_SIZE) {
+                controller.enqueue(await open(data.subarray(pos, pos + E2E_SEALED_RECORD_SIZE)));
+            }
+            pending = data.slice(pos);
+        },
+        async flush(controller) {
+            if (pending.length > 0) {
+                controller.enqueue(await open(pending));
+            }
+            if (index !== records) {
+                throw new Error('the payload is incomplete');
+            }
+        }
+    });
+}
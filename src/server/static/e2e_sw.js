@@ -0,0 +1,61 @@
+/*
+ Copyright 2024 @proofrock
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// The service worker that decrypts an end-to-end encrypted download as it
+// streams, so that the browser saves it to disk as any other download, however
+// big. The download page hands it the key, with a one-time token, then opens
+// .../e2e/{token}; that never reaches the server, and is answered here with the
+// decrypted payload.
+
+importScripts('e2e.js');
+
+const jobs = new Map();
+
+self.addEventListener('install', () => self.skipWaiting());
+
+self.addEventListener('activate', (event) => event.waitUntil(self.clients.claim()));
+
+self.addEventListener('message', (event) => {
+    jobs.set(event.data.token, event.data);
+    event.ports[0].postMessage('ready');
+});
+
+self.addEventListener('fetch', (event) => {
+    const match = new URL(event.request.url).pathname.match(/\/e2e\/([^/]+)$/);
+    if (!match) {
+        return;
+    }
+    const job = jobs.get(match[1]);
+    jobs.delete(match[1]);
+    if (!job) {
+        event.respondWith(new Response('Download not found: reload the page and try again', { status: 404 }));
+        return;
+    }
+    event.respondWith(openDownload(job));
+});
+
+async function openDownload(job) {
+    const res = await fetch(job.url);
+    if (!res.ok) {
+        return res;
+    }
+    return new Response(res.body.pipeThrough(e2eOpener(job.key, job.size)), {
+        headers: {
+            'Content-Type': 'application/octet-stream',
+            'Content-Disposition': res.headers.get('Content-Disposition'),
+            'Content-Length': String(e2eOpenedSize(job.size))
+        }
+    });
+}
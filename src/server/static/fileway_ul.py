@@ -0,0 +1,773 @@
+#!/usr/bin/env python3
+
+#  Copyright 2024 @proofrock
+#  Licensed under the Apache License, Version 2.0 (the "License");
+#  you may not use this file except in compliance with the License.
+#  You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+#  Unless required by applicable law or agreed to in writing, software
+#  distributed under the License is distributed on an "AS IS" BASIS,
+#  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#  See the License for the specific language governing permissions and
+#  limitations under the License.
+ 
+# Base URL for all HTTP requests
+BASE_URL = "#BASE_URL#"
+
+ ############################
+### Don't modify from here ###
+ ############################
+
+import argparse, atexit, base64, getpass, hashlib, json, os, pathlib, random, stat
+import string, sys, tempfile, threading, time, urllib.error, urllib.request, zipfile
+
+# Avoid buffering (harmful when capturing stdout in tests)
+sys.stdout.reconfigure(line_buffering=True)
+
+user_agent = "FilewayUploader"
+
+# The server reports a transfer that is over as 410 (Gone) from /ping/ and /ul/,
+# for as long as it remembers it, and as 404 once it forgot it.
+EXPIRY_CODES = (404, 410)
+
+def is_expiry(e):
+    return isinstance(e, urllib.error.HTTPError) and e.code in EXPIRY_CODES
+
+# A 410 tells how the transfer ended in X-Fileway-Phase, e.g. "cancelled",
+# and why in its body, e.g. "Transfer failed: downloader disconnected at 37%".
+def expiry_message(e):
+    if e.code == 410 and e.headers.get("X-Fileway-Phase"):
+        return f"ERROR: {e.read().decode('utf-8', 'replace').strip()}.        "
+    return "ERROR: transfer expired.                "
+
+# The transfer under way, to be cancelled if the upload is interrupted.
+current_transfer = None
+
+# Ends a transfer right away: the link stops working, and a download under way
+# is cut short.
+def cancel_transfer(conduitId, secret):
+    cancel_req = urllib.request.Request(f"{BASE_URL}/ul/{conduitId}", method='DELETE')
+    cancel_req.add_header("x-fileway-secret", secret)
+    cancel_req.add_header("user-agent", user_agent)
+    with urllib.request.urlopen(cancel_req, timeout=30) as cancel_response:
+        cancel_response.read()
+
+# A chunk upload can wait for a downloader that dropped to resume, up to the
+# server's grace window, so it gets a longer timeout than the other calls.
+UL_TIMEOUT = 600
+
+# A chunk that fails to upload is sent again, at the same index, this many
+# times; the server accepts a repeated chunk without delivering it twice.
+UL_ATTEMPTS = 5
+RETRY_CODES = (408, 409, 422, 500, 502, 503, 504)
+
+# The chunk plan is asked for in this version, where the server describes it
+# rather than listing the sizes: the first chunk is 'initial' bytes, each one
+# after is 'factor' times bigger, up to 'max', and the last is what's left of
+# 'size'. A stream, of size -1, goes on with chunks of 'max'. Asked for at
+# setup too, it's 'adaptive': the server tells the size of each chunk after the
+# first as it gets the one before, after how fast the transfer goes.
+CHUNK_PLAN_VERSION = 3
+
+def next_chunk_size(plan, size):
+    if plan['factor'] < 2:
+        return plan['max']
+    return min(size * plan['factor'], plan['max'])
+
+def chunk_size_at(plan, index):
+    offset, size = 0, plan['initial']
+    while index > 0 and size < plan['max']:
+        offset += size
+        size = next_chunk_size(plan, size)
+        index -= 1
+    offset += index * size
+    if plan['size'] < 0:
+        return size
+    return max(0, min(size, plan['size'] - offset))
+
+# The size of the chunk after the one at index, that the server just got:
+# it tells it, if the plan is adaptive.
+def chunk_size_after(plan, index, told):
+    if not plan.get('adaptive'):
+        return chunk_size_at(plan, index + 1)
+    if told is None:
+        raise Exception(f"the server didn't tell the size of chunk {index + 1}")
+    return told
+
+# An RFC 9530 digest, as in Content-Digest.
+def format_digest(sha256):
+    return "sha-256=:" + base64.b64encode(sha256).decode('ascii') + ":"
+
+# With eof, data is empty and index is the one after the last chunk: it's
+# how a stream ends. It returns the size of the next chunk, if the server
+# tells it.
+def upload_chunk(conduitId, index, data, secret, eof=False):
+    # The server checks it, so that a chunk corrupted on the way is sent again
+    digest = format_digest(hashlib.sha256(data).digest())
+    for attempt in range(1, UL_ATTEMPTS + 1):
+        ul_req = urllib.request.Request(
+            f"{BASE_URL}/ul/{conduitId}/{index}",
+            method='PUT',
+            data=data
+        )
+        ul_req.add_header("x-fileway-secret", secret)
+        ul_req.add_header("user-agent", user_agent)
+        ul_req.add_header("content-digest", digest)
+        if eof:
+            ul_req.add_header("x-fileway-eof", "1")
+
+        try:
+            with urllib.request.urlopen(ul_req, timeout=UL_TIMEOUT) as ul_response:
+                ul_response.read()
+                next_size = ul_response.headers.get("x-fileway-next-chunk")
+                return int(next_size) if next_size is not None else None
+        except urllib.error.HTTPError as e:
+            if e.code not in RETRY_CODES or attempt == UL_ATTEMPTS:
+                raise e
+        except OSError as e: # network errors and timeouts
+            if attempt == UL_ATTEMPTS:
+                raise e
+        time.sleep(attempt)
+
+# End-to-end encryption: the payload is cut in records, each sealed with
+# AES-256-GCM on its own, with a nonce made of the index of the record and of a
+# flag for the last one. The key goes in the fragment of the link, that is
+# never sent to the server. AES is not in the standard library, so this needs
+# the 'cryptography' package.
+E2E_RECORD_SIZE = 64 * 1024
+E2E_SEALED_RECORD_SIZE = E2E_RECORD_SIZE + 16
+
+class E2E:
+    def __init__(self, key_str=None):
+        try:
+            from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+        except ImportError:
+            print("Error: end-to-end encryption needs the 'cryptography' package (pip install cryptography)")
+            sys.exit(1)
+        if key_str is None:
+            key = os.urandom(32)
+            key_str = base64.urlsafe_b64encode(key).decode('ascii').rstrip("=")
+        else:
+            key = base64.urlsafe_b64decode(key_str + "=" * (-len(key_str) % 4))
+        self.key_str = key_str
+        self.aead = AESGCM(key)
+
+    # The length bytes at offset off of the sealed payload, whose size bytes
+    # are read with read_at(offset, length). Only the records they fall in are
+    # sealed, so that any piece can be asked for.
+    def sealed_slice(self, read_at, size, off, length):
+        records = (size + E2E_RECORD_SIZE - 1) // E2E_RECORD_SIZE
+        first = off // E2E_SEALED_RECORD_SIZE
+        last = (off + length - 1) // E2E_SEALED_RECORD_SIZE
+        sealed = b""
+        for i in range(first, last + 1):
+            plain = read_at(i * E2E_RECORD_SIZE, E2E_RECORD_SIZE)
+            nonce = bytes([1 if i == records - 1 else 0, 0, 0, 0]) + i.to_bytes(8, "big")
+            sealed += self.aead.encrypt(nonce, plain, None)
+        start = off - first * E2E_SEALED_RECORD_SIZE
+        return sealed[start:start + length]
+
+# A spooled upload is kept by the server, that says when it's all stored.
+def check_stored(conduitId, secret):
+    ping_req = urllib.request.Request(f"{BASE_URL}/ping/{conduitId}")
+    ping_req.add_header("x-fileway-secret", secret)
+    ping_req.add_header("user-agent", user_agent)
+    with urllib.request.urlopen(ping_req, timeout=30) as ping_response:
+        ping_response.read()
+        if ping_response.headers.get("X-Fileway-Spool") != "stored":
+            print("Error: the server didn't store the whole upload")
+            sys.exit(1)
+    print("All data stored on the server, it can be downloaded later. Bye!")
+
+# The server has it all, but has the downloader? The result is a long poll,
+# that answers once the transfer is over, or every 20 seconds anyway.
+def check_delivered(conduitId, secret):
+    print("Waiting for the downloader to get it all...", end="\r")
+    while True:
+        result_req = urllib.request.Request(f"{BASE_URL}/result/{conduitId}")
+        result_req.add_header("x-fileway-secret", secret)
+        result_req.add_header("user-agent", user_agent)
+        with urllib.request.urlopen(result_req, timeout=60) as result_response:
+            result = json.loads(result_response.read())
+        if result["final"]:
+            break
+    if result["phase"] != "completed":
+        print(f"ERROR: the downloader didn't get the whole payload: {result['detail']}, {result['bytes']} of {result['size']} bytes.")
+        sys.exit(1)
+    print(f"All data delivered, in {result['duration_ms'] / 1000:.1f}s. Bye!     ")
+
+def upload_txt(text, secret, downloads=1, spool=False, e2e=None, digest=False, confirm=True, pipe=None):
+    text = text.encode("utf-8")
+    size = len(text)
+
+    try:
+        # Setup transmission
+        setup_url = f"{BASE_URL}/setup?size={size}&txt=1&downloads={downloads}&spool={int(spool)}&e2e={int(e2e is not None)}"
+        if pipe:
+            setup_url += "&pipe=" + urllib.parse.quote(pipe)
+        if digest:
+            setup_url += "&sha256=" + payload_digest(lambda o, n: text[o:o + n], size, e2e)
+        setup_req = urllib.request.Request(setup_url)
+        setup_req.add_header("x-fileway-secret", secret)
+        setup_req.add_header("user-agent", user_agent)
+        
+        try:
+            with urllib.request.urlopen(setup_req, timeout=30) as response:
+                if response.status != 200:
+                    print("Error in setting up: " + response.read().decode('utf-8'))
+                    return
+                
+                conduitId = response.read().decode('utf-8')
+                global current_transfer
+                current_transfer = conduitId
+
+                # Output the full conduit URL
+                print_links("text", conduitId, e2e, pipe)
+                if downloads > 1:
+                    print(f"The same link is for {downloads} downloaders; it starts when they are all there, or a while after the first one.")
+
+                # Poll to check server availability and get chunk size
+                chunk_plan = None
+                while True:
+                    ping_url = f"{BASE_URL}/ping/{conduitId}"
+                    ping_req = urllib.request.Request(ping_url)
+                    ping_req.add_header("x-fileway-secret", secret)
+                    ping_req.add_header("user-agent", user_agent)
+                    ping_req.add_header("x-fileway-plan", str(CHUNK_PLAN_VERSION))
+                    
+                    with urllib.request.urlopen(ping_req, timeout=30) as ping_response:
+                        ping_text = ping_response.read()
+                        if ping_text:
+                            chunk_plan = json.loads(ping_text)
+                            if chunk_plan:
+                                break
+
+
+                # The plan has always 1 chunk for texts
+                print("Uploading the text", end="\r")
+
+                if e2e is not None:
+                    text = e2e.sealed_slice(lambda o, n: text[o:o + n], size, 0, chunk_size_at(chunk_plan, 0))
+                upload_chunk(conduitId, 0, text, secret)
+
+                if spool:
+                    check_stored(conduitId, secret)
+                elif confirm:
+                    check_delivered(conduitId, secret)
+                else:
+                    print("All data sent. Bye!                     ")
+
+        except urllib.error.HTTPError as e:
+            if is_expiry(e):
+                print(expiry_message(e))
+                sys.exit(1)
+            print(f"HTTP Error: {e}")
+            sys.exit(1)
+        except urllib.error.URLError as e:
+            print(f"URL Error: {e}")
+            sys.exit(1)
+    except Exception as e:
+        print(f"Unexpected error: {e}")
+
+# Asks the server where an interrupted upload got to: the index of the next
+# chunk to send, its offset in the file and its size, if the server tells it.
+def get_progress(conduitId, secret):
+    resume_req = urllib.request.Request(f"{BASE_URL}/resume/{conduitId}")
+    resume_req.add_header("x-fileway-secret", secret)
+    resume_req.add_header("user-agent", user_agent)
+    with urllib.request.urlopen(resume_req, timeout=30) as resume_response:
+        progress = json.loads(resume_response.read())
+        return progress["chunk"], progress["offset"], progress.get("size")
+
+# The links, with the key in the fragment if end-to-end encrypted: curl can't
+# decrypt, so then it's the fileway binary.
+def print_links(what, conduitId, e2e, pipe=None):
+    link = f"{BASE_URL}/dl/{conduitId}"
+    pipe_link = f"{BASE_URL}/pipe/{urllib.parse.quote(pipe)}" if pipe else None
+    print(f"All set up! Download your {what} using:")
+    if e2e is not None:
+        link += f"#{e2e.key_str}"
+        print(f"- a browser, from {link}")
+        print(f"- a shell, with $> fileway receive {link}")
+        if pipe_link:
+            print(f"- the pipe, also before now, with $> fileway receive {pipe_link}#{e2e.key_str}")
+    else:
+        print(f"- a browser, from {link}")
+        print(f"- a shell, with $> curl {'-OJ ' if what == 'file' else ''}{link}")
+        if pipe_link:
+            print(f"- the pipe, also before now, with $> curl {'-OJ ' if what == 'file' else ''}{pipe_link}")
+
+# The SHA-256 of the payload as it's sent (i.e. sealed, if end-to-end
+# encrypted), to be declared in the setup: the server, and the downloader,
+# check what they get against it.
+def payload_digest(read_at, size, e2e):
+    h = hashlib.sha256()
+    if e2e is None:
+        for off in range(0, size, E2E_RECORD_SIZE):
+            h.update(read_at(off, E2E_RECORD_SIZE))
+    else:
+        sealed_size = size + 16 * ((size + E2E_RECORD_SIZE - 1) // E2E_RECORD_SIZE)
+        for off in range(0, sealed_size, E2E_SEALED_RECORD_SIZE):
+            h.update(e2e.sealed_slice(read_at, size, off, min(E2E_SEALED_RECORD_SIZE, sealed_size - off)))
+    return h.hexdigest()
+
+def setup_file(filepath, filesize, secret, downloads, spool, e2e, digest, pipe):
+    filename = os.path.basename(filepath)
+    setup_url = f"{BASE_URL}/setup?filename={urllib.parse.quote(filename)}&size={filesize}&txt=0&downloads={downloads}&spool={int(spool)}&e2e={int(e2e is not None)}"
+    if pipe:
+        setup_url += "&pipe=" + urllib.parse.quote(pipe)
+    if digest:
+        print("Computing the digest...")
+        with open(filepath, 'rb') as file:
+            def read_at(off, length):
+                file.seek(off)
+                return file.read(length)
+            setup_url += "&sha256=" + payload_digest(read_at, filesize, e2e)
+    setup_req = urllib.request.Request(setup_url)
+    setup_req.add_header("x-fileway-secret", secret)
+    setup_req.add_header("user-agent", user_agent)
+    setup_req.add_header("x-fileway-plan", str(CHUNK_PLAN_VERSION))
+    with urllib.request.urlopen(setup_req, timeout=30) as response:
+        return response.read().decode('utf-8')
+
+def upload_file(filepath, secret, resume_id=None, downloads=1, spool=False, e2e=None, digest=False, confirm=True, pipe=None):
+    # Extract filename from path
+    filename = os.path.basename(filepath)
+    # Get file size
+    filesize = os.path.getsize(filepath)
+
+    try:
+        try:
+            # Setup transmission, unless going on with an interrupted one
+            if resume_id:
+                conduitId = resume_id
+            else:
+                conduitId = setup_file(filepath, filesize, secret, downloads, spool, e2e, digest, pipe)
+            global current_transfer
+            current_transfer = conduitId
+
+            # Output the full conduit URL
+            print_links("file", conduitId, e2e, pipe)
+            if downloads > 1:
+                print(f"The same link is for {downloads} downloaders; it starts when they are all there, or a while after the first one.")
+
+            # Poll to check server availability and get chunk size
+            chunk_plan = None
+            accessed_at_least_once = False
+            try:
+                while True:
+                    ping_url = f"{BASE_URL}/ping/{conduitId}"
+                    ping_req = urllib.request.Request(ping_url)
+                    ping_req.add_header("x-fileway-secret", secret)
+                    ping_req.add_header("user-agent", user_agent)
+                    ping_req.add_header("x-fileway-plan", str(CHUNK_PLAN_VERSION))
+                    
+                    with urllib.request.urlopen(ping_req, timeout=30) as ping_response:
+                        accessed_at_least_once = True
+                        ping_text = ping_response.read()
+                        if ping_text:
+                            chunk_plan = json.loads(ping_text)
+                            if chunk_plan:
+                                break
+
+                # Open file and upload chunks. Encrypted, the plan and the
+                # offsets are about the sealed payload.
+                first = 0
+                with open(filepath, 'rb') as file:
+                    def read_at(off, length):
+                        file.seek(off)
+                        return file.read(length)
+
+                    offset, chunk_size = 0, chunk_size_at(chunk_plan, 0)
+                    if resume_id:
+                        first, offset, chunk_size = get_progress(conduitId, secret)
+                        if chunk_size is None:
+                            chunk_size = chunk_size_at(chunk_plan, first)
+                        if e2e is None:
+                            file.seek(offset)
+                    print("", end="\r")
+                    lap = first
+                    while chunk_size > 0:
+                        perc = round(offset*100/chunk_plan['size'], 1)
+                        print(f"Uploading chunk {lap+1}: {perc}%", end="\r")
+
+                        if e2e is not None:
+                            chunk = e2e.sealed_slice(read_at, filesize, offset, chunk_size)
+                        else:
+                            chunk = file.read(chunk_size)
+                        if len(chunk) == 0:
+                            break
+                        offset += len(chunk)
+
+                        # Send chunk
+                        told = upload_chunk(conduitId, lap, chunk, secret)
+                        chunk_size = chunk_size_after(chunk_plan, lap, told)
+                        lap += 1
+
+                if spool:
+                    check_stored(conduitId, secret)
+                elif confirm:
+                    check_delivered(conduitId, secret)
+                else:
+                    print("All data sent. Bye!                     ")
+            except urllib.error.HTTPError as e:
+                if is_expiry(e):
+                    print(expiry_message(e))
+                    sys.exit(1)
+                raise e
+            except OSError as e: # network errors and timeouts
+                print(f"Error: {e}")
+                resume_arg = conduitId if e2e is None else f"{conduitId}#{e2e.key_str}"
+                print(f"The server waits for a while; to go on, add '--resume {resume_arg}'")
+                sys.exit(1)
+
+        except urllib.error.HTTPError as e:
+            if is_expiry(e):
+                print(expiry_message(e))
+                sys.exit(1)
+            print(f"HTTP Error: {e}")
+            sys.exit(1)
+        except urllib.error.URLError as e:
+            print(f"URL Error: {e}")
+            sys.exit(1)
+    except Exception as e:
+        print(f"Unexpected error: {e}")
+
+# A stream has no size: it's sent as it's read from reader, a chunk after the
+# other, and the server is told where it ends. The downloader gets it as it
+# goes; it can't be spooled, encrypted or resumed. failed() tells whether the
+# reader broke down, so that the stream is cancelled rather than ended.
+def upload_stream(reader, filename, secret, downloads=1, confirm=True, pipe=None, failed=lambda: False):
+    try:
+        try:
+            setup_url = f"{BASE_URL}/setup?filename={urllib.parse.quote(filename)}&stream=1&txt=0&downloads={downloads}"
+            if pipe:
+                setup_url += "&pipe=" + urllib.parse.quote(pipe)
+            setup_req = urllib.request.Request(setup_url)
+            setup_req.add_header("x-fileway-secret", secret)
+            setup_req.add_header("user-agent", user_agent)
+            setup_req.add_header("x-fileway-plan", str(CHUNK_PLAN_VERSION))
+            with urllib.request.urlopen(setup_req, timeout=30) as response:
+                conduitId = response.read().decode('utf-8')
+            global current_transfer
+            current_transfer = conduitId
+
+            print_links("file", conduitId, None, pipe)
+            if downloads > 1:
+                print(f"The same link is for {downloads} downloaders; it starts when they are all there, or a while after the first one.")
+
+            # The chunks go on as big as the biggest, until the stream ends
+            chunk_plan = None
+            while not chunk_plan:
+                ping_req = urllib.request.Request(f"{BASE_URL}/ping/{conduitId}")
+                ping_req.add_header("x-fileway-secret", secret)
+                ping_req.add_header("user-agent", user_agent)
+                ping_req.add_header("x-fileway-plan", str(CHUNK_PLAN_VERSION))
+                with urllib.request.urlopen(ping_req, timeout=30) as ping_response:
+                    ping_text = ping_response.read()
+                    if ping_text:
+                        chunk_plan = json.loads(ping_text)
+
+            print("", end="\r")
+            lap, sent, chunk_size = 0, 0, chunk_size_at(chunk_plan, 0)
+            while True:
+                chunk = b""
+                while len(chunk) < chunk_size:
+                    piece = reader.read(chunk_size - len(chunk))
+                    if not piece:
+                        break
+                    chunk += piece
+                if failed():
+                    cancel_transfer(conduitId, secret)
+                    print("Error: the stream broke down, the transfer is cancelled.")
+                    sys.exit(1)
+                if len(chunk) < chunk_size:
+                    if len(chunk) > 0:
+                        upload_chunk(conduitId, lap, chunk, secret)
+                        lap += 1
+                    break
+                told = upload_chunk(conduitId, lap, chunk, secret)
+                chunk_size = chunk_size_after(chunk_plan, lap, told)
+                lap, sent = lap + 1, sent + len(chunk)
+                print(f"Uploading chunk {lap}: {sent} bytes", end="\r")
+            upload_chunk(conduitId, lap, b"", secret, eof=True)
+
+            if confirm:
+                check_delivered(conduitId, secret)
+            else:
+                print("All data sent. Bye!                     ")
+        except urllib.error.HTTPError as e:
+            if is_expiry(e):
+                print(expiry_message(e))
+                sys.exit(1)
+            print(f"HTTP Error: {e}")
+            sys.exit(1)
+        except urllib.error.URLError as e:
+            print(f"URL Error: {e}")
+            sys.exit(1)
+    except Exception as e:
+        print(f"Unexpected error: {e}")
+
+# Writes to out (a path or a file, also one that can't seek) the zip of the
+# files and the directories in paths_list.
+def write_zip(out, paths_list):
+    with zipfile.ZipFile(out, 'w', zipfile.ZIP_DEFLATED) as zipf:
+        for path in paths_list:
+            if os.path.exists(path):
+                if os.path.isfile(path):
+                    zipf.write(path, os.path.basename(path))
+                elif os.path.isdir(path):
+                    norm = os.path.normpath(path)
+                    for root, _, files in os.walk(norm):
+                        for file in files:
+                            file_path = os.path.join(root, file)
+                            arcname = os.path.relpath(file_path, os.path.dirname(norm))
+                            zipf.write(file_path, arcname)
+            else:
+                print(f"Error: Path not found: {path}")
+                return False
+    return True
+
+# The zip is streamed as it's made, from another thread through a pipe, with
+# no temporary file.
+def stream_zip(paths_list, name, secret, downloads, confirm, pipe):
+    for path in paths_list:
+        if not os.path.exists(path):
+            print(f"Error: Path not found: {path}")
+            sys.exit(1)
+    read_fd, write_fd = os.pipe()
+    outcome = {}
+    def zipper():
+        try:
+            with os.fdopen(write_fd, 'wb') as out:
+                outcome["ok"] = write_zip(out, paths_list)
+        except Exception as e:
+            print(f"Error creating ZIP file: {str(e)}")
+            outcome["ok"] = False
+    thread = threading.Thread(target=zipper, daemon=True)
+    thread.start()
+    with os.fdopen(read_fd, 'rb') as reader:
+        def failed():
+            if reader.peek(1):
+                return False
+            thread.join()
+            return not outcome.get("ok", False)
+        upload_stream(reader, name, secret, downloads, confirm, pipe, failed)
+
+def create_temp_zip(paths_list):
+    try:
+        random_string = ''.join(random.choices(string.ascii_letters + string.digits, k=4))
+        zip_filename = f"fileway_{random_string}.zip"
+        
+        temp_dir = tempfile.gettempdir()
+        zip_path = os.path.join(temp_dir, zip_filename)
+        
+        atexit.register(lambda: os.remove(zip_path) if os.path.exists(zip_path) else None)
+        
+        if not write_zip(zip_path, paths_list):
+            return None
+        
+        return zip_path
+    
+    except Exception as e:
+        print(f"Error creating ZIP file: {str(e)}")
+        return None
+
+def obfuscate(text: str) -> str:
+    return ''.join(chr(ord(c) ^ 17) for c in text)
+
+def deobfuscate(text: str) -> str:
+    return ''.join(chr(ord(c) ^ 17) for c in text)
+
+def get_secret(save_to_home):
+    if "FILEWAY_SECRET" in os.environ:
+        return os.getenv('FILEWAY_SECRET')
+    
+    if "FILEWAY_PASSWORD" in os.environ:
+        print("'FILEWAY_PASSWORD' environment variable is deprecated, use 'FILEWAY_SECRET' instead.")
+        return os.getenv('FILEWAY_PASSWORD')
+    
+    creds_file = pathlib.Path.home() / '.fileway-creds'
+
+    try:
+        with open(creds_file, 'r') as f:
+            file_mode = os.stat(creds_file).st_mode
+            if (file_mode & 0o777) != 0o400:
+                print(f"Permissions for {creds_file} must be '0400'")
+                sys.exit(1)
+            secret = deobfuscate(f.read().strip())
+            return secret
+    except FileNotFoundError:
+        secret = getpass.getpass("Please enter the secret: ")
+        if save_to_home:
+            try:
+                fd = os.open(creds_file, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o400)
+                with os.fdopen(fd, 'w') as f:
+                    f.write(obfuscate(secret))
+                print(f"Secret saved to {creds_file}")
+            except Exception as e:
+                print(f"Error saving secret: {e}")
+                sys.exit(1)
+            finally:
+                print()
+        else:
+            print("Use '--save' to save the secret to user home and avoid the prompt")
+        
+        return secret
+    
+def parse_arguments():
+    parser = argparse.ArgumentParser(description='Uploader for Fileway')
+    
+    parser.add_argument('--txt', dest='is_txt', action='store_true', 
+                       help='Send a text. Incompatible with --zip.')
+    parser.add_argument('--save', dest='is_save', action='store_true',
+                       help='Save the secret to user home.')
+    parser.add_argument('--zip', dest='is_zip', action='store_true',
+                       help='Enable zip mode. Incompatible with --txt.')
+    parser.add_argument('--downloads', dest='downloads', type=int, default=1, metavar='N',
+                       help='How many downloaders get the payload, all at once; each one uses the same link.')
+    parser.add_argument('--spool', dest='is_spool', action='store_true',
+                       help="Have the server keep the payload, so that you don't have to wait for the download; the server must allow it.")
+    parser.add_argument('--digest', dest='is_digest', action='store_true',
+                       help='Hash the payload first, so that the server and the downloader check that they get exactly that.')
+    parser.add_argument('--e2e', dest='is_e2e', action='store_true',
+                       help="End-to-end encrypt the payload: the server can't read it, and the key is in the link. Needs the 'cryptography' package.")
+    parser.add_argument('--resume', dest='resume_id', metavar='ID',
+                       help='Go on with an interrupted upload, given its id (the end of the link, with the key after the # if encrypted); same file as before.')
+    parser.add_argument('--cancel', dest='cancel_id', metavar='ID',
+                       help='Cancel an upload, given its id, instead of sending anything; the link stops working.')
+    parser.add_argument('--pipe', dest='pipe', metavar='NAME',
+                       help='Send on the named pipe NAME too, where the downloader may already be waiting, with $> curl <server>/pipe/NAME.')
+    parser.add_argument('--no-confirm', dest='is_confirm', action='store_false',
+                       help="Don't wait for the downloader to confirm it got the whole payload, just for the server to have it.")
+    parser.add_argument('--name', dest='name', metavar='NAME',
+                       help="The file name for the downloader; mandatory for stdin ('-'), fileway.zip for a zip.")
+    parser.add_argument('payloads', nargs='*', help="List of files if --zip, just one if not ('-' for stdin, streamed); a text if --txt.")
+    
+    parser.set_defaults(is_save=False, is_zip=False)
+    return parser.parse_args()
+
+if __name__ == "__main__":
+    print("== Fileway #VERSION# ==")
+    print()
+    
+    args = parse_arguments()
+
+    if args.cancel_id:
+        try:
+            cancel_transfer(args.cancel_id.split("#", 1)[0], get_secret(args.is_save))
+        except urllib.error.HTTPError as e:
+            print(expiry_message(e) if is_expiry(e) else f"HTTP Error: {e}")
+            sys.exit(1)
+        except urllib.error.URLError as e:
+            print(f"URL Error: {e}")
+            sys.exit(1)
+        print("The transfer is cancelled.")
+        sys.exit(0)
+    
+    if len(args.payloads) == 0:
+        print("No files specified")
+        sys.exit(1)
+    
+    secret = get_secret(args.is_save)
+    
+    if args.is_txt and args.is_zip:
+        print("Error: --txt and --zip are incompatible.")
+        sys.exit(1) 
+
+    if args.resume_id and (args.is_txt or args.is_zip):
+        print("Error: --resume needs the file of the interrupted upload.")
+        sys.exit(1)
+    
+    # Without a size to declare, stdin and zips are streamed, unless something
+    # needs the whole payload first.
+    streamable = not (args.is_spool or args.is_e2e or args.is_digest or args.resume_id)
+    if not args.is_txt and (args.is_zip or args.payloads == ["-"]) and streamable:
+        try:
+            if args.is_zip:
+                print("Zipping and streaming files...")
+                stream_zip(args.payloads, args.name or "fileway.zip", secret, args.downloads, args.is_confirm, args.pipe)
+            elif not args.name:
+                print("Error: --name is mandatory when reading from stdin.")
+                sys.exit(1)
+            else:
+                print("Streaming from stdin...")
+                upload_stream(sys.stdin.buffer, args.name, secret, args.downloads, args.is_confirm, args.pipe)
+        except KeyboardInterrupt:
+            print('Interrupted')
+            if current_transfer:
+                try:
+                    cancel_transfer(current_transfer, secret)
+                    print("The transfer is cancelled.")
+                except (urllib.error.URLError, OSError) as e:
+                    print(f"Error cancelling the transfer: {e}")
+            sys.exit(130)
+        sys.exit(0)
+    if args.payloads == ["-"] and not args.is_txt:
+        print("Error: stdin can't be sent with --spool, --e2e, --digest or --resume.")
+        sys.exit(1)
+
+    payload = ""
+    if args.is_txt:
+        payload = " ".join(args.payloads)
+    elif args.is_zip:
+        print("Zipping files...")
+        payload = create_temp_zip(args.payloads)
+        if payload == None:
+            sys.exit(1)
+        print(f"Created upload file '{payload}'")
+    else:
+        if len(args.payloads) > 1:
+            print("To upload multiple files, specify '--zip'")
+            sys.exit(1)
+        payload = args.payloads[0]
+    
+    if args.is_txt:
+        print("Sending secret text...")
+    else:
+        print(f"Uploading '{payload}'...")
+        # Check if file exists
+        if not os.path.exists(payload):
+            print(f"Error: File '{payload}' does not exist.")
+            sys.exit(1)
+        
+        # Check if it's a file (not a directory)
+        if not os.path.isfile(payload):
+            print(f"Error: '{payload}' is not a file.")
+            sys.exit(1)
+
+        # Check file readability
+        if not os.access(payload, os.R_OK):
+            print(f"Error: Unable to read file '{payload}'. Check file permissions.")
+            sys.exit(1)
+
+    e2e = None
+    resume_id = args.resume_id
+    if resume_id and "#" in resume_id:
+        resume_id, key_str = resume_id.split("#", 1)
+        e2e = E2E(key_str)
+    elif args.is_e2e:
+        e2e = E2E()
+
+    try:
+        if args.is_txt:
+            upload_txt(payload, secret, args.downloads, args.is_spool, e2e, args.is_digest, args.is_confirm, args.pipe)
+        else:
+            upload_file(payload, secret, resume_id, args.downloads, args.is_spool, e2e, args.is_digest, args.is_confirm, args.pipe)
+    except KeyboardInterrupt:
+        print('Interrupted')
+        # The transfer is over: the link must not go on working
+        if current_transfer:
+            try:
+                cancel_transfer(current_transfer, secret)
+                print("The transfer is cancelled.")
+            except (urllib.error.URLError, OSError) as e:
+                print(f"Error cancelling the transfer: {e}")
+        if args.is_zip and payload and os.path.exists(payload):
+            try:
+                os.remove(payload)
+            except OSError:
+                pass
+        sys.exit(130)
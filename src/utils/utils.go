@@ -16,7 +16,7 @@ package utils
 import (
 	"crypto/rand"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/big"
 	"os"
 	"strconv"
@@ -47,7 +47,8 @@ func GetIntEnv(name string, deflt int) int {
 	}
 	ret, err := strconv.Atoi(val)
 	if err != nil {
-		log.Fatalf("FATAL: %s must be an integer, got %q", name, val)
+		slog.Error(fmt.Sprintf("FATAL: %s must be an integer, got %q", name, val), "event", "fatal")
+		os.Exit(1)
 	}
 	return ret
 }
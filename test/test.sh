@@ -202,6 +202,21 @@ wait_for_grep_in_file() {
     [[ "$TEXT" == "Ciαo" ]]
 }
 
+@test "Go client upload and download" {
+    cd test/src
+    : > ../output
+    FILEWAY_SECRET="mysecret" FILEWAY_URL="http://localhost:$MAIN_PORT" \
+        ../fileway send --quiet rnd2.bin > ../output 2>/dev/null &
+    UPLOADER_PID=$!
+    wait_for_grep_in_file ../output browser 15
+    cd .. # test/
+    URL=$(cat output | grep "a browser" | awk '{print $5}')
+    ./fileway receive --quiet "$URL"
+    HASH1=$(cd src/ && md5sum rnd2.bin)
+    HASH2=$(md5sum rnd2.bin)
+    [[ "$HASH1" == "$HASH2" ]]
+}
+
 # When nobody downloads within UPLOAD_TIMEOUT_SECS the server drops the conduit
 # and answers 410 from /ping/. The uploader has to report that and exit non-zero
 # instead of falling through to a generic error. This is the one path where the